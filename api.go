@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	apiHealthTimeout   = 5 * time.Second
+	apiSnapshotTimeout = 10 * time.Second
+)
+
+// apiClient describes a RTSP client in the responses of the API
+type apiClient struct {
+	Id             string `json:"id"`
+	State          string `json:"state"`
+	Path           string `json:"path"`
+	RemoteAddr     string `json:"remoteAddr"`
+	ConnectedSince string `json:"connectedSince"`
+	LastActivity   string `json:"lastActivity"`
+}
+
+type api struct {
+	p        *program
+	listener net.Listener
+	server   *http.Server
+
+	done chan struct{}
+}
+
+func newApi(p *program) (*api, error) {
+	listener, err := net.Listen("tcp", p.conf.ApiAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &api{
+		p:        p,
+		listener: listener,
+		done:     make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", a.onHealth)
+	mux.HandleFunc("/v1/info", a.onInfo)
+	mux.HandleFunc("/v1/clients", a.onClients)
+	mux.HandleFunc("/v1/paths/", a.onPaths)
+
+	a.server = &http.Server{
+		Handler: mux,
+	}
+
+	a.log("opened on %s", listener.Addr())
+	return a, nil
+}
+
+func (a *api) log(format string, args ...interface{}) {
+	a.p.log("[API] "+format, args...)
+}
+
+func (a *api) run() {
+	err := a.server.Serve(a.listener)
+	if err != http.ErrServerClosed {
+		a.log("ERR: %s", err)
+	}
+
+	close(a.done)
+}
+
+func (a *api) close() {
+	a.server.Close()
+	<-a.done
+}
+
+func (a *api) writeJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (a *api) writeError(w http.ResponseWriter, code int, err error) {
+	a.writeJson(w, code, map[string]string{"error": err.Error()})
+}
+
+// the server is healthy when the event loop is responsive and all the
+// required sources are ready
+func (a *api) onHealth(w http.ResponseWriter, r *http.Request) {
+	// buffered, since the event loop may answer after the timeout
+	res := make(chan []string, 1)
+
+	var notReady []string
+	ok := func() bool {
+		t := time.NewTimer(apiHealthTimeout)
+		defer t.Stop()
+
+		select {
+		case a.p.events <- programEventApiHealth{res}:
+		case <-t.C:
+			return false
+		}
+
+		select {
+		case notReady = <-res:
+			return notReady != nil
+		case <-t.C:
+			return false
+		}
+	}()
+
+	if !ok {
+		a.writeJson(w, http.StatusServiceUnavailable, map[string]string{"status": "event loop is not responding"})
+		return
+	}
+
+	if len(notReady) > 0 {
+		a.writeJson(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"status":          "some required sources are not ready",
+			"sourcesNotReady": notReady,
+		})
+		return
+	}
+
+	a.writeJson(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// the configuration doesn't change after startup, therefore it can be read
+// without passing through the event loop
+func (a *api) onInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	conf := a.p.conf
+
+	var rtspPorts []int
+	for _, l := range conf.rtspListenersParsed {
+		rtspPorts = append(rtspPorts, l.port)
+	}
+
+	// the path 'all' is not a real path
+	pathCount := len(conf.Paths)
+	if _, ok := conf.Paths["all"]; ok {
+		pathCount--
+	}
+
+	a.writeJson(w, http.StatusOK, map[string]interface{}{
+		"version":   Version,
+		"goVersion": runtime.Version(),
+		"buildTime": BuildTime,
+		"startTime": a.p.startTime.UTC().Format(time.RFC3339),
+		"uptime":    int64(time.Since(a.p.startTime) / time.Second),
+		"bytesOut":  a.p.stats.getBytesOut(),
+		"conf": map[string]interface{}{
+			"protocols": conf.Protocols,
+			"rtspPorts": rtspPorts,
+			"rtpPort":   conf.RtpPort,
+			"rtcpPort":  conf.RtcpPort,
+			"paths":     pathCount,
+		},
+	})
+}
+
+// clients are listed in order of connection; the id is the one printed in
+// the log lines of the client
+func (a *api) onClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	res := make(chan []apiClient)
+	a.p.events <- programEventApiClients{res}
+	clients := <-res
+	if clients == nil {
+		a.writeError(w, http.StatusServiceUnavailable, fmt.Errorf("terminated"))
+		return
+	}
+
+	a.writeJson(w, http.StatusOK, map[string]interface{}{"clients": clients})
+}
+
+// /v1/paths/<path>/<action>
+func (a *api) onPaths(w http.ResponseWriter, r *http.Request) {
+	// the action is the last component, since sub-sources contain a slash
+	rest := strings.TrimPrefix(r.URL.Path, "/v1/paths/")
+	n := strings.LastIndex(rest, "/")
+	if n <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	path, action := rest[:n], rest[n+1:]
+
+	switch action {
+	case "mute", "unmute":
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		res := make(chan error)
+		a.p.events <- programEventApiPathMute{res, path, action == "mute"}
+		err := <-res
+		if err != nil {
+			a.writeError(w, http.StatusNotFound, err)
+			return
+		}
+
+		a.writeJson(w, http.StatusOK, map[string]bool{"muted": action == "mute"})
+
+	case "drain", "undrain":
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		res := make(chan error)
+		a.p.events <- programEventApiPathDrain{res, path, action == "drain"}
+		err := <-res
+		if err == errPathNotConfigured {
+			a.writeError(w, http.StatusNotFound, fmt.Errorf("path '%s' is not configured", path))
+			return
+		}
+		if err != nil {
+			a.writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+
+		a.writeJson(w, http.StatusOK, map[string]bool{"draining": action == "drain"})
+
+	case "sdp":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		res := make(chan []byte)
+		a.p.events <- programEventApiPathSdp{res, path}
+		sdpText := <-res
+		if sdpText == nil {
+			a.writeError(w, http.StatusNotFound, fmt.Errorf("no one is streaming on path '%s'", path))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/sdp")
+		w.WriteHeader(http.StatusOK)
+		w.Write(sdpText)
+
+	case "keyframe.h264", "snapshot.jpg":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if action == "snapshot.jpg" && a.p.conf.SnapshotFfmpegPath == "" {
+			a.writeError(w, http.StatusNotImplemented, fmt.Errorf("snapshotFfmpegPath is not set"))
+			return
+		}
+
+		res := make(chan []byte)
+		a.p.events <- programEventApiPathKeyframe{res, path}
+		keyframe := <-res
+		if keyframe == nil {
+			a.writeError(w, http.StatusNotFound, fmt.Errorf("no H264 keyframe has been received on path '%s'", path))
+			return
+		}
+
+		if action == "keyframe.h264" {
+			w.Header().Set("Content-Type", "video/h264")
+			w.WriteHeader(http.StatusOK)
+			w.Write(keyframe)
+			return
+		}
+
+		jpeg, err := a.snapshot(r.Context(), keyframe)
+		if err != nil {
+			a.writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jpeg)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// snapshot decodes a keyframe, in Annex-B format, into a JPEG image with
+// ffmpeg
+func (a *api) snapshot(ctx context.Context, keyframe []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiSnapshotTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, a.p.conf.SnapshotFfmpegPath,
+		"-hide_banner", "-loglevel", "error",
+		"-f", "h264", "-i", "-",
+		"-frames:v", "1", "-f", "image2", "-c:v", "mjpeg", "-")
+	cmd.Stdin = bytes.NewReader(keyframe)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("ffmpeg didn't produce any image")
+	}
+	return stdout.Bytes(), nil
+}
@@ -1,59 +1,309 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aler9/gortsplib"
+	"github.com/pion/sdp"
 	"gopkg.in/yaml.v2"
 )
 
+// kinds of the errors returned by loadConf and conf.fill(), that can be
+// checked with errors.Is
+var (
+	errConfNotFound         = errors.New("configuration file not found")
+	errConfSyntax           = errors.New("invalid configuration syntax")
+	errConfUnknownField     = errors.New("unknown configuration field")
+	errConfInvalidPort      = errors.New("invalid port or listener address")
+	errConfInvalidSourceUrl = errors.New("invalid source url")
+	errConfInvalid          = errors.New("invalid configuration value") // all the other errors
+)
+
+// confError is an error of the configuration, whose message is the one
+// printed to users, and whose kind can be checked with errors.Is
+type confError struct {
+	kind error
+	msg  string
+}
+
+func (e *confError) Error() string {
+	return e.msg
+}
+
+func (e *confError) Is(target error) bool {
+	return target == e.kind
+}
+
+func confErrorf(kind error, format string, args ...interface{}) error {
+	return &confError{kind, fmt.Sprintf(format, args...)}
+}
+
+// confErrorHint returns a suggestion on how to fix an error of the
+// configuration, or an empty string
+func confErrorHint(err error) string {
+	switch {
+	case errors.Is(err, errConfNotFound):
+		return "pass the path of an existing configuration file as argument, or 'stdin' to read it from the standard input"
+
+	case errors.Is(err, errConfSyntax):
+		return "the configuration file must be a valid YAML document"
+
+	case errors.Is(err, errConfInvalidPort):
+		return "ports must be between 1 and 65535 and can't be used twice"
+
+	case errors.Is(err, errConfInvalidSourceUrl):
+		return "sources must be 'publisher' (or 'record'), or rtsp://, rtsps://, http://, https:// or file:// urls"
+	}
+	return ""
+}
+
 type ConfPath struct {
-	Source           string   `yaml:"source"`
-	SourceProtocol   string   `yaml:"sourceProtocol"`
-	PublishUser      string   `yaml:"publishUser"`
-	PublishPass      string   `yaml:"publishPass"`
-	PublishIps       []string `yaml:"publishIps"`
-	publishIpsParsed []interface{}
-	ReadUser         string   `yaml:"readUser"`
-	ReadPass         string   `yaml:"readPass"`
-	ReadIps          []string `yaml:"readIps"`
-	readIpsParsed    []interface{}
-	RunOnPublish     string `yaml:"runOnPublish"`
-	RunOnRead        string `yaml:"runOnRead"`
+	Source                     string            `yaml:"source"`
+	SourceProtocol             string            `yaml:"sourceProtocol"`
+	SourceHeaders              map[string]string `yaml:"sourceHeaders"`
+	SourceUser                 string            `yaml:"sourceUser"`
+	SourcePass                 string            `yaml:"sourcePass"`
+	SourceFingerprint          string            `yaml:"sourceFingerprint"`
+	sourceFingerprintParsed    []byte
+	SourceInsecureVerify       bool              `yaml:"sourceInsecureVerify"`
+	SourceTracks               []string          `yaml:"sourceTracks"`
+	SourceFallbacks            []string          `yaml:"sourceFallbacks"`
+	SubSources                 map[string]string `yaml:"subSources"`
+	SourceOnDemand             bool              `yaml:"sourceOnDemand"`
+	SourceOnDemandStartTimeout time.Duration     `yaml:"sourceOnDemandStartTimeout"`
+	SourceOnDemandCloseAfter   time.Duration     `yaml:"sourceOnDemandCloseAfter"`
+	SourceReadersParameter     string            `yaml:"sourceReadersParameter"`
+	SourceInterleavedChannels  []int             `yaml:"sourceInterleavedChannels"`
+	PushTo                     string            `yaml:"pushTo"`
+	pushToParsed               *url.URL
+	PublishTimeout             time.Duration `yaml:"publishTimeout"`
+	RtcpInterval               time.Duration `yaml:"rtcpInterval"`
+	RtpTimestamps              string        `yaml:"rtpTimestamps"`
+	PublishUser                string        `yaml:"publishUser"`
+	PublishPass                string        `yaml:"publishPass"`
+	PublishIps                 []string      `yaml:"publishIps"`
+	publishIpsParsed           []interface{}
+	MaxBitrate                 int           `yaml:"maxBitrate"`
+	ReadUser                   string        `yaml:"readUser"`
+	ReadPass                   string        `yaml:"readPass"`
+	ReadIps                    []string      `yaml:"readIps"`
+	ReadTokenSecret            string        `yaml:"readTokenSecret"`
+	ReadTokenParam             string        `yaml:"readTokenParam"`
+	ReaderRtcpTimeout          time.Duration `yaml:"readerRtcpTimeout"`
+	RequireReaderRtcp          bool          `yaml:"requireReaderRtcp"`
+	readIpsParsed              []interface{}
+	ReadProtocols              []string `yaml:"readProtocols"`
+	readProtocolsParsed        map[streamProtocol]struct{}
+	RunOnPublish               string   `yaml:"runOnPublish"`
+	RunOnRead                  string   `yaml:"runOnRead"`
+	Redirect                   string   `yaml:"redirect"`
+	DisablePublish             bool     `yaml:"disablePublish"`
+	DisableRead                bool     `yaml:"disableRead"`
+	SdpRemoveAttributes        []string `yaml:"sdpRemoveAttributes"`
+	sdpRemoveAttributesParsed  map[string]struct{}
+	SdpAddAttributes           []string `yaml:"sdpAddAttributes"`
+	sdpAddAttributesParsed     []sdp.Attribute
+	SendParameterSets          bool `yaml:"sendParameterSets"`
+	WaitKeyframe               bool `yaml:"waitKeyframe"`
+	regexp                     *regexp.Regexp
+}
+
+type ConfRtspListener struct {
+	Address string `yaml:"address"`
+	Mode    string `yaml:"mode"`
+}
+
+type confRtspListener struct {
+	ip   net.IP
+	port int
+	mode listenerMode
 }
 
 type conf struct {
-	Protocols         []string `yaml:"protocols"`
-	protocolsParsed   map[streamProtocol]struct{}
-	RtspPort          int           `yaml:"rtspPort"`
-	RtpPort           int           `yaml:"rtpPort"`
-	RtcpPort          int           `yaml:"rtcpPort"`
-	RunOnConnect      string        `yaml:"runOnConnect"`
-	ReadTimeout       time.Duration `yaml:"readTimeout"`
-	WriteTimeout      time.Duration `yaml:"writeTimeout"`
-	StreamDeadAfter   time.Duration `yaml:"streamDeadAfter"`
-	AuthMethods       []string      `yaml:"authMethods"`
-	authMethodsParsed []gortsplib.AuthMethod
-	Pprof             bool                 `yaml:"pprof"`
-	Paths             map[string]*ConfPath `yaml:"paths"`
+	AllowUnknownFields      bool     `yaml:"allowUnknownFields"`
+	Protocols               []string `yaml:"protocols"`
+	protocolsParsed         map[streamProtocol]struct{}
+	ListenInterface         string `yaml:"listenInterface"`
+	listenIp                net.IP
+	RtspPort                int                `yaml:"rtspPort"`
+	AdditionalRtspPorts     []int              `yaml:"additionalRtspPorts"`
+	RtspListeners           []ConfRtspListener `yaml:"rtspListeners"`
+	DisableRtspPort         bool               `yaml:"disableRtspPort"`
+	rtspListenersParsed     []confRtspListener // all the TCP RTSP listeners
+	RtpPort                 int                `yaml:"rtpPort"`
+	RtcpPort                int                `yaml:"rtcpPort"`
+	RtpPortMin              int                `yaml:"rtpPortMin"`
+	RtpPortMax              int                `yaml:"rtpPortMax"`
+	RunOnConnect            string             `yaml:"runOnConnect"`
+	RunDryRun               bool               `yaml:"runDryRun"`
+	ReadTimeout             time.Duration      `yaml:"readTimeout"`
+	WriteTimeout            time.Duration      `yaml:"writeTimeout"`
+	StreamDeadAfter         time.Duration      `yaml:"streamDeadAfter"`
+	DisconnectGrace         time.Duration      `yaml:"disconnectGrace"`
+	ReaderStartDelay        time.Duration      `yaml:"readerStartDelay"`
+	TrackFirstFrameTimeout  time.Duration      `yaml:"trackFirstFrameTimeout"`
+	CloseOnSilentTrack      bool               `yaml:"closeOnSilentTrack"`
+	TcpWriteBufferSize      int                `yaml:"tcpWriteBufferSize"`
+	DisableTcpNoDelay       bool               `yaml:"disableTcpNoDelay"`
+	TcpKeepAlivePeriod      time.Duration      `yaml:"tcpKeepAlivePeriod"`
+	ConnRateLimit           int                `yaml:"connRateLimit"`
+	ConnRateWindow          time.Duration      `yaml:"connRateWindow"`
+	MaxReadersPerIp         int                `yaml:"maxReadersPerIp"`
+	ListenBacklog           int                `yaml:"listenBacklog"`
+	MaxRequestHeaderSize    int                `yaml:"maxRequestHeaderSize"`
+	ReaderQueueSize         int                `yaml:"readerQueueSize"`
+	SlowReaderPolicy        string             `yaml:"slowReaderPolicy"`
+	RtcpForwarding          string             `yaml:"rtcpForwarding"`
+	RewriteSsrc             bool               `yaml:"rewriteSsrc"`
+	ForwardReaderLoss       bool               `yaml:"forwardReaderLoss"`
+	UdpReorderDepth         int                `yaml:"udpReorderDepth"`
+	UdpReorderTimeout       time.Duration      `yaml:"udpReorderTimeout"`
+	SymmetricRtp            bool               `yaml:"symmetricRtp"`
+	EgressCap               int64              `yaml:"egressCap"`
+	EgressCapPeriod         time.Duration      `yaml:"egressCapPeriod"`
+	EgressCapCloseReaders   bool               `yaml:"egressCapCloseReaders"`
+	MaxSessionDuration      time.Duration      `yaml:"maxSessionDuration"`
+	LogRequests             bool               `yaml:"logRequests"`
+	ServerName              string             `yaml:"serverName"`
+	DisableServerHeader     bool               `yaml:"disableServerHeader"`
+	AuthMethods             []string           `yaml:"authMethods"`
+	authMethodsParsed       []gortsplib.AuthMethod
+	TlsMinVersion           string `yaml:"tlsMinVersion"`
+	tlsMinVersionParsed     uint16
+	PublishUser             string `yaml:"publishUser"`
+	PublishPass             string `yaml:"publishPass"`
+	ReadUser                string `yaml:"readUser"`
+	ReadPass                string `yaml:"readPass"`
+	AllowedPathRegexp       string `yaml:"allowedPathRegexp"`
+	allowedPathRegexpParsed *regexp.Regexp
+	StatsdAddress           string               `yaml:"statsdAddress"`
+	StatsdInterval          time.Duration        `yaml:"statsdInterval"`
+	StatsdPrefix            string               `yaml:"statsdPrefix"`
+	SourceEventsUrl         string               `yaml:"sourceEventsUrl"`
+	Api                     bool                 `yaml:"api"`
+	ApiAddress              string               `yaml:"apiAddress"`
+	HealthRequiredSources   []string             `yaml:"healthRequiredSources"`
+	SnapshotFfmpegPath      string               `yaml:"snapshotFfmpegPath"`
+	Pprof                   bool                 `yaml:"pprof"`
+	PprofAddress            string               `yaml:"pprofAddress"`
+	WebSocket               bool                 `yaml:"webSocket"`
+	WebSocketAddress        string               `yaml:"webSocketAddress"`
+	Paths                   map[string]*ConfPath `yaml:"paths"`
+	pathsRegexp             []string             // names of the paths that are regular expressions or globs, sorted
+}
+
+// yamlFields returns the yaml names of the fields of a struct
+func yamlFields(typ reflect.Type) map[string]struct{} {
+	ret := make(map[string]struct{})
+	for i := 0; i < typ.NumField(); i++ {
+		tag := typ.Field(i).Tag.Get("yaml")
+		if tag != "" {
+			ret[strings.Split(tag, ",")[0]] = struct{}{}
+		}
+	}
+	return ret
+}
+
+// checkUnknownFields returns an error if the configuration contains fields
+// that don't exist, that are usually typos
+func checkUnknownFields(byts []byte) error {
+	var raw map[string]interface{}
+	err := yaml.Unmarshal(byts, &raw)
+	if err != nil {
+		return err
+	}
+
+	known := yamlFields(reflect.TypeOf(conf{}))
+	var keys []string
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, ok := known[k]; !ok {
+			return fmt.Errorf("unknown field '%s'", k)
+		}
+	}
+
+	listeners, _ := raw["rtspListeners"].([]interface{})
+	known = yamlFields(reflect.TypeOf(ConfRtspListener{}))
+	for i, l := range listeners {
+		lconf, ok := l.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+
+		keys = nil
+		for k := range lconf {
+			keys = append(keys, fmt.Sprintf("%v", k))
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if _, ok := known[k]; !ok {
+				return fmt.Errorf("unknown field '%s' in RTSP listener %d", k, i+1)
+			}
+		}
+	}
+
+	paths, ok := raw["paths"].(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+
+	known = yamlFields(reflect.TypeOf(ConfPath{}))
+	var pathNames []string
+	for path := range paths {
+		pathNames = append(pathNames, fmt.Sprintf("%v", path))
+	}
+	sort.Strings(pathNames)
+	for _, path := range pathNames {
+		pconf, ok := paths[path].(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+
+		keys = nil
+		for k := range pconf {
+			keys = append(keys, fmt.Sprintf("%v", k))
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if _, ok := known[k]; !ok {
+				return fmt.Errorf("unknown field '%s' in path '%s'", k, path)
+			}
+		}
+	}
+
+	return nil
 }
 
 func loadConf(fpath string, stdin io.Reader) (*conf, error) {
 	conf := &conf{}
 
 	err := func() error {
+		var byts []byte
+
 		if fpath == "stdin" {
-			err := yaml.NewDecoder(stdin).Decode(conf)
+			var err error
+			byts, err = ioutil.ReadAll(stdin)
 			if err != nil {
 				return err
 			}
 
-			return nil
-
 		} else {
 			// rtsp-simple-server.yml is optional
 			if fpath == "rtsp-simple-server.yml" {
@@ -62,24 +312,156 @@ func loadConf(fpath string, stdin io.Reader) (*conf, error) {
 				}
 			}
 
-			f, err := os.Open(fpath)
+			var err error
+			byts, err = ioutil.ReadFile(fpath)
 			if err != nil {
+				if os.IsNotExist(err) {
+					return confErrorf(errConfNotFound, "%s", err)
+				}
 				return err
 			}
-			defer f.Close()
+		}
+
+		err := yaml.Unmarshal(byts, conf)
+		if err != nil {
+			return confErrorf(errConfSyntax, "%s", err)
+		}
 
-			err = yaml.NewDecoder(f).Decode(conf)
+		if !conf.AllowUnknownFields {
+			err := checkUnknownFields(byts)
 			if err != nil {
-				return err
+				return confErrorf(errConfUnknownField, "%s (set allowUnknownFields to ignore unknown fields)", err)
 			}
-
-			return nil
 		}
+
+		return nil
 	}()
 	if err != nil {
 		return nil, err
 	}
 
+	err = loadConfEnv(conf, os.Environ())
+	if err != nil {
+		return nil, err
+	}
+
+	err = conf.fill()
+	if err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+// confEnvPrefix is the prefix of the environment variables that override
+// the values of the configuration file
+const confEnvPrefix = "RTSP_"
+
+// setConfEnvField sets the field of a struct whose yaml name, in uppercase,
+// is key. Values are parsed as YAML, therefore lists can be written as
+// [a, b], except strings, that are used as they are.
+func setConfEnvField(dest reflect.Value, key string, value string) error {
+	typ := dest.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		tag := strings.Split(typ.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || strings.ToUpper(tag) != key {
+			continue
+		}
+
+		field := dest.Field(i)
+		if field.Kind() == reflect.String {
+			field.SetString(value)
+			return nil
+		}
+
+		return yaml.Unmarshal([]byte(value), field.Addr().Interface())
+	}
+	return nil
+}
+
+// loadConfEnv overrides the configuration with the environment variables
+// that start with RTSP_. The name of a variable is the prefix followed by
+// the name of a parameter in uppercase, for instance RTSP_RTSPPORT; the
+// parameters of paths are set with RTSP_PATHS_<PATH>_<PARAMETER>, for
+// instance RTSP_PATHS_CAM_SOURCE, where the path is matched with the
+// existing ones regardless of the case, and created in lowercase if it
+// doesn't exist. Variables that don't match any parameter are ignored.
+func loadConfEnv(conf *conf, environ []string) error {
+	pathFields := reflect.TypeOf(ConfPath{})
+
+	var vars []string
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, confEnvPrefix) {
+			vars = append(vars, kv)
+		}
+	}
+	sort.Strings(vars)
+
+	for _, kv := range vars {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name, value := parts[0], parts[1]
+		key := strings.TrimPrefix(name, confEnvPrefix)
+
+		if strings.HasPrefix(key, "PATHS_") {
+			key = strings.TrimPrefix(key, "PATHS_")
+
+			// the parameter is the longest suffix that is a known field,
+			// since path names can contain underscores
+			var pathName, field string
+			for i := 0; i < pathFields.NumField(); i++ {
+				tag := strings.ToUpper(strings.Split(pathFields.Field(i).Tag.Get("yaml"), ",")[0])
+				if tag != "" && strings.HasSuffix(key, "_"+tag) && len(tag) > len(field) &&
+					len(key) > len(tag)+1 {
+					field = tag
+					pathName = key[:len(key)-len(tag)-1]
+				}
+			}
+			if field == "" {
+				continue
+			}
+
+			if conf.Paths == nil {
+				conf.Paths = make(map[string]*ConfPath)
+			}
+			confName := strings.ToLower(pathName)
+			for existing := range conf.Paths {
+				if strings.ToUpper(existing) == pathName {
+					confName = existing
+					break
+				}
+			}
+			pconf := conf.Paths[confName]
+			if pconf == nil {
+				// paths without parameters are decoded as nil
+				pconf = &ConfPath{}
+				conf.Paths[confName] = pconf
+			}
+
+			err := setConfEnvField(reflect.ValueOf(pconf).Elem(), field, value)
+			if err != nil {
+				return confErrorf(errConfInvalid, "invalid value of environment variable %s: %s", name, err)
+			}
+			continue
+		}
+
+		err := setConfEnvField(reflect.ValueOf(conf).Elem(), key, value)
+		if err != nil {
+			return confErrorf(errConfInvalid, "invalid value of environment variable %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// fill validates a configuration and fills the missing values with the
+// default ones. It is called by loadConf; configurations that are built in
+// code must be passed through it before being used by newProgramWithConf.
+func (conf *conf) fill() error {
+	var err error
+
 	if len(conf.Protocols) == 0 {
 		conf.Protocols = []string{"udp", "tcp"}
 	}
@@ -93,27 +475,115 @@ func loadConf(fpath string, stdin io.Reader) (*conf, error) {
 			conf.protocolsParsed[streamProtocolTcp] = struct{}{}
 
 		default:
-			return nil, fmt.Errorf("unsupported protocol: %s", proto)
+			return confErrorf(errConfInvalid, "unsupported protocol: %s", proto)
 		}
 	}
 	if len(conf.protocolsParsed) == 0 {
-		return nil, fmt.Errorf("no protocols provided")
+		return confErrorf(errConfInvalid, "no protocols provided")
+	}
+
+	if conf.ListenInterface != "" {
+		conf.listenIp, err = interfaceIp(conf.ListenInterface)
+		if err != nil {
+			return confErrorf(errConfInvalid, "%s", err)
+		}
 	}
 
 	if conf.RtspPort == 0 {
 		conf.RtspPort = 8554
 	}
+	if conf.RtspPort < 0 || conf.RtspPort > 65535 {
+		return confErrorf(errConfInvalidPort, "invalid RTSP port: %d", conf.RtspPort)
+	}
+	for i, port := range conf.AdditionalRtspPorts {
+		if port <= 0 || port > 65535 {
+			return confErrorf(errConfInvalidPort, "invalid additional RTSP port: %d", port)
+		}
+		if port == conf.RtspPort {
+			return confErrorf(errConfInvalidPort, "additional RTSP port %d is already the main RTSP port", port)
+		}
+		for _, other := range conf.AdditionalRtspPorts[:i] {
+			if port == other {
+				return confErrorf(errConfInvalidPort, "additional RTSP port %d is listed twice", port)
+			}
+		}
+	}
+
+	if !conf.DisableRtspPort {
+		for _, port := range append([]int{conf.RtspPort}, conf.AdditionalRtspPorts...) {
+			conf.rtspListenersParsed = append(conf.rtspListenersParsed, confRtspListener{
+				ip:   conf.listenIp,
+				port: port,
+				mode: listenerModeAll,
+			})
+		}
+	}
+	for i, lconf := range conf.RtspListeners {
+		addr, err := net.ResolveTCPAddr("tcp", lconf.Address)
+		if err != nil {
+			return confErrorf(errConfInvalidPort, "invalid address of RTSP listener %d: %s", i+1, err)
+		}
+		if addr.Port == 0 {
+			return confErrorf(errConfInvalidPort, "invalid address of RTSP listener %d: port is missing", i+1)
+		}
+
+		l := confRtspListener{
+			ip:   addr.IP,
+			port: addr.Port,
+		}
+
+		switch lconf.Mode {
+		case "", "all":
+			l.mode = listenerModeAll
+
+		case "publish":
+			l.mode = listenerModePublish
+
+		case "read":
+			l.mode = listenerModeRead
+
+		default:
+			return confErrorf(errConfInvalid, "unsupported mode of RTSP listener %d: '%s'", i+1, lconf.Mode)
+		}
+
+		for _, other := range conf.rtspListenersParsed {
+			if other.port == l.port && (other.ip == nil || l.ip == nil || other.ip.Equal(l.ip)) {
+				return confErrorf(errConfInvalidPort, "address of RTSP listener %d (%s) is already used by another RTSP listener", i+1, lconf.Address)
+			}
+		}
+
+		conf.rtspListenersParsed = append(conf.rtspListenersParsed, l)
+	}
+	if len(conf.rtspListenersParsed) == 0 {
+		return confErrorf(errConfInvalid, "disableRtspPort is set but no rtspListeners are provided")
+	}
+
 	if conf.RtpPort == 0 {
 		conf.RtpPort = 8000
 	}
+	if conf.RtpPort < 0 || conf.RtpPort > 65534 {
+		return confErrorf(errConfInvalidPort, "invalid rtp port: %d", conf.RtpPort)
+	}
 	if (conf.RtpPort % 2) != 0 {
-		return nil, fmt.Errorf("rtp port must be even")
+		return confErrorf(errConfInvalidPort, "rtp port must be even")
 	}
 	if conf.RtcpPort == 0 {
 		conf.RtcpPort = 8001
 	}
 	if conf.RtcpPort != (conf.RtpPort + 1) {
-		return nil, fmt.Errorf("rtcp and rtp ports must be consecutive")
+		return confErrorf(errConfInvalidPort, "rtcp and rtp ports must be consecutive")
+	}
+	if conf.RtpPortMin != 0 || conf.RtpPortMax != 0 {
+		if (conf.RtpPortMin % 2) != 0 {
+			return confErrorf(errConfInvalidPort, "rtpPortMin must be even")
+		}
+		if conf.RtpPortMax <= conf.RtpPortMin+1 || conf.RtpPortMax > 65535 {
+			return confErrorf(errConfInvalidPort, "rtpPortMax must be greater than rtpPortMin+1 and lower than 65536")
+		}
+		if conf.RtpPort < conf.RtpPortMax && conf.RtcpPort >= conf.RtpPortMin {
+			return confErrorf(errConfInvalidPort, "rtp and rtcp ports (%d-%d) can't be inside the range rtpPortMin-rtpPortMax (%d-%d)",
+				conf.RtpPort, conf.RtcpPort, conf.RtpPortMin, conf.RtpPortMax)
+		}
 	}
 
 	if conf.ReadTimeout == 0 {
@@ -125,6 +595,171 @@ func loadConf(fpath string, stdin io.Reader) (*conf, error) {
 	if conf.StreamDeadAfter == 0 {
 		conf.StreamDeadAfter = 15 * time.Second
 	}
+	if conf.DisconnectGrace < 0 {
+		return confErrorf(errConfInvalid, "disconnect grace can't be negative")
+	}
+	if conf.TrackFirstFrameTimeout == 0 {
+		conf.TrackFirstFrameTimeout = 10 * time.Second
+	}
+	if conf.ReaderStartDelay < 0 {
+		return confErrorf(errConfInvalid, "reader start delay can't be negative")
+	}
+	if conf.TcpWriteBufferSize < 0 {
+		return confErrorf(errConfInvalid, "tcp write buffer size can't be negative")
+	}
+	if conf.TcpKeepAlivePeriod == 0 {
+		conf.TcpKeepAlivePeriod = 15 * time.Second
+	}
+	if conf.TcpKeepAlivePeriod < 0 {
+		return confErrorf(errConfInvalid, "tcp keepalive period can't be negative")
+	}
+	if conf.ListenBacklog < 0 {
+		return confErrorf(errConfInvalid, "listen backlog can't be negative")
+	}
+	if conf.ConnRateLimit < 0 {
+		return confErrorf(errConfInvalid, "connection rate limit can't be negative")
+	}
+	if conf.ConnRateWindow == 0 {
+		conf.ConnRateWindow = 10 * time.Second
+	}
+	if conf.MaxSessionDuration < 0 {
+		return confErrorf(errConfInvalid, "maximum session duration can't be negative")
+	}
+	if conf.MaxReadersPerIp < 0 {
+		return confErrorf(errConfInvalid, "maximum readers per IP can't be negative")
+	}
+	if conf.MaxRequestHeaderSize == 0 {
+		conf.MaxRequestHeaderSize = 4096
+	}
+	if conf.MaxRequestHeaderSize < 0 {
+		return confErrorf(errConfInvalid, "maximum request header size can't be negative")
+	}
+	if conf.ReaderQueueSize == 0 {
+		conf.ReaderQueueSize = 512
+	}
+	if conf.ReaderQueueSize < 0 {
+		return confErrorf(errConfInvalid, "reader queue size can't be negative")
+	}
+	if conf.SlowReaderPolicy == "" {
+		conf.SlowReaderPolicy = "dropNewest"
+	}
+	switch conf.SlowReaderPolicy {
+	case "dropOldest", "dropNewest", "disconnect":
+	default:
+		return confErrorf(errConfInvalid, "unsupported slow reader policy: %s", conf.SlowReaderPolicy)
+	}
+
+	if conf.RtcpForwarding == "" {
+		conf.RtcpForwarding = "senderReports"
+	}
+	switch conf.RtcpForwarding {
+	case "senderReports", "all", "none":
+	default:
+		return confErrorf(errConfInvalid, "unsupported RTCP forwarding mode: %s", conf.RtcpForwarding)
+	}
+
+	if conf.UdpReorderDepth < 0 {
+		return confErrorf(errConfInvalid, "udp reorder depth can't be negative")
+	}
+	if conf.UdpReorderTimeout == 0 {
+		conf.UdpReorderTimeout = 50 * time.Millisecond
+	}
+	if conf.UdpReorderTimeout < 2*time.Millisecond {
+		return confErrorf(errConfInvalid, "udp reorder timeout must be at least 2ms")
+	}
+
+	if conf.EgressCap < 0 {
+		return confErrorf(errConfInvalid, "egress cap can't be negative")
+	}
+	if conf.EgressCapPeriod == 0 {
+		conf.EgressCapPeriod = 720 * time.Hour
+	}
+	if conf.EgressCapPeriod < time.Second {
+		return confErrorf(errConfInvalid, "egress cap period must be at least 1s")
+	}
+
+	if conf.ServerName == "" {
+		conf.ServerName = "rtsp-simple-server/" + Version
+	}
+	if strings.ContainsAny(conf.ServerName, "\r\n") {
+		return confErrorf(errConfInvalid, "server name can't contain newlines")
+	}
+
+	if conf.StatsdInterval == 0 {
+		conf.StatsdInterval = 10 * time.Second
+	}
+	if conf.StatsdPrefix == "" {
+		conf.StatsdPrefix = "rtsp_simple_server"
+	}
+
+	if conf.SourceEventsUrl != "" {
+		u, err := url.Parse(conf.SourceEventsUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return confErrorf(errConfInvalid, "invalid sourceEventsUrl '%s'", conf.SourceEventsUrl)
+		}
+	}
+
+	if conf.ApiAddress == "" {
+		conf.ApiAddress = ":9997"
+	}
+	if conf.Api {
+		_, portStr, err := net.SplitHostPort(conf.ApiAddress)
+		if err != nil {
+			return confErrorf(errConfInvalidPort, "invalid apiAddress: %s", err)
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return confErrorf(errConfInvalidPort, "invalid apiAddress port: %s", portStr)
+		}
+		for _, l := range conf.rtspListenersParsed {
+			if int(port) == l.port {
+				return confErrorf(errConfInvalidPort, "apiAddress port %d is already used by RTSP", port)
+			}
+		}
+	}
+
+	if conf.PprofAddress == "" {
+		conf.PprofAddress = "127.0.0.1:9999"
+	}
+
+	if conf.WebSocketAddress == "" {
+		conf.WebSocketAddress = ":9996"
+	}
+	if conf.WebSocket {
+		_, portStr, err := net.SplitHostPort(conf.WebSocketAddress)
+		if err != nil {
+			return confErrorf(errConfInvalidPort, "invalid webSocketAddress: %s", err)
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return confErrorf(errConfInvalidPort, "invalid webSocketAddress port: %s", portStr)
+		}
+		for _, l := range conf.rtspListenersParsed {
+			if int(port) == l.port {
+				return confErrorf(errConfInvalidPort, "webSocketAddress port %d is already used by RTSP", port)
+			}
+		}
+	}
+
+	if conf.TlsMinVersion == "" {
+		conf.TlsMinVersion = "1.2"
+	}
+	switch conf.TlsMinVersion {
+	case "1.0":
+		conf.tlsMinVersionParsed = tls.VersionTLS10
+
+	case "1.1":
+		conf.tlsMinVersionParsed = tls.VersionTLS11
+
+	case "1.2":
+		conf.tlsMinVersionParsed = tls.VersionTLS12
+
+	case "1.3":
+		conf.tlsMinVersionParsed = tls.VersionTLS13
+
+	default:
+		return confErrorf(errConfInvalid, "unsupported TLS version: %s", conf.TlsMinVersion)
+	}
 
 	if len(conf.AuthMethods) == 0 {
 		conf.AuthMethods = []string{"basic", "digest"}
@@ -138,7 +773,14 @@ func loadConf(fpath string, stdin io.Reader) (*conf, error) {
 			conf.authMethodsParsed = append(conf.authMethodsParsed, gortsplib.Digest)
 
 		default:
-			return nil, fmt.Errorf("unsupported authentication method: %s", method)
+			return confErrorf(errConfInvalid, "unsupported authentication method: %s", method)
+		}
+	}
+
+	if conf.AllowedPathRegexp != "" {
+		conf.allowedPathRegexpParsed, err = regexp.Compile(conf.AllowedPathRegexp)
+		if err != nil {
+			return confErrorf(errConfInvalid, "invalid allowedPathRegexp: %s", err)
 		}
 	}
 
@@ -148,62 +790,404 @@ func loadConf(fpath string, stdin io.Reader) (*conf, error) {
 		}
 	}
 
+	// sub-sources are turned into paths named after their parent, that
+	// inherit its settings
+	subPaths := make(map[string]*ConfPath)
+	for path, pconf := range conf.Paths {
+		if pconf == nil || len(pconf.SubSources) == 0 {
+			continue
+		}
+
+		if path == "all" || isPathPattern(path) {
+			return confErrorf(errConfInvalid, "subSources can't be used in path '%s'", path)
+		}
+
+		for name, source := range pconf.SubSources {
+			if name == "" || strings.Contains(name, "/") {
+				return confErrorf(errConfInvalid, "invalid sub-source name '%s' in path '%s'", name, path)
+			}
+
+			subPath := path + "/" + name
+			if _, ok := conf.Paths[subPath]; ok {
+				return confErrorf(errConfInvalid, "sub-source '%s' of path '%s' conflicts with path '%s'", name, path, subPath)
+			}
+
+			sub := *pconf
+			sub.Source = source
+			sub.SourceFallbacks = nil
+			sub.SubSources = nil
+			sub.PushTo = ""
+			subPaths[subPath] = &sub
+		}
+	}
+	for subPath, pconf := range subPaths {
+		conf.Paths[subPath] = pconf
+	}
+
 	for path, pconf := range conf.Paths {
 		if pconf == nil {
 			conf.Paths[path] = &ConfPath{}
 			pconf = conf.Paths[path]
 		}
 
-		if pconf.Source == "" {
+		// publisher is an alias of record, that is used internally
+		if pconf.Source == "" || pconf.Source == "publisher" {
 			pconf.Source = "record"
 		}
 
+		// paths without credentials inherit the global ones
+		if pconf.PublishUser == "" && pconf.PublishPass == "" {
+			pconf.PublishUser = conf.PublishUser
+			pconf.PublishPass = conf.PublishPass
+		}
+		if pconf.ReadUser == "" && pconf.ReadPass == "" {
+			pconf.ReadUser = conf.ReadUser
+			pconf.ReadPass = conf.ReadPass
+		}
+
+		if pconf.PublishTimeout == 0 {
+			pconf.PublishTimeout = conf.StreamDeadAfter
+		}
+
+		if pconf.ReaderRtcpTimeout == 0 {
+			pconf.ReaderRtcpTimeout = conf.StreamDeadAfter
+		}
+
+		switch pconf.RtpTimestamps {
+		case "":
+			pconf.RtpTimestamps = "passthrough"
+		case "passthrough", "rewrite":
+		default:
+			return confErrorf(errConfInvalid, "rtpTimestamps of path '%s' must be 'passthrough' or 'rewrite'", path)
+		}
+
+		if pconf.RtcpInterval == 0 {
+			pconf.RtcpInterval = 10 * time.Second
+		}
+		if pconf.RtcpInterval < 1*time.Second || pconf.RtcpInterval > 5*time.Minute {
+			return confErrorf(errConfInvalid, "rtcpInterval of path '%s' must be between 1s and 5m", path)
+		}
+
+		if strings.HasPrefix(path, "~") {
+			pconf.regexp, err = regexp.Compile(path[1:])
+			if err != nil {
+				return confErrorf(errConfInvalid, "invalid regular expression in path '%s': %s", path, err)
+			}
+			conf.pathsRegexp = append(conf.pathsRegexp, path)
+		} else if isPathPattern(path) {
+			pconf.regexp = globToRegexp(path)
+			conf.pathsRegexp = append(conf.pathsRegexp, path)
+		}
+
 		if pconf.PublishUser != "" {
 			if !regexp.MustCompile("^[a-zA-Z0-9]+$").MatchString(pconf.PublishUser) {
-				return nil, fmt.Errorf("publish username must be alphanumeric")
+				return confErrorf(errConfInvalid, "publish username must be alphanumeric")
 			}
 		}
 		if pconf.PublishPass != "" {
 			if !regexp.MustCompile("^[a-zA-Z0-9]+$").MatchString(pconf.PublishPass) {
-				return nil, fmt.Errorf("publish password must be alphanumeric")
+				return confErrorf(errConfInvalid, "publish password must be alphanumeric")
 			}
 		}
 		pconf.publishIpsParsed, err = parseIpCidrList(pconf.PublishIps)
 		if err != nil {
-			return nil, err
+			return confErrorf(errConfInvalid, "%s", err)
+		}
+		if pconf.MaxBitrate < 0 {
+			return confErrorf(errConfInvalid, "max bitrate can't be negative")
 		}
 
 		if pconf.ReadUser != "" && pconf.ReadPass == "" || pconf.ReadUser == "" && pconf.ReadPass != "" {
-			return nil, fmt.Errorf("read username and password must be both filled")
+			return confErrorf(errConfInvalid, "read username and password must be both filled")
 		}
 		if pconf.ReadUser != "" {
 			if !regexp.MustCompile("^[a-zA-Z0-9]+$").MatchString(pconf.ReadUser) {
-				return nil, fmt.Errorf("read username must be alphanumeric")
+				return confErrorf(errConfInvalid, "read username must be alphanumeric")
 			}
 		}
 		if pconf.ReadPass != "" {
 			if !regexp.MustCompile("^[a-zA-Z0-9]+$").MatchString(pconf.ReadPass) {
-				return nil, fmt.Errorf("read password must be alphanumeric")
+				return confErrorf(errConfInvalid, "read password must be alphanumeric")
 			}
 		}
 		if pconf.ReadUser != "" && pconf.ReadPass == "" || pconf.ReadUser == "" && pconf.ReadPass != "" {
-			return nil, fmt.Errorf("read username and password must be both filled")
+			return confErrorf(errConfInvalid, "read username and password must be both filled")
 		}
 		pconf.readIpsParsed, err = parseIpCidrList(pconf.ReadIps)
 		if err != nil {
-			return nil, err
+			return confErrorf(errConfInvalid, "%s", err)
+		}
+
+		if pconf.ReadTokenParam == "" {
+			pconf.ReadTokenParam = "token"
+		}
+
+		if len(pconf.ReadProtocols) == 0 {
+			pconf.readProtocolsParsed = conf.protocolsParsed
+		} else {
+			pconf.readProtocolsParsed = make(map[streamProtocol]struct{})
+			for _, proto := range pconf.ReadProtocols {
+				switch proto {
+				case "udp":
+					pconf.readProtocolsParsed[streamProtocolUdp] = struct{}{}
+
+				case "tcp":
+					pconf.readProtocolsParsed[streamProtocolTcp] = struct{}{}
+
+				default:
+					return confErrorf(errConfInvalid, "unsupported protocol: %s", proto)
+				}
+			}
+			for proto := range pconf.readProtocolsParsed {
+				if _, ok := conf.protocolsParsed[proto]; !ok {
+					return confErrorf(errConfInvalid, "path '%s' has read protocol '%s' that is not enabled in protocols", path, proto)
+				}
+			}
 		}
 
 		if pconf.Source != "record" {
 			if path == "all" {
-				return nil, fmt.Errorf("path 'all' cannot have a RTSP source")
+				return confErrorf(errConfInvalid, "path 'all' cannot have a RTSP source")
+			}
+
+			if pconf.regexp != nil {
+				return confErrorf(errConfInvalid, "path '%s' is a pattern and cannot have a RTSP source", path)
+			}
+
+			u, err := url.Parse(pconf.Source)
+			if err == nil && u.Scheme == "file" {
+				if u.Host != "" || u.Path == "" {
+					return confErrorf(errConfInvalidSourceUrl, "'%s' is not a valid file url, the path must be absolute", redactUrl(pconf.Source))
+				}
+			} else if err != nil || (u.Scheme != "rtsp" && u.Scheme != "rtsps" && u.Scheme != "http" && u.Scheme != "https") {
+				return confErrorf(errConfInvalidSourceUrl, "source '%s' of path '%s' is not valid, it must be 'publisher' (or 'record'), "+
+					"or a rtsp://, rtsps://, http://, https:// or file:// url", redactUrl(pconf.Source), path)
+			} else if u.Host == "" {
+				return confErrorf(errConfInvalidSourceUrl, "'%s' is not a valid RTSP url", redactUrl(pconf.Source))
+			}
+
+			if (pconf.SourceUser != "" && pconf.SourcePass == "") ||
+				(pconf.SourceUser == "" && pconf.SourcePass != "") {
+				return confErrorf(errConfInvalid, "sourceUser and sourcePass of path '%s' must be both provided", path)
+			}
+			if pconf.SourceUser != "" {
+				if u.Scheme == "file" {
+					return confErrorf(errConfInvalid, "sourceUser and sourcePass of path '%s' can't be used with a file source", path)
+				}
+				if u.User != nil {
+					return confErrorf(errConfInvalid, "sourceUser and sourcePass of path '%s' can't be used together with credentials inside the source url", path)
+				}
+			}
+
+			if pconf.SourceFingerprint != "" {
+				if u.Scheme != "rtsps" && u.Scheme != "https" {
+					return confErrorf(errConfInvalid, "sourceFingerprint of path '%s' can be used only with rtsps and https sources", path)
+				}
+
+				// colons are allowed, since fingerprints are usually printed with them
+				byts, err := hex.DecodeString(strings.Replace(pconf.SourceFingerprint, ":", "", -1))
+				if err != nil || len(byts) != 32 {
+					return confErrorf(errConfInvalid, "sourceFingerprint of path '%s' is not a valid SHA256 hash", path)
+				}
+				pconf.sourceFingerprintParsed = byts
+			}
+
+			if pconf.SourceInsecureVerify {
+				if u.Scheme != "rtsps" && u.Scheme != "https" {
+					return confErrorf(errConfInvalid, "sourceInsecureVerify of path '%s' can be used only with rtsps and https sources", path)
+				}
+				if pconf.SourceFingerprint != "" {
+					return confErrorf(errConfInvalid, "sourceInsecureVerify and sourceFingerprint of path '%s' can't be used together", path)
+				}
+			}
+
+			if pconf.SourceReadersParameter != "" {
+				if u.Scheme == "file" {
+					return confErrorf(errConfInvalid, "sourceReadersParameter of path '%s' can't be used with a file source", path)
+				}
+				if strings.ContainsAny(pconf.SourceReadersParameter, ":\r\n") {
+					return confErrorf(errConfInvalid, "sourceReadersParameter of path '%s' is not a valid parameter name", path)
+				}
+			}
+
+			if len(pconf.SourceTracks) > 0 {
+				if u.Scheme == "file" {
+					return confErrorf(errConfInvalid, "sourceTracks of path '%s' can't be used with a file source", path)
+				}
+				for _, typ := range pconf.SourceTracks {
+					if typ != "video" && typ != "audio" && typ != "application" {
+						return confErrorf(errConfInvalid, "path '%s' has an unsupported track type in sourceTracks: '%s'", path, typ)
+					}
+				}
+			}
+
+			if len(pconf.SourceFallbacks) > 0 {
+				if u.Scheme == "file" {
+					return confErrorf(errConfInvalid, "sourceFallbacks of path '%s' can't be used with a file source", path)
+				}
+				for _, fallback := range pconf.SourceFallbacks {
+					fu, err := url.Parse(fallback)
+					if err != nil || (fu.Scheme != "rtsp" && fu.Scheme != "rtsps" && fu.Scheme != "http" && fu.Scheme != "https") || fu.Host == "" {
+						return confErrorf(errConfInvalidSourceUrl, "'%s' is not a valid RTSP url", redactUrl(fallback))
+					}
+					if pconf.SourceUser != "" && fu.User != nil {
+						return confErrorf(errConfInvalid, "sourceUser and sourcePass of path '%s' can't be used together with credentials inside the source url", path)
+					}
+					if (pconf.SourceFingerprint != "" || pconf.SourceInsecureVerify) &&
+						fu.Scheme != "rtsps" && fu.Scheme != "https" {
+						return confErrorf(errConfInvalid, "sourceFingerprint and sourceInsecureVerify of path '%s' require all the sourceFallbacks to be rtsps or https", path)
+					}
+				}
 			}
 
 			if pconf.SourceProtocol == "" {
 				pconf.SourceProtocol = "udp"
 			}
+
+			if len(pconf.SourceInterleavedChannels) > 0 {
+				if u.Scheme == "file" || pconf.SourceProtocol != "tcp" {
+					return confErrorf(errConfInvalid, "sourceInterleavedChannels of path '%s' can be used only with sourceProtocol tcp", path)
+				}
+				used := make(map[int]struct{})
+				for _, ch := range pconf.SourceInterleavedChannels {
+					_, ok1 := used[ch]
+					_, ok2 := used[ch+1]
+					if ch < 0 || ch > 254 || ok1 || ok2 {
+						return confErrorf(errConfInvalid, "path '%s' has an invalid channel in sourceInterleavedChannels: %d", path, ch)
+					}
+					used[ch] = struct{}{}
+					used[ch+1] = struct{}{}
+				}
+			}
+
+			for k, v := range pconf.SourceHeaders {
+				if !regexp.MustCompile("^[a-zA-Z0-9-]+$").MatchString(k) {
+					return confErrorf(errConfInvalid, "invalid source header name '%s'", k)
+				}
+				if strings.ContainsAny(v, "\r\n") {
+					return confErrorf(errConfInvalid, "value of source header '%s' can't contain newlines", k)
+				}
+			}
+		}
+
+		attrKeyRegexp := regexp.MustCompile("^[a-zA-Z0-9-]+$")
+		if len(pconf.SdpRemoveAttributes) > 0 {
+			pconf.sdpRemoveAttributesParsed = make(map[string]struct{})
+			for _, key := range pconf.SdpRemoveAttributes {
+				if !attrKeyRegexp.MatchString(key) {
+					return confErrorf(errConfInvalid, "path '%s' has an invalid SDP attribute to remove: '%s'", path, key)
+				}
+				if key == "control" {
+					return confErrorf(errConfInvalid, "path '%s' cannot remove the SDP attribute 'control', that is required by readers", path)
+				}
+				pconf.sdpRemoveAttributesParsed[key] = struct{}{}
+			}
+		}
+		for _, attr := range pconf.SdpAddAttributes {
+			kv := strings.SplitN(attr, ":", 2)
+			if !attrKeyRegexp.MatchString(kv[0]) || strings.ContainsAny(attr, "\r\n") {
+				return confErrorf(errConfInvalid, "path '%s' has an invalid SDP attribute to add: '%s'", path, attr)
+			}
+			if kv[0] == "control" {
+				return confErrorf(errConfInvalid, "path '%s' cannot add the SDP attribute 'control', that is generated by the server", path)
+			}
+
+			a := sdp.Attribute{Key: kv[0]}
+			if len(kv) == 2 {
+				a.Value = kv[1]
+			}
+			pconf.sdpAddAttributesParsed = append(pconf.sdpAddAttributesParsed, a)
+		}
+
+		if pconf.SourceOnDemand && pconf.Source == "record" {
+			return confErrorf(errConfInvalid, "path '%s' has sourceOnDemand enabled but no RTSP source", path)
+		}
+		if pconf.SourceOnDemandStartTimeout == 0 {
+			pconf.SourceOnDemandStartTimeout = 10 * time.Second
+		}
+		if pconf.SourceOnDemandCloseAfter == 0 {
+			pconf.SourceOnDemandCloseAfter = 10 * time.Second
+		}
+
+		if pconf.PushTo != "" {
+			if path == "all" || pconf.regexp != nil {
+				return confErrorf(errConfInvalid, "path '%s' can't have pushTo, since it doesn't refer to a single path", path)
+			}
+			if pconf.SourceOnDemand {
+				return confErrorf(errConfInvalid, "path '%s' cannot have both pushTo and sourceOnDemand", path)
+			}
+
+			u, err := url.Parse(pconf.PushTo)
+			if err != nil || u.Scheme != "rtsp" || u.Host == "" {
+				return confErrorf(errConfInvalid, "pushTo of path '%s' is not a valid RTSP url: '%s'", path, redactUrl(pconf.PushTo))
+			}
+			if u.Port() == "" {
+				u.Host += ":554"
+			}
+			pconf.pushToParsed = u
+		}
+
+		if pconf.DisablePublish && pconf.DisableRead {
+			return confErrorf(errConfInvalid, "path '%s' cannot have both disablePublish and disableRead", path)
+		}
+		if pconf.DisablePublish && pconf.Source != "record" {
+			return confErrorf(errConfInvalid, "path '%s' cannot have both a RTSP source and disablePublish", path)
+		}
+		if pconf.DisableRead && pconf.Redirect != "" {
+			return confErrorf(errConfInvalid, "path '%s' cannot have both a redirect and disableRead", path)
+		}
+
+		if pconf.Redirect != "" {
+			if pconf.Source != "record" {
+				return confErrorf(errConfInvalid, "path '%s' cannot have both a RTSP source and a redirect", path)
+			}
+
+			u, err := url.Parse(pconf.Redirect)
+			if err != nil || u.Scheme != "rtsp" {
+				return confErrorf(errConfInvalid, "'%s' is not a valid RTSP url", pconf.Redirect)
+			}
 		}
 	}
 
-	return conf, nil
+	for _, path := range conf.HealthRequiredSources {
+		pconf, ok := conf.Paths[path]
+		if !ok || pconf.Source == "record" {
+			return confErrorf(errConfInvalid, "path '%s' in healthRequiredSources doesn't have a RTSP source", path)
+		}
+	}
+
+	// regular expressions and globs are matched in alphabetical order
+	sort.Strings(conf.pathsRegexp)
+
+	return nil
+}
+
+func (conf *conf) findConfForPath(path string) *ConfPath {
+	if pconf := conf.findNamedConfForPath(path); pconf != nil {
+		return pconf
+	}
+
+	if pconf, ok := conf.Paths["all"]; ok {
+		return pconf
+	}
+
+	return nil
+}
+
+// findNamedConfForPath is like findConfForPath, without falling back on the
+// path 'all'
+func (conf *conf) findNamedConfForPath(path string) *ConfPath {
+	if pconf, ok := conf.Paths[path]; ok && pconf.regexp == nil {
+		return pconf
+	}
+
+	// check regular expressions and globs, the first one that matches wins
+	for _, name := range conf.pathsRegexp {
+		pconf := conf.Paths[name]
+		if pconf.regexp.MatchString(path) {
+			return pconf
+		}
+	}
+
+	return nil
 }
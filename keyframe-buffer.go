@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/pion/sdp"
+)
+
+const (
+	// keyframes bigger than this are discarded
+	keyframeBufferMaxSize = 4 * 1024 * 1024
+)
+
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// keyframeBuffer keeps the last keyframe of a H264 track of a publisher, in
+// order to serve snapshots without opening a RTSP session. Only the IDR NAL
+// units are depacketized, therefore the other frames are not copied.
+// It is owned by the program.
+type keyframeBuffer struct {
+	sets *parameterSets
+
+	seq      uint16
+	ts       uint32
+	started  bool     // seq and ts have been set
+	broken   bool     // a packet of the current access unit has been lost
+	idr      [][]byte // IDR NAL units of the current access unit
+	size     int
+	fragment []byte // FU-A that is being received, only if it contains an IDR or a parameter set
+
+	last []byte // last complete keyframe, in Annex-B format
+}
+
+// newKeyframeBuffer returns nil if the media is not H264
+func newKeyframeBuffer(m *sdp.MediaDescription) *keyframeBuffer {
+	if !sdpMediaIsH264(m) {
+		return nil
+	}
+	return &keyframeBuffer{
+		sets: newParameterSets(m),
+	}
+}
+
+// keyframe returns the last keyframe, preceded by the SPS and the PPS, in
+// Annex-B format, or nil if no keyframe has been received yet. The returned
+// slice is never modified.
+func (kb *keyframeBuffer) keyframe() []byte {
+	return kb.last
+}
+
+func (kb *keyframeBuffer) onRtp(frame []byte) {
+	payload := rtpPayload(frame)
+	if payload == nil {
+		return
+	}
+	seq := binary.BigEndian.Uint16(frame[2:4])
+	ts := binary.BigEndian.Uint32(frame[4:8])
+	marker := (frame[1] & 0x80) != 0
+
+	if kb.started && ts != kb.ts {
+		kb.flush()
+	}
+	if kb.started && seq != kb.seq+1 {
+		kb.broken = true
+		kb.fragment = nil
+	}
+	kb.started = true
+	kb.seq = seq
+	kb.ts = ts
+
+	switch payload[0] & 0x1f {
+	case 24: // STAP-A
+		aggregated := payload[1:]
+		for len(aggregated) >= 2 {
+			size := int(binary.BigEndian.Uint16(aggregated))
+			if size == 0 || len(aggregated) < 2+size {
+				break
+			}
+			kb.onNalu(aggregated[2 : 2+size])
+			aggregated = aggregated[2+size:]
+		}
+
+	case 28: // FU-A
+		if len(payload) < 2 {
+			break
+		}
+		start := (payload[1] & 0x80) != 0
+		end := (payload[1] & 0x40) != 0
+
+		if start {
+			kb.fragment = nil
+			typ := payload[1] & 0x1f
+			if typ == 5 || typ == 7 || typ == 8 {
+				kb.fragment = append([]byte{(payload[0] & 0xe0) | typ}, payload[2:]...)
+			}
+		} else if kb.fragment != nil {
+			kb.fragment = append(kb.fragment, payload[2:]...)
+		}
+
+		if kb.fragment != nil && len(kb.fragment) > keyframeBufferMaxSize {
+			kb.fragment = nil
+			kb.broken = true
+		}
+
+		if end && kb.fragment != nil {
+			kb.onNalu(kb.fragment)
+			kb.fragment = nil
+		}
+
+	default:
+		kb.onNalu(payload)
+	}
+
+	if marker {
+		kb.flush()
+	}
+}
+
+func (kb *keyframeBuffer) onNalu(nalu []byte) {
+	if kb.sets != nil {
+		kb.sets.store(nalu)
+	}
+
+	if nalu[0]&0x1f != 5 {
+		return
+	}
+
+	kb.size += len(nalu)
+	if kb.size > keyframeBufferMaxSize {
+		kb.broken = true
+		return
+	}
+	kb.idr = append(kb.idr, append([]byte(nil), nalu...))
+}
+
+// flush is called when an access unit is complete
+func (kb *keyframeBuffer) flush() {
+	if len(kb.idr) > 0 && !kb.broken {
+		var nalus [][]byte
+		if kb.sets != nil {
+			for _, set := range kb.sets.sets[:2] {
+				if set != nil {
+					nalus = append(nalus, set)
+				}
+			}
+		}
+		nalus = append(nalus, kb.idr...)
+
+		var ret []byte
+		for _, nalu := range nalus {
+			ret = append(ret, annexBStartCode...)
+			ret = append(ret, nalu...)
+		}
+		kb.last = ret
+	}
+
+	kb.idr = nil
+	kb.size = 0
+	kb.broken = false
+	kb.fragment = nil
+}
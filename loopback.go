@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aler9/gortsplib"
+)
+
+const (
+	loopbackPath          = "loopback-test"
+	loopbackFrameCount    = 100
+	loopbackFrameInterval = 5 * time.Millisecond
+	loopbackTimeout       = 10 * time.Second
+	loopbackIdrInterval   = 25
+)
+
+// the SPS and PPS are the ones of a 320x240 H264 stream, the frames contain
+// a pattern and are not decodable. A frame every loopbackIdrInterval is
+// marked as IDR, since readers can wait for a keyframe
+const loopbackSdp = "v=0\r\n" +
+	"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+	"s=Stream\r\n" +
+	"c=IN IP4 127.0.0.1\r\n" +
+	"t=0 0\r\n" +
+	"m=video 0 RTP/AVP 96\r\n" +
+	"a=rtpmap:96 H264/90000\r\n" +
+	"a=fmtp:96 packetization-mode=1; sprop-parameter-sets=Z2QADKw7ULBLQgAAAwACAAADAD0I,aO48gA==\r\n"
+
+func loopbackFrame(seq uint16) []byte {
+	buf := make([]byte, 12+100)
+	buf[0] = 0x80
+	buf[1] = 96
+	buf[2] = byte(seq >> 8)
+	buf[3] = byte(seq)
+	buf[12] = 0x41
+	if seq%loopbackIdrInterval == 0 {
+		buf[12] = 0x65
+	}
+	for i := 13; i < len(buf); i++ {
+		buf[i] = byte(int(seq) + i)
+	}
+	return buf
+}
+
+type loopbackResult struct {
+	frames   int
+	duration time.Duration
+}
+
+// runLoopbackTest publishes a synthetic stream to the server and reads it
+// back, in order to check that frames flow through the event loop
+func (p *program) runLoopbackTest() (*loopbackResult, error) {
+	var host string
+	for _, l := range p.conf.rtspListenersParsed {
+		if l.mode != listenerModeAll {
+			continue
+		}
+
+		ip := "127.0.0.1"
+		if l.ip != nil && !l.ip.IsUnspecified() {
+			ip = l.ip.String()
+		}
+		host = net.JoinHostPort(ip, strconv.FormatInt(int64(l.port), 10))
+		break
+	}
+	if host == "" {
+		return nil, fmt.Errorf("no RTSP listener accepts both publishers and readers")
+	}
+
+	u := &url.URL{Scheme: "rtsp", Host: host, Path: "/" + loopbackPath}
+	trackUrl := &url.URL{Scheme: "rtsp", Host: host, Path: "/" + loopbackPath + "/trackID=0"}
+
+	dial := func() (*gortsplib.ConnClient, error) {
+		nconn, err := net.DialTimeout("tcp", host, p.conf.ReadTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return gortsplib.NewConnClient(gortsplib.ConnClientConf{
+			Conn:         nconn,
+			ReadTimeout:  p.conf.ReadTimeout,
+			WriteTimeout: p.conf.WriteTimeout,
+		}), nil
+	}
+
+	do := func(conn *gortsplib.ConnClient, req *gortsplib.Request) error {
+		res, err := conn.Do(req)
+		if err != nil {
+			return fmt.Errorf("%s failed: %s", req.Method, err)
+		}
+		if res.StatusCode != gortsplib.StatusOK {
+			return fmt.Errorf("%s failed: %d %s", req.Method, res.StatusCode, res.StatusMessage)
+		}
+		return nil
+	}
+
+	start := time.Now()
+
+	// publisher
+	pconn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer pconn.NetConn().Close()
+
+	err = do(pconn, &gortsplib.Request{
+		Method: gortsplib.ANNOUNCE,
+		Url:    u,
+		Header: gortsplib.Header{
+			"Content-Type":   []string{"application/sdp"},
+			"Content-Length": []string{strconv.FormatInt(int64(len(loopbackSdp)), 10)},
+		},
+		Content: []byte(loopbackSdp),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = do(pconn, &gortsplib.Request{
+		Method: gortsplib.SETUP,
+		Url:    trackUrl,
+		Header: gortsplib.Header{
+			"Transport": []string{"RTP/AVP/TCP;unicast;interleaved=0-1;mode=record"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = do(pconn, &gortsplib.Request{Method: gortsplib.RECORD, Url: u})
+	if err != nil {
+		return nil, err
+	}
+
+	// reader
+	rconn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer rconn.NetConn().Close()
+
+	err = do(rconn, &gortsplib.Request{Method: gortsplib.DESCRIBE, Url: u})
+	if err != nil {
+		return nil, err
+	}
+
+	err = do(rconn, &gortsplib.Request{
+		Method: gortsplib.SETUP,
+		Url:    trackUrl,
+		Header: gortsplib.Header{
+			"Transport": []string{"RTP/AVP/TCP;unicast;interleaved=0-1"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = do(rconn, &gortsplib.Request{Method: gortsplib.PLAY, Url: u})
+	if err != nil {
+		return nil, err
+	}
+
+	// frames that are published right after PLAY can be lost, since the
+	// reader is added to the path asynchronously. Therefore the publisher
+	// keeps publishing until enough consecutive frames are read back.
+	readDone := make(chan error, 1)
+	go func() {
+		readDone <- func() error {
+			received := 0
+			var lastSeq uint16
+
+			for received < loopbackFrameCount {
+				frame := &gortsplib.InterleavedFrame{Content: make([]byte, 2048)}
+				err := rconn.ReadFrame(frame)
+				if err != nil {
+					return fmt.Errorf("unable to read frames: %s", err)
+				}
+
+				if frame.StreamType != gortsplib.StreamTypeRtp {
+					continue
+				}
+				if len(frame.Content) < 13 {
+					return fmt.Errorf("received an invalid frame")
+				}
+
+				// parameter sets are sent before the first frame when
+				// sendParameterSets is enabled
+				if typ := frame.Content[12] & 0x1f; received == 0 && (typ == 7 || typ == 8) {
+					continue
+				}
+
+				seq := uint16(frame.Content[2])<<8 | uint16(frame.Content[3])
+				if received > 0 && seq != lastSeq+1 {
+					return fmt.Errorf("frame %d was received after frame %d", seq, lastSeq)
+				}
+				if string(frame.Content) != string(loopbackFrame(seq)) {
+					return fmt.Errorf("content of frame %d is corrupted", seq)
+				}
+
+				lastSeq = seq
+				received++
+			}
+			return nil
+		}()
+	}()
+
+	ticker := time.NewTicker(loopbackFrameInterval)
+	defer ticker.Stop()
+	timeout := time.NewTimer(loopbackTimeout)
+	defer timeout.Stop()
+
+	var seq uint16
+	for {
+		select {
+		case <-ticker.C:
+			err := pconn.WriteFrame(&gortsplib.InterleavedFrame{
+				TrackId:    0,
+				StreamType: gortsplib.StreamTypeRtp,
+				Content:    loopbackFrame(seq),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("unable to publish frames: %s", err)
+			}
+			seq++
+
+		case err := <-readDone:
+			if err != nil {
+				return nil, err
+			}
+			return &loopbackResult{
+				frames:   loopbackFrameCount,
+				duration: time.Since(start),
+			}, nil
+
+		case <-timeout.C:
+			return nil, fmt.Errorf("frames were not read back within %s", loopbackTimeout)
+		}
+	}
+}
@@ -1,24 +1,104 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
-	"net/http"
-	_ "net/http/pprof"
 	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aler9/gortsplib"
+	"github.com/pion/rtcp"
 	"github.com/pion/sdp"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 var Version = "v0.0.0"
 
+// BuildTime is set at build time with -ldflags "-X main.BuildTime=..."
+var BuildTime = ""
+
+// readers of a path that are served in parallel by each goroutine of the
+// fan-out; paths with less readers are served sequentially. It is a variable
+// in order to allow benchmarks to compare the two methods
+var forwardFrameParallelMin = 32
+
+// counters are accessed atomically, since they're written by the goroutines
+// that receive frames and can be read by any other goroutine
+type trackCounters struct {
+	rtpPacketsIn   uint64
+	rtpBytesIn     uint64
+	rtcpPacketsIn  uint64
+	rtpPacketsOut  uint64
+	rtpBytesOut    uint64
+	rtcpPacketsOut uint64
+	framesDropped  uint64
+}
+
+func (tc *trackCounters) onFrameIn(streamType gortsplib.StreamType, n int) {
+	if streamType == gortsplib.StreamTypeRtp {
+		atomic.AddUint64(&tc.rtpPacketsIn, 1)
+		atomic.AddUint64(&tc.rtpBytesIn, uint64(n))
+	} else {
+		atomic.AddUint64(&tc.rtcpPacketsIn, 1)
+	}
+}
+
+func (tc *trackCounters) onFrameOut(streamType gortsplib.StreamType, n int) {
+	if streamType == gortsplib.StreamTypeRtp {
+		atomic.AddUint64(&tc.rtpPacketsOut, 1)
+		atomic.AddUint64(&tc.rtpBytesOut, uint64(n))
+	} else {
+		atomic.AddUint64(&tc.rtcpPacketsOut, 1)
+	}
+}
+
+func (tc *trackCounters) String() string {
+	return fmt.Sprintf("RTP in: %d packets (%d bytes), RTP out: %d packets (%d bytes), RTCP in: %d packets, RTCP out: %d packets, dropped: %d frames",
+		atomic.LoadUint64(&tc.rtpPacketsIn),
+		atomic.LoadUint64(&tc.rtpBytesIn),
+		atomic.LoadUint64(&tc.rtpPacketsOut),
+		atomic.LoadUint64(&tc.rtpBytesOut),
+		atomic.LoadUint64(&tc.rtcpPacketsIn),
+		atomic.LoadUint64(&tc.rtcpPacketsOut),
+		atomic.LoadUint64(&tc.framesDropped))
+}
+
 type track struct {
+	counters trackCounters // must be the first field for 64-bit alignment
 	rtpPort  int
 	rtcpPort int
+	rtpl     *serverUdpListener // only if UDP
+	rtcpl    *serverUdpListener // only if UDP
+	reorder  *reorderBuffer     // only if UDP, publishing and enabled
+	ssrc     uint32             // only if reading and rewriteSsrc is enabled
+
+	// fraction lost of the last receiver report of the reader, accessed
+	// atomically, only if reading and forwardReaderLoss is enabled
+	readerFractionLost uint32
+
+	// only if reading, the track is H264 and waitKeyframe is enabled
+	waitKeyframe    bool
+	waitingKeyframe bool // RTP packets are discarded until a keyframe is received
+
+	// only if reading, parameter sets are sent before the first frame
+	paramSetsPending bool
+
+	// only if reading via UDP and symmetricRtp is enabled: addresses from
+	// which the reader sends packets, that replace its client ports
+	udpRtpAddr  *net.UDPAddr
+	udpRtcpAddr *net.UDPAddr
+	lastSsrc    uint32 // SSRC of the last RTP packet sent to the reader
 }
 
 type streamProtocol int
@@ -35,12 +115,18 @@ func (s streamProtocol) String() string {
 	return "tcp"
 }
 
+// frames are sent to the program through a buffered channel, separated from
+// the one of the other events, in order not to block publishers and sources
+// while the program is handling other events
+const programFrameQueueSize = 2048
+
 type programEvent interface {
 	isProgramEvent()
 }
 
 type programEventClientNew struct {
 	nconn net.Conn
+	mode  listenerMode
 }
 
 func (programEventClientNew) isProgramEvent() {}
@@ -52,13 +138,28 @@ type programEventClientClose struct {
 
 func (programEventClientClose) isProgramEvent() {}
 
+// describeRes is the result of a DESCRIBE. A nil sdpText and a nil err mean
+// that no one is publishing on the path.
+type describeRes struct {
+	sdpText   []byte
+	sdpParsed *sdp.SessionDescription
+	err       error
+}
+
 type programEventClientDescribe struct {
 	path string
-	res  chan []byte
+	res  chan describeRes
 }
 
 func (programEventClientDescribe) isProgramEvent() {}
 
+type programEventClientGetSource struct {
+	path string
+	res  chan *source
+}
+
+func (programEventClientGetSource) isProgramEvent() {}
+
 type programEventClientAnnounce struct {
 	res    chan error
 	client *serverClient
@@ -71,6 +172,7 @@ type programEventClientSetupPlay struct {
 	res      chan error
 	client   *serverClient
 	path     string
+	trackId  int // -1 means the first track that has not been setup
 	protocol streamProtocol
 	rtpPort  int
 	rtcpPort int
@@ -102,6 +204,20 @@ type programEventClientPlay2 struct {
 
 func (programEventClientPlay2) isProgramEvent() {}
 
+type programEventClientPause struct {
+	done   chan struct{}
+	client *serverClient
+}
+
+func (programEventClientPause) isProgramEvent() {}
+
+type programEventClientResume struct {
+	done   chan struct{}
+	client *serverClient
+}
+
+func (programEventClientResume) isProgramEvent() {}
+
 type programEventClientPlayStop struct {
 	done   chan struct{}
 	client *serverClient
@@ -161,10 +277,100 @@ type programEventStreamerFrame struct {
 
 func (programEventStreamerFrame) isProgramEvent() {}
 
+type programEventApiPathMute struct {
+	res   chan error
+	path  string
+	muted bool
+}
+
+func (programEventApiPathMute) isProgramEvent() {}
+
+type programEventApiPathDrain struct {
+	res      chan error
+	path     string
+	draining bool
+}
+
+func (programEventApiPathDrain) isProgramEvent() {}
+
+type programEventApiPathSdp struct {
+	res  chan []byte // nil if the path has no ready publisher
+	path string
+}
+
+func (programEventApiPathSdp) isProgramEvent() {}
+
+type programEventApiPathKeyframe struct {
+	res  chan []byte // nil if the path has no ready publisher or no keyframe has been received yet
+	path string
+}
+
+func (programEventApiPathKeyframe) isProgramEvent() {}
+
+type programEventApiClients struct {
+	res chan []apiClient
+}
+
+func (programEventApiClients) isProgramEvent() {}
+
+type programEventApiHealth struct {
+	res chan []string // paths of the required sources that are not ready
+}
+
+func (programEventApiHealth) isProgramEvent() {}
+
+type programEventSourceStopped struct {
+	source *source
+}
+
+func (programEventSourceStopped) isProgramEvent() {}
+
+type programEventWsClientNew struct {
+	res    chan error
+	client *serverWsClient
+}
+
+func (programEventWsClientNew) isProgramEvent() {}
+
+type programEventWsClientClose struct {
+	done   chan struct{}
+	client *serverWsClient
+}
+
+func (programEventWsClientClose) isProgramEvent() {}
+
+type programEventReadersLoss struct {
+	res  chan []uint8 // worst fraction lost of each track
+	path string
+}
+
+func (programEventReadersLoss) isProgramEvent() {}
+
+type programEventCheckGrace struct{}
+
+func (programEventCheckGrace) isProgramEvent() {}
+
+type programEventCheckReorder struct{}
+
+func (programEventCheckReorder) isProgramEvent() {}
+
+type programEventCheckEgress struct{}
+
+func (programEventCheckEgress) isProgramEvent() {}
+
+type programEventCheckSessionDuration struct{}
+
+func (programEventCheckSessionDuration) isProgramEvent() {}
+
 type programEventTerminate struct{}
 
 func (programEventTerminate) isProgramEvent() {}
 
+type graceWait struct {
+	deadline time.Time
+	sdpText  []byte // SDP of the publisher that is gone
+}
+
 // a publisher can be either a serverClient or a source
 type publisher interface {
 	publisherIsReady() bool
@@ -172,51 +378,152 @@ type publisher interface {
 	publisherSdpParsed() *sdp.SessionDescription
 }
 
+// stats are written by the program and can be read by any goroutine
+// without passing through the event loop
+type programStats struct {
+	clientCount    int64
+	publisherCount int64
+	receiverCount  int64
+	bytesOut       int64 // bytes sent to readers since the start
+}
+
+func (ps *programStats) get() (int64, int64, int64) {
+	return atomic.LoadInt64(&ps.clientCount),
+		atomic.LoadInt64(&ps.publisherCount),
+		atomic.LoadInt64(&ps.receiverCount)
+}
+
+func (ps *programStats) getBytesOut() int64 {
+	return atomic.LoadInt64(&ps.bytesOut)
+}
+
 type program struct {
-	conf           *conf
-	rtspl          *serverTcpListener
-	rtpl           *serverUdpListener
-	rtcpl          *serverUdpListener
-	clients        map[*serverClient]struct{}
-	sources        []*source
-	publishers     map[string]publisher
-	publisherCount int
-	receiverCount  int
+	stats         programStats // must be the first field for 64-bit alignment
+	conf          *conf
+	startTime     time.Time
+	rtspls        []*serverTcpListener
+	rtpl          *serverUdpListener // only if UDP is enabled
+	rtcpl         *serverUdpListener // only if UDP is enabled
+	statsd        *statsdExporter
+	sourceEvents  *sourceEventsHook
+	api           *api
+	pprof         *pprof
+	ws            *serverWs
+	udpPortPool   []int     // free RTP ports, only if a port range is configured
+	errorLog      *logDedup // de-duplicates errors of malformed requests
+	ssrcBuf       []byte    // only if rewriteSsrc is enabled
+	clients       map[*serverClient]struct{}
+	wsClients     map[*serverWsClient]struct{}
+	sources       []*source
+	pushers       map[string]*pusher // only paths with pushTo
+	publishers    map[string]publisher
+	readers       map[string]map[*serverClient]struct{} // clients that are playing, by path
+	mutedPaths    map[string]struct{}
+	drainingPaths map[string]struct{}         // paths that don't accept new sessions
+	graceWaiting  map[string]*graceWait       // paths whose readers are waiting for a new publisher
+	paramSets     map[string][]*parameterSets // one per track, only if sendParameterSets is enabled
+
+	// one per track, only if the API is enabled
+	keyframes map[string][]*keyframeBuffer
+
+	// one per track, only if rtpTimestamps is rewrite
+	tsRewriters map[string][]*timestampRewriter
+
+	// only if egressCap is enabled
+	egressPeriodStart time.Time
+	egressPeriodBase  int64 // bytesOut at the start of the period
+	egressCapReached  bool
+
+	egressTerminate chan struct{}
+	egressDone      chan struct{}
+
+	graceTerminate chan struct{}
+	graceDone      chan struct{}
+
+	reorderTerminate chan struct{}
+	reorderDone      chan struct{}
+
+	sessionDurationTerminate chan struct{}
+	sessionDurationDone      chan struct{}
 
 	events chan programEvent
+	frames chan programEvent // frames of publishers and sources
 	done   chan struct{}
 }
 
-func newProgram(sargs []string, stdin io.Reader) (*program, error) {
+type programArgs struct {
+	version      bool
+	check        bool
+	loopbackTest bool
+	confPath     string
+}
+
+func parseArgs(sargs []string) programArgs {
 	k := kingpin.New("rtsp-simple-server",
 		"rtsp-simple-server "+Version+"\n\nRTSP server.")
 
 	argVersion := k.Flag("version", "print version").Bool()
+	argCheck := k.Flag("check", "validate the config file and exit, without starting the server").Bool()
+	argLoopbackTest := k.Flag("loopback-test", "start the server, publish a test stream, read it back and exit").Hidden().Bool()
 	argConfPath := k.Arg("confpath", "path to a config file. The default is rtsp-simple-server.yml. Use 'stdin' to read config from stdin").Default("rtsp-simple-server.yml").String()
 
 	kingpin.MustParse(k.Parse(sargs))
 
-	if *argVersion == true {
-		fmt.Println(Version)
-		os.Exit(0)
+	return programArgs{
+		version:      *argVersion,
+		check:        *argCheck,
+		loopbackTest: *argLoopbackTest,
+		confPath:     *argConfPath,
 	}
+}
+
+// newProgram starts a server with the configuration file pointed by the
+// command line arguments
+func newProgram(sargs []string, stdin io.Reader) (*program, error) {
+	args := parseArgs(sargs)
 
-	conf, err := loadConf(*argConfPath, stdin)
+	conf, err := loadConf(args.confPath, stdin)
 	if err != nil {
 		return nil, err
 	}
 
+	return newProgramWithConf(conf)
+}
+
+// newProgramWithConf starts a server with a configuration that has been
+// loaded with loadConf or filled with conf.fill(). It doesn't depend on the
+// command line, therefore it allows to embed the server; it is stopped
+// with close().
+func newProgramWithConf(conf *conf) (*program, error) {
 	p := &program{
-		conf:       conf,
-		clients:    make(map[*serverClient]struct{}),
-		publishers: make(map[string]publisher),
-		events:     make(chan programEvent),
-		done:       make(chan struct{}),
+		conf:          conf,
+		startTime:     time.Now(),
+		clients:       make(map[*serverClient]struct{}),
+		wsClients:     make(map[*serverWsClient]struct{}),
+		publishers:    make(map[string]publisher),
+		readers:       make(map[string]map[*serverClient]struct{}),
+		pushers:       make(map[string]*pusher),
+		mutedPaths:    make(map[string]struct{}),
+		drainingPaths: make(map[string]struct{}),
+		graceWaiting:  make(map[string]*graceWait),
+		paramSets:     make(map[string][]*parameterSets),
+		keyframes:     make(map[string][]*keyframeBuffer),
+		tsRewriters:   make(map[string][]*timestampRewriter),
+		errorLog:      newLogDedup(malformedRequestLogInterval),
+		events:        make(chan programEvent),
+		frames:        make(chan programEvent, programFrameQueueSize),
+		done:          make(chan struct{}),
+	}
+
+	if conf.RtpPortMin != 0 {
+		for port := conf.RtpPortMin; port < conf.RtpPortMax; port += 2 {
+			p.udpPortPool = append(p.udpPortPool, port)
+		}
 	}
 
 	for path, pconf := range conf.Paths {
 		if pconf.Source != "record" {
-			s, err := newSource(p, path, pconf.Source, pconf.SourceProtocol)
+			s, err := newSource(p, path, pconf)
 			if err != nil {
 				return nil, err
 			}
@@ -224,60 +531,259 @@ func newProgram(sargs []string, stdin io.Reader) (*program, error) {
 			p.sources = append(p.sources, s)
 			p.publishers[path] = s
 		}
+
+		if pconf.PushTo != "" {
+			p.pushers[path] = newPusher(p, path, pconf)
+		}
 	}
 
 	p.log("rtsp-simple-server %s", Version)
 
-	if conf.Pprof {
-		go func(mux *http.ServeMux) {
-			server := &http.Server{
-				Addr:    ":9999",
-				Handler: mux,
-			}
-			p.log("pprof is available on :9999")
-			panic(server.ListenAndServe())
-		}(http.DefaultServeMux)
-		http.DefaultServeMux = http.NewServeMux()
-	}
-
-	p.rtpl, err = newServerUdpListener(p, conf.RtpPort, gortsplib.StreamTypeRtp)
+	err := checkListeners(conf)
 	if err != nil {
 		return nil, err
 	}
 
-	p.rtcpl, err = newServerUdpListener(p, conf.RtcpPort, gortsplib.StreamTypeRtcp)
-	if err != nil {
-		return nil, err
+	if limit, ok := openFilesLimit(); ok {
+		if need := requiredOpenFiles(conf); limit < need {
+			p.log("WARN: the limit of open files (%d) is lower than the number of files "+
+				"that the configuration may need (%d); clients may be rejected with "+
+				"'too many open files'. Increase it with 'ulimit -n'", limit, need)
+		}
 	}
 
-	p.rtspl, err = newServerTcpListener(p)
-	if err != nil {
-		return nil, err
+	if _, ok := conf.protocolsParsed[streamProtocolUdp]; ok {
+		p.rtpl, err = newServerUdpListener(p, conf.RtpPort, gortsplib.StreamTypeRtp)
+		if err != nil {
+			return nil, err
+		}
+
+		p.rtcpl, err = newServerUdpListener(p, conf.RtcpPort, gortsplib.StreamTypeRtcp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, lconf := range conf.rtspListenersParsed {
+		rtspl, err := newServerTcpListener(p, lconf)
+		if err != nil {
+			return nil, err
+		}
+		p.rtspls = append(p.rtspls, rtspl)
+	}
+
+	if conf.StatsdAddress != "" {
+		p.statsd, err = newStatsdExporter(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.SourceEventsUrl != "" {
+		p.sourceEvents = newSourceEventsHook(p)
+	}
+
+	if conf.Api {
+		p.api, err = newApi(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.Pprof {
+		p.pprof, err = newPprof(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.WebSocket {
+		p.ws, err = newServerWs(p)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	go p.rtpl.run()
-	go p.rtcpl.run()
-	go p.rtspl.run()
+	if p.rtpl != nil {
+		go p.rtpl.run()
+		go p.rtcpl.run()
+	}
+	for _, rtspl := range p.rtspls {
+		go rtspl.run()
+	}
+	if p.statsd != nil {
+		go p.statsd.run()
+	}
+	if p.sourceEvents != nil {
+		go p.sourceEvents.run()
+	}
+	if p.api != nil {
+		go p.api.run()
+	}
+	if p.pprof != nil {
+		go p.pprof.run()
+	}
+	if p.ws != nil {
+		go p.ws.run()
+	}
 	for _, s := range p.sources {
 		go s.run()
 	}
+	for _, pu := range p.pushers {
+		go pu.run()
+	}
+	if conf.DisconnectGrace > 0 {
+		p.graceTerminate = make(chan struct{})
+		p.graceDone = make(chan struct{})
+		go p.runTicker(1*time.Second, programEventCheckGrace{}, p.graceTerminate, p.graceDone)
+	}
+	if conf.UdpReorderDepth > 0 {
+		p.reorderTerminate = make(chan struct{})
+		p.reorderDone = make(chan struct{})
+		go p.runTicker(conf.UdpReorderTimeout/2, programEventCheckReorder{}, p.reorderTerminate, p.reorderDone)
+	}
+	if conf.EgressCap > 0 {
+		p.egressPeriodStart = time.Now()
+		p.egressTerminate = make(chan struct{})
+		p.egressDone = make(chan struct{})
+		go p.runTicker(1*time.Second, programEventCheckEgress{}, p.egressTerminate, p.egressDone)
+	}
+	if conf.MaxSessionDuration > 0 {
+		p.sessionDurationTerminate = make(chan struct{})
+		p.sessionDurationDone = make(chan struct{})
+		go p.runTicker(1*time.Second, programEventCheckSessionDuration{}, p.sessionDurationTerminate, p.sessionDurationDone)
+	}
 	go p.run()
 
 	return p, nil
 }
 
+// checkListeners binds all the configured listeners at once, in order to
+// report all the port conflicts before the server starts. The listeners are
+// released before returning.
+func checkListeners(conf *conf) error {
+	var closers []io.Closer
+	defer func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}()
+
+	var errs []string
+	bind := func(network string, address string) {
+		var c io.Closer
+		var err error
+		if network == "udp" {
+			c, err = net.ListenPacket(network, address)
+		} else {
+			c, err = net.Listen(network, address)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			return
+		}
+		closers = append(closers, c)
+	}
+
+	host := ""
+	if conf.listenIp != nil {
+		host = conf.listenIp.String()
+	}
+
+	if _, ok := conf.protocolsParsed[streamProtocolUdp]; ok {
+		bind("udp", net.JoinHostPort(host, strconv.FormatInt(int64(conf.RtpPort), 10)))
+		bind("udp", net.JoinHostPort(host, strconv.FormatInt(int64(conf.RtcpPort), 10)))
+	}
+	for _, l := range conf.rtspListenersParsed {
+		lhost := ""
+		if l.ip != nil {
+			lhost = l.ip.String()
+		}
+		bind("tcp", net.JoinHostPort(lhost, strconv.FormatInt(int64(l.port), 10)))
+	}
+	if conf.Api {
+		bind("tcp", conf.ApiAddress)
+	}
+	if conf.Pprof {
+		bind("tcp", conf.PprofAddress)
+	}
+	if conf.WebSocket {
+		bind("tcp", conf.WebSocketAddress)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to open the listeners:\n%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// requiredOpenFiles estimates the number of file descriptors that the
+// server may need with the given configuration: one for each listener, three
+// for each source (the RTSP connection and a couple of UDP sockets), one for
+// each pusher, two for each UDP session of the port range, and a margin for
+// the clients that use TCP and for the files of the process.
+func requiredOpenFiles(conf *conf) uint64 {
+	n := uint64(64)
+	n += uint64(len(conf.rtspListenersParsed))
+	if _, ok := conf.protocolsParsed[streamProtocolUdp]; ok {
+		n += 2
+	}
+	if conf.Api {
+		n++
+	}
+	if conf.Pprof {
+		n++
+	}
+	if conf.WebSocket {
+		n++
+	}
+	for _, pconf := range conf.Paths {
+		if pconf.Source != "record" {
+			n += 3
+		}
+		if pconf.PushTo != "" {
+			n++
+		}
+	}
+	if conf.RtpPortMin != 0 {
+		n += uint64(conf.RtpPortMax - conf.RtpPortMin)
+	}
+	return n
+}
+
 func (p *program) log(format string, args ...interface{}) {
-	log.Printf("[%d/%d/%d] "+format, append([]interface{}{len(p.clients),
-		p.publisherCount, p.receiverCount}, args...)...)
+	clients, publishers, receivers := p.stats.get()
+	log.Printf("[%d/%d/%d] "+format, append([]interface{}{clients,
+		publishers, receivers}, args...)...)
 }
 
 func (p *program) run() {
 outer:
-	for rawEvt := range p.events {
+	for {
+		var rawEvt programEvent
+		select {
+		case rawEvt = <-p.frames:
+			p.handleFrame(rawEvt)
+			continue
+
+		case rawEvt = <-p.events:
+			// frames that have been queued before the event are handled
+			// first, since the event may depend on them (e.g. a publisher
+			// that stops publishing after sending its last frames)
+			for n := len(p.frames); n > 0; n-- {
+				p.handleFrame(<-p.frames)
+			}
+		}
+
 		switch evt := rawEvt.(type) {
 		case programEventClientNew:
-			c := newServerClient(p, evt.nconn)
+			// the id allows to tie together the log lines of a client, even
+			// when multiple clients share the same address
+			id := fmt.Sprintf("%08x", rand.Uint32())
+
+			c := newServerClient(p, evt.nconn, evt.mode, id)
 			p.clients[c] = struct{}{}
+			atomic.AddInt64(&p.stats.clientCount, 1)
 			c.log("connected")
 
 		case programEventClientClose:
@@ -288,26 +794,77 @@ outer:
 			}
 
 			delete(p.clients, evt.client)
+			atomic.AddInt64(&p.stats.clientCount, -1)
+			p.releaseTracks(evt.client)
+			p.removeReader(evt.client)
 
 			if evt.client.path != "" {
 				if pub, ok := p.publishers[evt.client.path]; ok && pub == evt.client {
 					delete(p.publishers, evt.client.path)
+					delete(p.mutedPaths, evt.client.path)
+
+				} else if s, ok := pub.(*source); ok {
+					atomic.AddInt64(&s.readerCount, -1)
 				}
 			}
 
-			evt.client.log("disconnected")
+			for trackId, t := range evt.client.streamTracks {
+				evt.client.log("track %d: %s", trackId, &t.counters)
+			}
+
+			evt.client.log("disconnected (%s)", evt.client.summary())
 			close(evt.done)
 
 		case programEventClientDescribe:
+			if _, ok := p.drainingPaths[evt.path]; ok {
+				evt.res <- describeRes{nil, nil, errPathDraining}
+				continue
+			}
+
+			pub, ok := p.publishers[evt.path]
+			if !ok {
+				evt.res <- describeRes{}
+				continue
+			}
+
+			if !pub.publisherIsReady() {
+				// wait for the on-demand source to become ready
+				if s, ok := pub.(*source); ok && s.pconf.SourceOnDemand {
+					s.describeRequests = append(s.describeRequests, evt.res)
+					s.requestStart()
+					continue
+				}
+
+				evt.res <- describeRes{}
+				continue
+			}
+
+			if s, ok := pub.(*source); ok && s.pconf.SourceOnDemand {
+				s.requestStart()
+			}
+
+			evt.res <- describeRes{pub.publisherSdpText(), pub.publisherSdpParsed(), nil}
+
+		case programEventClientGetSource:
 			pub, ok := p.publishers[evt.path]
 			if !ok || !pub.publisherIsReady() {
 				evt.res <- nil
 				continue
 			}
 
-			evt.res <- pub.publisherSdpText()
+			// parameters can't be forwarded to files
+			s, _ := pub.(*source)
+			if s != nil && s.filePath != "" {
+				s = nil
+			}
+			evt.res <- s
 
 		case programEventClientAnnounce:
+			if _, ok := p.drainingPaths[evt.path]; ok {
+				evt.res <- errPathDraining
+				continue
+			}
+
 			_, ok := p.publishers[evt.path]
 			if ok {
 				evt.res <- fmt.Errorf("someone is already publishing on path '%s'", evt.path)
@@ -320,112 +877,402 @@ outer:
 			evt.res <- nil
 
 		case programEventClientSetupPlay:
+			if _, ok := p.drainingPaths[evt.path]; ok {
+				evt.res <- errPathDraining
+				continue
+			}
+
+			if p.egressCapReached {
+				evt.res <- errEgressCapReached
+				continue
+			}
+
 			pub, ok := p.publishers[evt.path]
 			if !ok || !pub.publisherIsReady() {
-				evt.res <- fmt.Errorf("no one is streaming on path '%s'", evt.path)
+				if s, ok := pub.(*source); ok && s.pconf.SourceOnDemand {
+					s.requestStart()
+				}
+
+				evt.res <- errorWithStatus(gortsplib.StatusNotFound, "no one is streaming on path '%s'", evt.path)
 				continue
 			}
 
 			sdpParsed := pub.publisherSdpParsed()
 
-			if len(evt.client.streamTracks) >= len(sdpParsed.MediaDescriptions) {
-				evt.res <- fmt.Errorf("all the tracks have already been setup")
+			if evt.client.trackIndexes == nil {
+				evt.client.trackIndexes = make([]int, len(sdpParsed.MediaDescriptions))
+				for i := range evt.client.trackIndexes {
+					evt.client.trackIndexes[i] = -1
+				}
+			}
+
+			trackId := evt.trackId
+			if trackId < 0 {
+				for i, idx := range evt.client.trackIndexes {
+					if idx < 0 {
+						trackId = i
+						break
+					}
+				}
+				if trackId < 0 {
+					evt.res <- fmt.Errorf("all the tracks have already been setup")
+					continue
+				}
+			}
+
+			if trackId >= len(evt.client.trackIndexes) {
+				evt.res <- errorWithStatus(gortsplib.StatusNotFound, "track %d doesn't exist", trackId)
+				continue
+			}
+
+			if evt.client.trackIndexes[trackId] >= 0 {
+				evt.res <- fmt.Errorf("track %d has already been setup", trackId)
+				continue
+			}
+
+			if evt.protocol == streamProtocolUdp {
+				err := p.checkUdpClientPorts(evt.client, evt.rtpPort, evt.rtcpPort)
+				if err != nil {
+					evt.res <- err
+					continue
+				}
+			}
+
+			t, err := p.newTrack(evt.protocol, evt.rtpPort, evt.rtcpPort)
+			if err != nil {
+				evt.res <- err
 				continue
 			}
 
+			if p.conf.RewriteSsrc {
+				t.ssrc = rand.Uint32()
+			}
+
+			if pconf := p.conf.findConfForPath(evt.path); pconf != nil && pconf.WaitKeyframe {
+				t.waitKeyframe = sdpMediaIsH264(sdpParsed.MediaDescriptions[trackId])
+			}
+
+			if s, ok := pub.(*source); ok && evt.client.path == "" {
+				atomic.AddInt64(&s.readerCount, 1)
+			}
+
 			evt.client.path = evt.path
 			evt.client.streamProtocol = evt.protocol
-			evt.client.streamTracks = append(evt.client.streamTracks, &track{
-				rtpPort:  evt.rtpPort,
-				rtcpPort: evt.rtcpPort,
-			})
+			evt.client.trackIndexes[trackId] = len(evt.client.streamTracks)
+			evt.client.streamTracks = append(evt.client.streamTracks, t)
 			evt.client.state = clientStatePrePlay
 			evt.res <- nil
 
 		case programEventClientSetupRecord:
+			if evt.protocol == streamProtocolUdp {
+				err := p.checkUdpClientPorts(evt.client, evt.rtpPort, evt.rtcpPort)
+				if err != nil {
+					evt.res <- err
+					continue
+				}
+			}
+
+			t, err := p.newTrack(evt.protocol, evt.rtpPort, evt.rtcpPort)
+			if err != nil {
+				evt.res <- err
+				continue
+			}
+
+			if evt.protocol == streamProtocolUdp && p.conf.UdpReorderDepth > 0 {
+				t.reorder = newReorderBuffer(p.conf.UdpReorderDepth, p.conf.UdpReorderTimeout)
+			}
+
 			evt.client.streamProtocol = evt.protocol
-			evt.client.streamTracks = append(evt.client.streamTracks, &track{
-				rtpPort:  evt.rtpPort,
-				rtcpPort: evt.rtcpPort,
-			})
+			evt.client.streamTracks = append(evt.client.streamTracks, t)
 			evt.client.state = clientStatePreRecord
 			evt.res <- nil
 
 		case programEventClientPlay1:
 			pub, ok := p.publishers[evt.client.path]
 			if !ok || !pub.publisherIsReady() {
-				evt.res <- fmt.Errorf("no one is streaming on path '%s'", evt.client.path)
+				evt.res <- errorWithStatus(gortsplib.StatusNotFound, "no one is streaming on path '%s'", evt.client.path)
 				continue
 			}
 
-			sdpParsed := pub.publisherSdpParsed()
+			// readers can receive a part of the tracks
+			if len(evt.client.trackIndexes) != len(pub.publisherSdpParsed().MediaDescriptions) {
+				evt.res <- errorWithStatus(gortsplib.StatusMethodNotValidInThisState, "the tracks of the stream have changed")
+				continue
+			}
 
-			if len(evt.client.streamTracks) != len(sdpParsed.MediaDescriptions) {
-				evt.res <- fmt.Errorf("not all tracks have been setup")
+			if p.conf.MaxReadersPerIp > 0 && p.readersOfIp(evt.client.ip()) >= p.conf.MaxReadersPerIp {
+				evt.res <- errorWithStatus(gortsplib.StatusServiceUnavailable, "too many readers from %s", evt.client.ip())
 				continue
 			}
 
 			evt.res <- nil
 
 		case programEventClientPlay2:
-			p.receiverCount += 1
+			atomic.AddInt64(&p.stats.receiverCount, 1)
+			p.addPlaying(evt.client.path, 1)
+			p.addReader(evt.client)
+			evt.client.state = clientStatePlay
+			evt.client.startReading()
+			close(evt.done)
+
+		case programEventClientPause:
+			atomic.AddInt64(&p.stats.receiverCount, -1)
+			p.addPlaying(evt.client.path, -1)
+			p.removeReader(evt.client)
+			evt.client.state = clientStatePause
+			close(evt.done)
+
+		case programEventClientResume:
+			atomic.AddInt64(&p.stats.receiverCount, 1)
+			p.addPlaying(evt.client.path, 1)
+			p.addReader(evt.client)
 			evt.client.state = clientStatePlay
+			evt.client.startReading()
 			close(evt.done)
 
 		case programEventClientPlayStop:
-			p.receiverCount -= 1
+			// paused clients have already been removed from the count
+			if evt.client.state == clientStatePlay {
+				atomic.AddInt64(&p.stats.receiverCount, -1)
+				p.addPlaying(evt.client.path, -1)
+				p.removeReader(evt.client)
+			}
 			evt.client.state = clientStatePrePlay
 			close(evt.done)
 
 		case programEventClientRecord:
-			p.publisherCount += 1
+			atomic.AddInt64(&p.stats.publisherCount, 1)
 			evt.client.state = clientStateRecord
+			p.onPublisherReady(evt.client.path, evt.client.streamSdpText, evt.client)
 			close(evt.done)
 
 		case programEventClientRecordStop:
-			p.publisherCount -= 1
+			atomic.AddInt64(&p.stats.publisherCount, -1)
 			evt.client.state = clientStatePreRecord
+			p.onPublisherGone(evt.client.path, evt.client.streamSdpText, evt.client)
+			close(evt.done)
 
-			// close all other clients that share the same path
-			for oc := range p.clients {
-				if oc != evt.client && oc.path == evt.client.path {
-					go oc.close()
+		case programEventStreamerReady:
+			evt.source.ready = true
+			if p.conf.UdpReorderDepth > 0 && evt.source.proto == streamProtocolUdp {
+				for range evt.source.serverSdpParsed.MediaDescriptions {
+					evt.source.reorders = append(evt.source.reorders,
+						newReorderBuffer(p.conf.UdpReorderDepth, p.conf.UdpReorderTimeout))
 				}
 			}
+			atomic.AddInt64(&p.stats.publisherCount, 1)
+			evt.source.log("ready")
+			p.onPublisherReady(evt.source.path, evt.source.serverSdpText, nil)
 
-			close(evt.done)
+			for _, res := range evt.source.describeRequests {
+				res <- describeRes{evt.source.serverSdpText, evt.source.serverSdpParsed, nil}
+			}
+			evt.source.describeRequests = nil
 
-		case programEventClientFrameUdp:
-			client, trackId := p.findPublisher(evt.addr, evt.streamType)
-			if client == nil {
+		case programEventStreamerNotReady:
+			evt.source.ready = false
+			evt.source.reorders = nil
+			atomic.AddInt64(&p.stats.publisherCount, -1)
+
+			for trackId, tc := range evt.source.counters {
+				evt.source.log("track %d: %s", trackId, tc)
+			}
+
+			evt.source.log("not ready")
+			p.onPublisherGone(evt.source.path, evt.source.serverSdpText, nil)
+
+		case programEventApiClients:
+			ret := []apiClient{}
+			for c := range p.clients {
+				ret = append(ret, apiClient{
+					Id:             c.id,
+					State:          c.state.String(),
+					Path:           c.path,
+					RemoteAddr:     c.conn.NetConn().RemoteAddr().String(),
+					ConnectedSince: c.connectedAt.UTC().Format(time.RFC3339),
+					LastActivity:   c.lastActivity().UTC().Format(time.RFC3339),
+				})
+			}
+			sort.Slice(ret, func(i, j int) bool {
+				return ret[i].ConnectedSince < ret[j].ConnectedSince ||
+					(ret[i].ConnectedSince == ret[j].ConnectedSince && ret[i].Id < ret[j].Id)
+			})
+			evt.res <- ret
+
+		case programEventApiHealth:
+			notReady := []string{}
+			for _, path := range p.conf.HealthRequiredSources {
+				if !p.publishers[path].publisherIsReady() {
+					notReady = append(notReady, path)
+				}
+			}
+			evt.res <- notReady
+
+		case programEventSourceStopped:
+			for _, res := range evt.source.describeRequests {
+				res <- describeRes{}
+			}
+			evt.source.describeRequests = nil
+
+		case programEventApiPathMute:
+			if _, ok := p.publishers[evt.path]; !ok {
+				evt.res <- fmt.Errorf("path '%s' has no publisher", evt.path)
 				continue
 			}
 
-			client.RtcpReceivers[trackId].OnFrame(evt.streamType, evt.buf)
-			p.forwardFrame(client.path, trackId, evt.streamType, evt.buf)
+			if evt.muted {
+				p.mutedPaths[evt.path] = struct{}{}
+				p.log("path '%s' muted", evt.path)
+			} else {
+				delete(p.mutedPaths, evt.path)
+				p.log("path '%s' unmuted", evt.path)
+			}
+			evt.res <- nil
 
-		case programEventClientFrameTcp:
-			p.forwardFrame(evt.path, evt.trackId, evt.streamType, evt.buf)
+		case programEventApiPathSdp:
+			pub, ok := p.publishers[evt.path]
+			if !ok || !pub.publisherIsReady() {
+				evt.res <- nil
+				continue
+			}
+			evt.res <- pub.publisherSdpText()
 
-		case programEventStreamerReady:
-			evt.source.ready = true
-			p.publisherCount += 1
-			evt.source.log("ready")
+		case programEventApiPathKeyframe:
+			var ret []byte
+			for _, kb := range p.keyframes[evt.path] {
+				if kb != nil && kb.keyframe() != nil {
+					ret = kb.keyframe()
+					break
+				}
+			}
+			evt.res <- ret
 
-		case programEventStreamerNotReady:
-			evt.source.ready = false
-			p.publisherCount -= 1
-			evt.source.log("not ready")
+		case programEventApiPathDrain:
+			if _, ok := p.drainingPaths[evt.path]; !ok && p.conf.findConfForPath(evt.path) == nil {
+				evt.res <- errPathNotConfigured
+				continue
+			}
+
+			if evt.draining {
+				p.drainingPaths[evt.path] = struct{}{}
+				p.log("path '%s' is draining, new sessions are rejected", evt.path)
+			} else {
+				delete(p.drainingPaths, evt.path)
+				p.log("path '%s' is not draining anymore", evt.path)
+			}
+			evt.res <- nil
 
-			// close all clients that share the same path
-			for oc := range p.clients {
-				if oc.path == evt.source.path {
-					go oc.close()
+		case programEventWsClientNew:
+			if _, ok := p.drainingPaths[evt.client.path]; ok {
+				evt.res <- errPathDraining
+				continue
+			}
+
+			if p.egressCapReached {
+				evt.res <- errEgressCapReached
+				continue
+			}
+
+			pub, ok := p.publishers[evt.client.path]
+			if !ok || !pub.publisherIsReady() {
+				evt.res <- errorWithStatus(gortsplib.StatusNotFound, "no one is streaming on path '%s'", evt.client.path)
+				continue
+			}
+
+			if s, ok := pub.(*source); ok {
+				atomic.AddInt64(&s.readerCount, 1)
+				s.addPlaying(1)
+			}
+
+			evt.client.sdpText = pub.publisherSdpText()
+			p.wsClients[evt.client] = struct{}{}
+			atomic.AddInt64(&p.stats.receiverCount, 1)
+			evt.res <- nil
+
+		case programEventWsClientClose:
+			// already deleted
+			if _, ok := p.wsClients[evt.client]; !ok {
+				close(evt.done)
+				continue
+			}
+
+			delete(p.wsClients, evt.client)
+			atomic.AddInt64(&p.stats.receiverCount, -1)
+
+			if s, ok := p.publishers[evt.client.path].(*source); ok {
+				atomic.AddInt64(&s.readerCount, -1)
+				s.addPlaying(-1)
+			}
+			close(evt.done)
+
+		case programEventReadersLoss:
+			var ret []uint8
+			for c := range p.clients {
+				if c.path != evt.path || c.state != clientStatePlay {
+					continue
+				}
+
+				for trackId, idx := range c.trackIndexes {
+					for len(ret) <= trackId {
+						ret = append(ret, 0)
+					}
+					if idx < 0 {
+						continue
+					}
+					if f := uint8(atomic.LoadUint32(&c.streamTracks[idx].readerFractionLost)); f > ret[trackId] {
+						ret[trackId] = f
+					}
 				}
 			}
+			evt.res <- ret
 
-		case programEventStreamerFrame:
-			p.forwardFrame(evt.source.path, evt.trackId, evt.streamType, evt.buf)
+		case programEventCheckReorder:
+			now := time.Now()
+			for c := range p.clients {
+				if c.state != clientStateRecord {
+					continue
+				}
+				for trackId, t := range c.streamTracks {
+					if t.reorder != nil {
+						c, trackId := c, trackId
+						t.reorder.check(now, func(buf []byte) {
+							p.forwardFrame(c.path, trackId, gortsplib.StreamTypeRtp, buf)
+						})
+					}
+				}
+			}
+			for _, s := range p.sources {
+				for trackId, rb := range s.reorders {
+					s, trackId := s, trackId
+					rb.check(now, func(buf []byte) {
+						p.forwardFrame(s.path, trackId, gortsplib.StreamTypeRtp, buf)
+					})
+				}
+			}
+
+		case programEventCheckGrace:
+			now := time.Now()
+			for path, gw := range p.graceWaiting {
+				if now.After(gw.deadline) {
+					p.log("no publisher came back on path '%s', closing its readers", path)
+					delete(p.graceWaiting, path)
+					p.closeReaders(path, nil)
+				}
+			}
+
+		case programEventCheckEgress:
+			p.checkEgress(time.Now())
+
+		case programEventCheckSessionDuration:
+			now := time.Now()
+			for c := range p.clients {
+				if (c.state == clientStatePlay || c.state == clientStatePause) && !c.expiredClosed &&
+					now.Sub(c.connectedAt) >= p.conf.MaxSessionDuration {
+					c.expiredClosed = true
+					c.log("session has lasted more than %s (maxSessionDuration), closing", p.conf.MaxSessionDuration)
+					c.conn.NetConn().Close()
+				}
+			}
 
 		case programEventTerminate:
 			break outer
@@ -433,29 +1280,51 @@ outer:
 	}
 
 	go func() {
-		for rawEvt := range p.events {
+		for {
+			var rawEvt programEvent
+			select {
+			case rawEvt = <-p.frames:
+				continue
+
+			case e, ok := <-p.events:
+				if !ok {
+					return
+				}
+				rawEvt = e
+			}
+
 			switch evt := rawEvt.(type) {
 			case programEventClientClose:
+				p.releaseTracks(evt.client)
 				close(evt.done)
 
 			case programEventClientDescribe:
+				evt.res <- describeRes{}
+
+			case programEventClientGetSource:
 				evt.res <- nil
 
 			case programEventClientAnnounce:
-				evt.res <- fmt.Errorf("terminated")
+				evt.res <- errorWithStatus(gortsplib.StatusServiceUnavailable, "terminated")
 
 			case programEventClientSetupPlay:
-				evt.res <- fmt.Errorf("terminated")
+				evt.res <- errorWithStatus(gortsplib.StatusServiceUnavailable, "terminated")
 
 			case programEventClientSetupRecord:
-				evt.res <- fmt.Errorf("terminated")
+				evt.res <- errorWithStatus(gortsplib.StatusServiceUnavailable, "terminated")
 
 			case programEventClientPlay1:
-				evt.res <- fmt.Errorf("terminated")
+				evt.res <- errorWithStatus(gortsplib.StatusServiceUnavailable, "terminated")
 
 			case programEventClientPlay2:
 				close(evt.done)
 
+			case programEventClientPause:
+				close(evt.done)
+
+			case programEventClientResume:
+				close(evt.done)
+
 			case programEventClientPlayStop:
 				close(evt.done)
 
@@ -464,6 +1333,33 @@ outer:
 
 			case programEventClientRecordStop:
 				close(evt.done)
+
+			case programEventApiPathMute:
+				evt.res <- fmt.Errorf("terminated")
+
+			case programEventApiPathDrain:
+				evt.res <- fmt.Errorf("terminated")
+
+			case programEventApiPathSdp:
+				evt.res <- nil
+
+			case programEventApiPathKeyframe:
+				evt.res <- nil
+
+			case programEventApiHealth:
+				evt.res <- nil
+
+			case programEventApiClients:
+				evt.res <- nil
+
+			case programEventWsClientNew:
+				evt.res <- fmt.Errorf("terminated")
+
+			case programEventWsClientClose:
+				close(evt.done)
+
+			case programEventReadersLoss:
+				evt.res <- nil
 			}
 		}
 	}()
@@ -472,14 +1368,67 @@ outer:
 		s.close()
 	}
 
-	p.rtspl.close()
-	p.rtcpl.close()
-	p.rtpl.close()
+	for _, pu := range p.pushers {
+		pu.close()
+	}
+
+	if p.sourceEvents != nil {
+		p.sourceEvents.close()
+	}
+
+	if p.graceTerminate != nil {
+		close(p.graceTerminate)
+		<-p.graceDone
+	}
+
+	if p.reorderTerminate != nil {
+		close(p.reorderTerminate)
+		<-p.reorderDone
+	}
+
+	if p.egressTerminate != nil {
+		close(p.egressTerminate)
+		<-p.egressDone
+	}
+
+	if p.sessionDurationTerminate != nil {
+		close(p.sessionDurationTerminate)
+		<-p.sessionDurationDone
+	}
+
+	if p.statsd != nil {
+		p.statsd.close()
+	}
+
+	if p.api != nil {
+		p.api.close()
+	}
+
+	if p.pprof != nil {
+		p.pprof.close()
+	}
+
+	if p.ws != nil {
+		p.ws.close()
+	}
+
+	for _, rtspl := range p.rtspls {
+		rtspl.close()
+	}
+	if p.rtpl != nil {
+		p.rtcpl.close()
+		p.rtpl.close()
+	}
 
 	for c := range p.clients {
 		c.close()
 	}
 
+	for wc := range p.wsClients {
+		wc.close()
+		<-wc.done
+	}
+
 	close(p.events)
 	close(p.done)
 }
@@ -489,6 +1438,374 @@ func (p *program) close() {
 	<-p.done
 }
 
+// handleFrame forwards a frame of a publisher or a source. The buffer of the
+// frame is released afterwards, since it is copied when it is forwarded.
+func (p *program) handleFrame(rawEvt programEvent) {
+	switch evt := rawEvt.(type) {
+	case programEventClientFrameUdp:
+		defer frameBuffers.put(evt.buf)
+
+		client, trackId := p.findPublisher(evt.addr, evt.streamType)
+		if client == nil {
+			if p.conf.SymmetricRtp {
+				p.learnUdpReaderAddr(evt.addr, evt.streamType, evt.buf)
+			}
+
+			// receiver reports of readers
+			if evt.streamType == gortsplib.StreamTypeRtcp {
+				reader, trackId := p.findUdpReader(evt.addr)
+				if reader != nil {
+					reader.streamTracks[trackId].counters.onFrameIn(evt.streamType, len(evt.buf))
+					atomic.StoreInt64(&reader.udpLastRtcpTime, time.Now().UnixNano())
+
+					if p.conf.ForwardReaderLoss {
+						if f, ok := rtcpFractionLost(evt.buf); ok {
+							atomic.StoreUint32(&reader.streamTracks[trackId].readerFractionLost, uint32(f))
+						}
+					}
+				}
+			}
+			return
+		}
+
+		client.streamTracks[trackId].counters.onFrameIn(evt.streamType, len(evt.buf))
+		client.RtcpReceivers[trackId].OnFrame(evt.streamType, evt.buf)
+
+		if rb := client.streamTracks[trackId].reorder; rb != nil && evt.streamType == gortsplib.StreamTypeRtp {
+			rb.push(evt.buf, time.Now(), func(buf []byte) {
+				p.forwardFrame(client.path, trackId, gortsplib.StreamTypeRtp, buf)
+			})
+			return
+		}
+
+		p.forwardFrame(client.path, trackId, evt.streamType, evt.buf)
+
+	case programEventClientFrameTcp:
+		defer frameBuffers.put(evt.buf)
+
+		p.forwardFrame(evt.path, evt.trackId, evt.streamType, evt.buf)
+
+	case programEventStreamerFrame:
+		defer frameBuffers.put(evt.buf)
+
+		if evt.source.reorders != nil && evt.streamType == gortsplib.StreamTypeRtp {
+			evt.source.reorders[evt.trackId].push(evt.buf, time.Now(), func(buf []byte) {
+				p.forwardFrame(evt.source.path, evt.trackId, gortsplib.StreamTypeRtp, buf)
+			})
+			return
+		}
+
+		p.forwardFrame(evt.source.path, evt.trackId, evt.streamType, evt.buf)
+	}
+}
+
+// readersOfIp returns the number of sessions of an IP that are reading,
+// including the paused ones
+func (p *program) readersOfIp(ip net.IP) int {
+	n := 0
+	for c := range p.clients {
+		if (c.state == clientStatePlay || c.state == clientStatePause) && c.ip().Equal(ip) {
+			n++
+		}
+	}
+	return n
+}
+
+// addPlaying updates the number of readers of a path that are receiving
+// frames, that is notified to its source, if any
+func (p *program) addPlaying(path string, delta int64) {
+	if s, ok := p.publishers[path].(*source); ok {
+		s.addPlaying(delta)
+	}
+}
+
+// addReader adds a client that is starting to play to the readers of its path
+func (p *program) addReader(c *serverClient) {
+	readers, ok := p.readers[c.path]
+	if !ok {
+		readers = make(map[*serverClient]struct{})
+		p.readers[c.path] = readers
+	}
+	readers[c] = struct{}{}
+}
+
+func (p *program) removeReader(c *serverClient) {
+	readers, ok := p.readers[c.path]
+	if !ok {
+		return
+	}
+	delete(readers, c)
+	if len(readers) == 0 {
+		delete(p.readers, c.path)
+	}
+}
+
+// readersLoss returns the worst fraction lost reported by the readers of a
+// path, for each track. It is called by publishers and sources.
+func (p *program) readersLoss(path string) []uint8 {
+	if !p.conf.ForwardReaderLoss {
+		return nil
+	}
+
+	res := make(chan []uint8)
+	p.events <- programEventReadersLoss{res, path}
+	return <-res
+}
+
+// receiverReport generates the receiver report of a track of a publisher or
+// a source, that includes the losses of the readers
+func receiverReport(rr *gortsplib.RtcpReceiver, trackId int, readersLoss []uint8) []byte {
+	frame := rr.Report()
+	if trackId < len(readersLoss) {
+		frame = rtcpRaiseFractionLost(frame, readersLoss[trackId])
+	}
+	return frame
+}
+
+// runTicker sends evt to the event loop periodically, until terminate is
+// closed
+func (p *program) runTicker(interval time.Duration, evt programEvent, terminate chan struct{}, done chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			p.events <- evt
+
+		case <-terminate:
+			close(done)
+			return
+		}
+	}
+}
+
+// closeReaders closes all the clients of a path, except the publisher
+func (p *program) closeReaders(path string, publisher *serverClient) {
+	for oc := range p.clients {
+		if oc != publisher && oc.path == path {
+			go oc.close()
+		}
+	}
+	for wc := range p.wsClients {
+		if wc.path == path {
+			wc.close()
+		}
+	}
+}
+
+// checkEgress starts a new period when the current one is over, and stops
+// accepting readers when the bytes sent within the period exceed the cap
+func (p *program) checkEgress(now time.Time) {
+	bytesOut := p.stats.getBytesOut()
+
+	if now.Sub(p.egressPeriodStart) >= p.conf.EgressCapPeriod {
+		p.egressPeriodStart = now
+		p.egressPeriodBase = bytesOut
+		if p.egressCapReached {
+			p.egressCapReached = false
+			p.log("a new egress period has started, readers are accepted again")
+		}
+		return
+	}
+
+	if p.egressCapReached || bytesOut-p.egressPeriodBase < p.conf.EgressCap {
+		return
+	}
+
+	p.egressCapReached = true
+	p.log("WARN: egress cap of %d bytes reached, readers are rejected until %s",
+		p.conf.EgressCap, p.egressPeriodStart.Add(p.conf.EgressCapPeriod).Format(time.RFC3339))
+
+	if p.conf.EgressCapCloseReaders {
+		for c := range p.clients {
+			switch c.state {
+			case clientStatePrePlay, clientStatePlay, clientStatePause:
+				go c.close()
+			}
+		}
+		for wc := range p.wsClients {
+			wc.close()
+		}
+	}
+}
+
+func (p *program) onPublisherGone(path string, sdpText []byte, publisher *serverClient) {
+	delete(p.paramSets, path)
+	delete(p.keyframes, path)
+	delete(p.tsRewriters, path)
+
+	if pu, ok := p.pushers[path]; ok {
+		pu.setSdp(nil)
+	}
+
+	if p.conf.DisconnectGrace == 0 {
+		p.closeReaders(path, publisher)
+		return
+	}
+
+	hasReaders := false
+	for oc := range p.clients {
+		if oc != publisher && oc.path == path {
+			hasReaders = true
+			break
+		}
+	}
+	for wc := range p.wsClients {
+		if wc.path == path {
+			hasReaders = true
+			break
+		}
+	}
+	if !hasReaders {
+		return
+	}
+
+	p.graceWaiting[path] = &graceWait{
+		deadline: time.Now().Add(p.conf.DisconnectGrace),
+		sdpText:  sdpText,
+	}
+	p.log("publisher of path '%s' is gone, readers are kept for %s", path, p.conf.DisconnectGrace)
+}
+
+func (p *program) onPublisherReady(path string, sdpText []byte, publisher *serverClient) {
+	if pconf := p.conf.findConfForPath(path); pconf != nil && pconf.SendParameterSets {
+		var sets []*parameterSets
+		for _, m := range p.publishers[path].publisherSdpParsed().MediaDescriptions {
+			sets = append(sets, newParameterSets(m))
+		}
+		p.paramSets[path] = sets
+	}
+
+	if pconf := p.conf.findConfForPath(path); pconf != nil && pconf.RtpTimestamps == "rewrite" {
+		var trs []*timestampRewriter
+		for _, m := range p.publishers[path].publisherSdpParsed().MediaDescriptions {
+			trs = append(trs, newTimestampRewriter(sdpMediaClockRate(m), p.startTime))
+		}
+		p.tsRewriters[path] = trs
+	}
+
+	if p.conf.Api {
+		var kbs []*keyframeBuffer
+		for _, m := range p.publishers[path].publisherSdpParsed().MediaDescriptions {
+			kbs = append(kbs, newKeyframeBuffer(m))
+		}
+		p.keyframes[path] = kbs
+	}
+
+	if pu, ok := p.pushers[path]; ok {
+		pu.setSdp(sdpText)
+	}
+
+	gw, ok := p.graceWaiting[path]
+	if !ok {
+		return
+	}
+	delete(p.graceWaiting, path)
+
+	// readers can't be fed by a stream with different tracks
+	if !bytes.Equal(gw.sdpText, sdpText) {
+		p.log("publisher of path '%s' is back with a different SDP, closing readers", path)
+		for _, change := range sdpMediaChanges(gw.sdpText, sdpText) {
+			p.log("path '%s': %s", path, change)
+		}
+		p.closeReaders(path, publisher)
+		return
+	}
+
+	p.log("publisher of path '%s' is back", path)
+}
+
+func (p *program) newTrack(protocol streamProtocol, rtpPort int, rtcpPort int) (*track, error) {
+	t := &track{
+		rtpPort:  rtpPort,
+		rtcpPort: rtcpPort,
+	}
+
+	if protocol != streamProtocolUdp {
+		return t, nil
+	}
+
+	if p.udpPortPool == nil {
+		t.rtpl = p.rtpl
+		t.rtcpl = p.rtcpl
+		return t, nil
+	}
+
+	// pick the first pair of ports that can be bound
+	for i, port := range p.udpPortPool {
+		rtpl, err := newServerUdpListener(p, port, gortsplib.StreamTypeRtp)
+		if err != nil {
+			continue
+		}
+
+		rtcpl, err := newServerUdpListener(p, port+1, gortsplib.StreamTypeRtcp)
+		if err != nil {
+			rtpl.nconn.Close()
+			continue
+		}
+
+		p.udpPortPool = append(p.udpPortPool[:i], p.udpPortPool[i+1:]...)
+
+		go rtpl.run()
+		go rtcpl.run()
+
+		t.rtpl = rtpl
+		t.rtcpl = rtcpl
+		return t, nil
+	}
+
+	return nil, errorWithStatus(gortsplib.StatusServiceUnavailable, "no UDP ports available")
+}
+
+// releaseUdpPort puts a RTP port back into the pool. A port that is already in
+// the pool would be allocated to two sessions at once.
+func (p *program) releaseUdpPort(port int) {
+	for _, other := range p.udpPortPool {
+		if other == port {
+			p.log("ERR: UDP port %d has been released twice", port)
+			return
+		}
+	}
+	p.udpPortPool = append(p.udpPortPool, port)
+}
+
+// release the UDP listeners allocated by newTrack()
+func (p *program) releaseTracks(client *serverClient) {
+	for _, t := range client.streamTracks {
+		if t.rtpl == nil || t.rtpl == p.rtpl {
+			continue
+		}
+
+		// the listeners can't be waited here, since they may be
+		// blocked while sending an event to this loop
+		t.rtpl.nconn.Close()
+		t.rtcpl.nconn.Close()
+
+		p.releaseUdpPort(t.rtpl.port)
+	}
+}
+
+// checkUdpClientPorts returns an error if the UDP ports of a client are already
+// used by another track with the same IP, since incoming packets are routed to
+// tracks by IP and port, and one of the tracks would receive the packets of
+// the other one
+func (p *program) checkUdpClientPorts(client *serverClient, rtpPort int, rtcpPort int) error {
+	for c := range p.clients {
+		if c.streamProtocol != streamProtocolUdp || !c.ip().Equal(client.ip()) {
+			continue
+		}
+
+		for _, t := range c.streamTracks {
+			if t.rtpPort == rtpPort || t.rtpPort == rtcpPort ||
+				t.rtcpPort == rtpPort || t.rtcpPort == rtcpPort {
+				return fmt.Errorf("client ports %d-%d are already used by another session of %s", rtpPort, rtcpPort, client.ip())
+			}
+		}
+	}
+	return nil
+}
+
 func (p *program) findPublisher(addr *net.UDPAddr, streamType gortsplib.StreamType) (*serverClient, int) {
 	for _, pub := range p.publishers {
 		cl, ok := pub.(*serverClient)
@@ -517,52 +1834,460 @@ func (p *program) findPublisher(addr *net.UDPAddr, streamType gortsplib.StreamTy
 	return nil, -1
 }
 
-func (p *program) forwardFrame(path string, trackId int, streamType gortsplib.StreamType, frame []byte) {
+func (p *program) findUdpReader(addr *net.UDPAddr) (*serverClient, int) {
 	for client := range p.clients {
-		if client.path == path && client.state == clientStatePlay {
-			if client.streamProtocol == streamProtocolUdp {
-				if streamType == gortsplib.StreamTypeRtp {
-					p.rtpl.write(&udpAddrBufPair{
-						addr: &net.UDPAddr{
-							IP:   client.ip(),
-							Zone: client.zone(),
-							Port: client.streamTracks[trackId].rtpPort,
-						},
-						buf: frame,
-					})
-				} else {
-					p.rtcpl.write(&udpAddrBufPair{
-						addr: &net.UDPAddr{
-							IP:   client.ip(),
-							Zone: client.zone(),
-							Port: client.streamTracks[trackId].rtcpPort,
-						},
-						buf: frame,
-					})
+		if client.streamProtocol != streamProtocolUdp ||
+			(client.state != clientStatePlay && client.state != clientStatePause) ||
+			!client.ip().Equal(addr.IP) {
+			continue
+		}
+
+		for i, t := range client.streamTracks {
+			if t.udpRtcpAddr != nil {
+				if t.udpRtcpAddr.Port == addr.Port {
+					return client, i
 				}
+			} else if t.rtcpPort == addr.Port {
+				return client, i
+			}
+		}
+	}
+	return nil, -1
+}
+
+// learnUdpReaderAddr associates the source address of a packet of a reader
+// that is not sent from its client ports, as happens behind NATs, with one
+// of its tracks. Receiver reports are associated with the track whose SSRC
+// they refer to, RTP packets with the track whose RTCP address has the next
+// port; otherwise, packets are associated with the only track whose address
+// is not known yet.
+func (p *program) learnUdpReaderAddr(addr *net.UDPAddr, streamType gortsplib.StreamType, buf []byte) {
+	type candidate struct {
+		client *serverClient
+		t      *track
+	}
+	var candidates []candidate
+
+	for client := range p.clients {
+		if client.streamProtocol != streamProtocolUdp ||
+			(client.state != clientStatePrePlay && client.state != clientStatePlay &&
+				client.state != clientStatePause) ||
+			!client.ip().Equal(addr.IP) {
+			continue
+		}
+
+		for _, t := range client.streamTracks {
+			learned, port := t.udpRtpAddr, t.rtpPort
+			if streamType == gortsplib.StreamTypeRtcp {
+				learned, port = t.udpRtcpAddr, t.rtcpPort
+			}
+
+			if learned != nil {
+				// the address is already known
+				if learned.Port == addr.Port {
+					return
+				}
+				continue
+			}
+
+			// the packet comes from the client port
+			if port == addr.Port {
+				return
+			}
+
+			candidates = append(candidates, candidate{client, t})
+		}
+	}
 
+	if streamType == gortsplib.StreamTypeRtcp {
+		if ssrc, ok := rtcpReportSsrc(buf); ok {
+			for _, c := range candidates {
+				if c.t.lastSsrc == ssrc {
+					candidates = []candidate{c}
+					break
+				}
+			}
+		}
+	} else {
+		for _, c := range candidates {
+			if c.t.udpRtcpAddr != nil && c.t.udpRtcpAddr.Port == addr.Port+1 {
+				candidates = []candidate{c}
+				break
+			}
+		}
+	}
+
+	if len(candidates) != 1 {
+		return
+	}
+
+	c := candidates[0]
+	if streamType == gortsplib.StreamTypeRtp {
+		c.t.udpRtpAddr = addr
+		c.client.log("the reader sends RTP packets from %s, that is used instead of the client port", addr)
+	} else {
+		c.t.udpRtcpAddr = addr
+		c.client.log("the reader sends RTCP packets from %s, that is used instead of the client port", addr)
+	}
+}
+
+// filterPublisherRtcp returns the part of a RTCP packet of a publisher that
+// must be forwarded to readers, or nil. Sender reports are kept, since they
+// allow readers to synchronize tracks; the SSRCs are the ones of the RTP
+// packets, that are forwarded untouched unless rewriteSsrc is enabled.
+func (p *program) filterPublisherRtcp(frame []byte) []byte {
+	switch p.conf.RtcpForwarding {
+	case "all":
+		return frame
+
+	case "none":
+		return nil
+	}
+
+	pkts, err := rtcp.Unmarshal(frame)
+	if err != nil {
+		return nil
+	}
+
+	var kept []rtcp.Packet
+	for _, pkt := range pkts {
+		switch pkt.(type) {
+		case *rtcp.SenderReport, *rtcp.SourceDescription:
+			kept = append(kept, pkt)
+		}
+	}
+
+	// a compound packet must start with a report
+	if len(kept) == 0 {
+		return nil
+	}
+	if _, ok := kept[0].(*rtcp.SenderReport); !ok {
+		return nil
+	}
+	if len(kept) == len(pkts) {
+		return frame
+	}
+
+	byts, err := rtcp.Marshal(kept)
+	if err != nil {
+		return nil
+	}
+	return byts
+}
+
+// rewriteSsrc returns a RTP packet, or the given RTCP packets, with the SSRC
+// of a reader. The returned buffer is valid until the next call, since the
+// frame is copied again before being written.
+func (p *program) rewriteSsrc(frame []byte, rtcpPkts []rtcp.Packet, ssrc uint32) []byte {
+	if rtcpPkts == nil {
+		if len(frame) < 12 {
+			return nil
+		}
+		p.ssrcBuf = append(p.ssrcBuf[:0], frame...)
+		binary.BigEndian.PutUint32(p.ssrcBuf[8:12], ssrc)
+		return p.ssrcBuf
+	}
+
+	for _, pkt := range rtcpPkts {
+		switch tpkt := pkt.(type) {
+		case *rtcp.SenderReport:
+			tpkt.SSRC = ssrc
+
+		case *rtcp.ReceiverReport:
+			tpkt.SSRC = ssrc
+
+		case *rtcp.SourceDescription:
+			for i := range tpkt.Chunks {
+				tpkt.Chunks[i].Source = ssrc
+			}
+
+		case *rtcp.Goodbye:
+			for i := range tpkt.Sources {
+				tpkt.Sources[i] = ssrc
+			}
+		}
+	}
+
+	byts, err := rtcp.Marshal(rtcpPkts)
+	if err != nil {
+		return nil
+	}
+	return byts
+}
+
+func (p *program) forwardFrame(path string, trackId int, streamType gortsplib.StreamType, frame []byte) {
+	if _, ok := p.mutedPaths[path]; ok {
+		return
+	}
+
+	if streamType == gortsplib.StreamTypeRtcp {
+		frame = p.filterPublisherRtcp(frame)
+		if frame == nil {
+			return
+		}
+	}
+
+	if trs, ok := p.tsRewriters[path]; ok && trackId < len(trs) {
+		if streamType == gortsplib.StreamTypeRtp {
+			frame = trs[trackId].rewriteRtp(frame, time.Now())
+		} else {
+			frame = trs[trackId].rewriteRtcp(frame)
+			if frame == nil {
+				return
+			}
+		}
+	}
+
+	// RTCP packets are parsed once, and the SSRCs are replaced for each reader
+	var rtcpPkts []rtcp.Packet
+	if p.conf.RewriteSsrc && streamType == gortsplib.StreamTypeRtcp {
+		var err error
+		rtcpPkts, err = rtcp.Unmarshal(frame)
+		if err != nil {
+			return
+		}
+	}
+	original := frame
+
+	var sets *parameterSets
+	if pss, ok := p.paramSets[path]; ok && streamType == gortsplib.StreamTypeRtp && trackId < len(pss) {
+		sets = pss[trackId]
+		if sets != nil {
+			sets.onRtp(frame)
+		}
+	}
+
+	if kbs, ok := p.keyframes[path]; ok && streamType == gortsplib.StreamTypeRtp && trackId < len(kbs) && kbs[trackId] != nil {
+		kbs[trackId].onRtp(frame)
+	}
+
+	// TCP readers are served in parallel when they are many, since copying
+	// frames into their queues is the most expensive part of the fan-out.
+	// UDP readers share the UDP listeners and SSRCs are rewritten with
+	// shared buffers, therefore they are always served by this goroutine
+	readers := p.readers[path]
+	if len(readers) >= forwardFrameParallelMin && !p.conf.RewriteSsrc {
+		var tcpReaders []*serverClient
+		for client := range readers {
+			if client.streamProtocol == streamProtocolTcp {
+				tcpReaders = append(tcpReaders, client)
 			} else {
-				buf := client.writeBuf.swap()
-				buf = buf[:len(frame)]
-				copy(buf, frame)
-
-				client.events <- serverClientEventFrameTcp{
-					frame: &gortsplib.InterleavedFrame{
-						TrackId:    trackId,
-						StreamType: streamType,
-						Content:    buf,
-					},
+				p.forwardFrameToReader(client, trackId, streamType, original, rtcpPkts, sets)
+			}
+		}
+
+		workers := runtime.GOMAXPROCS(0)
+		if max := len(tcpReaders) / forwardFrameParallelMin; workers > max {
+			workers = max
+		}
+		if workers < 1 {
+			workers = 1
+		}
+
+		var wg sync.WaitGroup
+		chunk := (len(tcpReaders) + workers - 1) / workers
+		for i := 0; i < len(tcpReaders); i += chunk {
+			end := i + chunk
+			if end > len(tcpReaders) {
+				end = len(tcpReaders)
+			}
+
+			wg.Add(1)
+			go func(clients []*serverClient) {
+				defer wg.Done()
+				for _, client := range clients {
+					p.forwardFrameToReader(client, trackId, streamType, original, rtcpPkts, sets)
+				}
+			}(tcpReaders[i:end])
+		}
+		wg.Wait()
+
+	} else {
+		for client := range readers {
+			p.forwardFrameToReader(client, trackId, streamType, original, rtcpPkts, sets)
+		}
+	}
+
+	for wc := range p.wsClients {
+		if wc.path == path {
+			if wc.writeFrame(trackId, streamType, original) {
+				atomic.AddInt64(&p.stats.bytesOut, int64(len(original)))
+			}
+		}
+	}
+
+	if pu, ok := p.pushers[path]; ok {
+		if pu.writeFrame(trackId, streamType, original) {
+			atomic.AddInt64(&p.stats.bytesOut, int64(len(original)))
+		}
+	}
+}
+
+// forwardFrameToReader sends a frame of the publisher of a path to a reader of
+// the path. It can be called by multiple goroutines at once, for different
+// TCP readers, if rewriteSsrc is disabled
+func (p *program) forwardFrameToReader(client *serverClient, trackId int, streamType gortsplib.StreamType,
+	frame []byte, rtcpPkts []rtcp.Packet, sets *parameterSets) {
+	// the track has not been setup by the reader
+	if trackId >= len(client.trackIndexes) || client.trackIndexes[trackId] < 0 {
+		return
+	}
+	idx := client.trackIndexes[trackId]
+	t := client.streamTracks[idx]
+
+	if t.waitingKeyframe && streamType == gortsplib.StreamTypeRtp {
+		if !h264IsKeyframeStart(frame) {
+			return
+		}
+		t.waitingKeyframe = false
+	}
+
+	if t.paramSetsPending && streamType == gortsplib.StreamTypeRtp {
+		t.paramSetsPending = false
+		if sets != nil {
+			for _, pkt := range sets.packets(frame) {
+				p.forwardFrameToClient(client, idx, streamType, pkt, nil)
+			}
+		}
+	}
+
+	p.forwardFrameToClient(client, idx, streamType, frame, rtcpPkts)
+}
+
+// forwardFrameToClient sends a frame to a reader. trackId is the index of the
+// track among the ones setup by the reader, that is also its TCP channel
+func (p *program) forwardFrameToClient(client *serverClient, trackId int, streamType gortsplib.StreamType, frame []byte, rtcpPkts []rtcp.Packet) {
+	if p.conf.RewriteSsrc {
+		frame = p.rewriteSsrc(frame, rtcpPkts, client.streamTracks[trackId].ssrc)
+		if frame == nil {
+			return
+		}
+	}
+
+	t := client.streamTracks[trackId]
+	t.counters.onFrameOut(streamType, len(frame))
+
+	if client.streamProtocol == streamProtocolUdp {
+		if streamType == gortsplib.StreamTypeRtp {
+			if p.conf.SymmetricRtp && len(frame) >= 12 {
+				t.lastSsrc = binary.BigEndian.Uint32(frame[8:12])
+			}
+
+			addr := t.udpRtpAddr
+			if addr == nil {
+				addr = &net.UDPAddr{
+					IP:   client.ip(),
+					Zone: client.zone(),
+					Port: t.rtpPort,
 				}
 			}
+			t.rtpl.write(&udpAddrBufPair{
+				addr: addr,
+				buf:  frame,
+			})
+		} else {
+			addr := t.udpRtcpAddr
+			if addr == nil {
+				addr = &net.UDPAddr{
+					IP:   client.ip(),
+					Zone: client.zone(),
+					Port: t.rtcpPort,
+				}
+			}
+			t.rtcpl.write(&udpAddrBufPair{
+				addr: addr,
+				buf:  frame,
+			})
 		}
+		atomic.AddInt64(&p.stats.bytesOut, int64(len(frame)))
+		return
+	}
+
+	p.forwardFrameTcp(client, trackId, streamType, frame)
+}
+
+// frames are queued in order not to block the event loop when a reader
+// is slower than the publisher
+func (p *program) forwardFrameTcp(client *serverClient, trackId int, streamType gortsplib.StreamType, frame []byte) {
+	// each queued frame has its own buffer, that is released by the client
+	// after the frame has been written or by this function when it is dropped
+	evt := serverClientEventFrameTcp{
+		frame: &gortsplib.InterleavedFrame{
+			TrackId:    trackId,
+			StreamType: streamType,
+			Content:    frameBuffers.copy(frame),
+		},
+	}
+
+	select {
+	case client.events <- evt:
+		return
+	default:
+	}
+
+	// queue is full
+	switch p.conf.SlowReaderPolicy {
+	case "dropOldest":
+		select {
+		case rawEvt := <-client.events:
+			oldest := rawEvt.(serverClientEventFrameTcp).frame
+			atomic.AddUint64(&client.streamTracks[oldest.TrackId].counters.framesDropped, 1)
+			frameBuffers.put(oldest.Content)
+		default:
+		}
+		client.events <- evt
+
+	case "disconnect":
+		frameBuffers.put(evt.frame.Content)
+		atomic.AddUint64(&client.streamTracks[trackId].counters.framesDropped, 1)
+		if !client.slowReaderClosed {
+			client.slowReaderClosed = true
+			client.log("ERR: reader is too slow, closing")
+			client.conn.NetConn().Close()
+		}
+
+	default: // dropNewest
+		frameBuffers.put(evt.frame.Content)
+		atomic.AddUint64(&client.streamTracks[trackId].counters.framesDropped, 1)
 	}
 }
 
 func main() {
-	_, err := newProgram(os.Args[1:], os.Stdin)
+	args := parseArgs(os.Args[1:])
+
+	if args.version {
+		fmt.Println(Version)
+		os.Exit(0)
+	}
+
+	conf, err := loadConf(args.confPath, os.Stdin)
 	if err != nil {
+		if hint := confErrorHint(err); hint != "" {
+			log.Fatalf("ERR: %s (%s)", err, hint)
+		}
 		log.Fatal("ERR: ", err)
 	}
 
+	if args.check {
+		fmt.Println("configuration is valid")
+		os.Exit(0)
+	}
+
+	p, err := newProgramWithConf(conf)
+	if err != nil {
+		log.Fatal("ERR: ", err)
+	}
+
+	if args.loopbackTest {
+		res, err := p.runLoopbackTest()
+		p.close()
+		if err != nil {
+			fmt.Println("FAIL:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("PASS: %d frames published and read back in %s\n", res.frames, res.duration)
+		os.Exit(0)
+	}
+
 	select {}
 }
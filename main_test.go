@@ -2,15 +2,38 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/aler9/gortsplib"
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
 )
 
 var ownDockerIp = func() string {
@@ -92,6 +115,564 @@ func (c *container) wait() int {
 	return int(code)
 }
 
+// logBuffer collects the output of the log package
+type logBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+// newLogBuffer redirects the output of the log package to a buffer, until
+// log.SetOutput() is called again
+func newLogBuffer() *logBuffer {
+	lb := &logBuffer{}
+	log.SetOutput(lb)
+	return lb
+}
+
+func (lb *logBuffer) Write(p []byte) (int, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *logBuffer) String() string {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.buf.String()
+}
+
+// SDP of the streams that are published by the tests that don't use docker
+const testSdp = "v=0\r\n" +
+	"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+	"s=Stream\r\n" +
+	"c=IN IP4 127.0.0.1\r\n" +
+	"t=0 0\r\n" +
+	"m=video 0 RTP/AVP 96\r\n" +
+	"a=rtpmap:96 H264/90000\r\n"
+
+// testRtpFrame returns a RTP packet that contains a H264 IDR
+func testRtpFrame(seq uint16) []byte {
+	buf := make([]byte, 12+100)
+	buf[0] = 0x80
+	buf[1] = 96
+	binary.BigEndian.PutUint16(buf[2:4], seq)
+	buf[12] = 0x65
+	return buf
+}
+
+// testDial connects to the server under test
+func testDial(t *testing.T) (net.Conn, *gortsplib.ConnClient) {
+	nconn, err := net.Dial("tcp", "127.0.0.1:8554")
+	require.NoError(t, err)
+	return nconn, gortsplib.NewConnClient(gortsplib.ConnClientConf{
+		Conn:         nconn,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	})
+}
+
+// testDo sends a request to the server under test and checks that it succeeds
+func testDo(t *testing.T, conn *gortsplib.ConnClient, method gortsplib.Method, path string,
+	header gortsplib.Header, content []byte) {
+	u, err := url.Parse("rtsp://127.0.0.1:8554/" + path)
+	require.NoError(t, err)
+	res, err := conn.Do(&gortsplib.Request{Method: method, Url: u, Header: header, Content: content})
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+}
+
+// testPublish publishes a stream on a path with TCP and sends RTP packets on
+// its first track, until the connection is closed
+func testPublish(t *testing.T, conn *gortsplib.ConnClient, path string, sdpText string) {
+	testDo(t, conn, gortsplib.ANNOUNCE, path, gortsplib.Header{
+		"Content-Type":   []string{"application/sdp"},
+		"Content-Length": []string{strconv.FormatInt(int64(len(sdpText)), 10)},
+	}, []byte(sdpText))
+
+	for trackId := 0; trackId < strings.Count(sdpText, "\nm="); trackId++ {
+		testDo(t, conn, gortsplib.SETUP, fmt.Sprintf("%s/trackID=%d", path, trackId), gortsplib.Header{
+			"Transport": []string{fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;mode=record",
+				trackId*2, trackId*2+1)},
+		}, nil)
+	}
+
+	testDo(t, conn, gortsplib.RECORD, path, nil, nil)
+
+	go func() {
+		for seq := uint16(0); ; seq++ {
+			err := conn.WriteFrame(&gortsplib.InterleavedFrame{
+				TrackId:    0,
+				StreamType: gortsplib.StreamTypeRtp,
+				Content:    testRtpFrame(seq),
+			})
+			if err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+}
+
+// testPlayTcp reads the first track of a path with TCP
+func testPlayTcp(t *testing.T, conn *gortsplib.ConnClient, path string) {
+	testDo(t, conn, gortsplib.DESCRIBE, path, nil, nil)
+	testDo(t, conn, gortsplib.SETUP, path+"/trackID=0", gortsplib.Header{
+		"Transport": []string{"RTP/AVP/TCP;unicast;interleaved=0-1"},
+	}, nil)
+	testDo(t, conn, gortsplib.PLAY, path, nil, nil)
+}
+
+// testReadRtp reads frames until a RTP packet is received
+func testReadRtp(t *testing.T, conn *gortsplib.ConnClient) []byte {
+	frame := &gortsplib.InterleavedFrame{Content: make([]byte, 2048)}
+	for {
+		frame.Content = frame.Content[:cap(frame.Content)]
+		err := conn.ReadFrame(frame)
+		require.NoError(t, err)
+		if frame.StreamType == gortsplib.StreamTypeRtp {
+			return frame.Content
+		}
+	}
+}
+
+func TestReaderStartDelay(t *testing.T) {
+	p, err := newProgram([]string{"stdin"}, bytes.NewBuffer([]byte("readerStartDelay: 500ms\n")))
+	require.NoError(t, err)
+	defer p.close()
+
+	pnconn, pconn := testDial(t)
+	defer pnconn.Close()
+	testPublish(t, pconn, "teststream", testSdp)
+
+	rnconn, rconn := testDial(t)
+	defer rnconn.Close()
+	testPlayTcp(t, rconn, "teststream")
+	playTime := time.Now()
+
+	testReadRtp(t, rconn)
+	require.GreaterOrEqual(t, int64(time.Since(playTime)), int64(500*time.Millisecond))
+}
+
+func TestTcpWriteBufferSize(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the size of the send buffer is not read back on Windows")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	for _, ca := range []struct {
+		name    string
+		size    int
+		clamped bool
+	}{
+		{"applied", 64 * 1024, false},
+		{"clamped", 1024 * 1024 * 1024, true},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			cconn, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			defer cconn.Close()
+
+			nconn, err := l.Accept()
+			require.NoError(t, err)
+			defer nconn.Close()
+
+			c := &serverClient{
+				p:    &program{conf: &conf{}},
+				conn: gortsplib.NewConnServer(gortsplib.ConnServerConf{Conn: newRequestLimitConn(nconn, 4096)}),
+			}
+
+			lb := newLogBuffer()
+			defer log.SetOutput(os.Stderr)
+
+			c.setTcpWriteBuffer(ca.size)
+
+			applied, ok := tcpWriteBufferSize(nconn.(*net.TCPConn))
+			require.True(t, ok)
+			if ca.clamped {
+				require.Less(t, applied, ca.size)
+				require.Contains(t, lb.String(), "clamped by the kernel")
+			} else {
+				require.GreaterOrEqual(t, applied, ca.size)
+				require.NotContains(t, lb.String(), "clamped by the kernel")
+			}
+		})
+	}
+}
+
+func TestSilentTrack(t *testing.T) {
+	lb := newLogBuffer()
+	defer log.SetOutput(os.Stderr)
+
+	p, err := newProgram([]string{"stdin"}, bytes.NewBuffer([]byte("trackFirstFrameTimeout: 1s\n"+
+		"closeOnSilentTrack: yes\n")))
+	require.NoError(t, err)
+	defer p.close()
+
+	// only the first track sends frames
+	nconn, conn := testDial(t)
+	defer nconn.Close()
+	testPublish(t, conn, "teststream", testSdp+
+		"m=audio 0 RTP/AVP 97\r\n"+
+		"a=rtpmap:97 MPEG4-GENERIC/44100/2\r\n")
+
+	// the publisher is closed
+	nconn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 2048)
+	for {
+		_, err := nconn.Read(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok {
+				require.False(t, nerr.Timeout())
+			}
+			break
+		}
+	}
+
+	require.Contains(t, lb.String(), "track 1 has not sent any frame since RECORD")
+	require.NotContains(t, lb.String(), "track 0 has not sent any frame since RECORD")
+}
+
+func TestListenInterface(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the name of the loopback interface is lo only on Linux")
+	}
+
+	_, err := loadConf("stdin", strings.NewReader("listenInterface: nonexisting\n"))
+	require.Error(t, err)
+
+	conf, err := loadConf("stdin", strings.NewReader("listenInterface: lo\n"))
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", conf.listenIp.String())
+
+	p, err := newProgram([]string{"stdin"}, bytes.NewBuffer([]byte("listenInterface: lo\n")))
+	require.NoError(t, err)
+	defer p.close()
+
+	nconn, conn := testDial(t)
+	defer nconn.Close()
+	testDo(t, conn, gortsplib.OPTIONS, "teststream", nil, nil)
+}
+
+func TestReaderRtcpTimeout(t *testing.T) {
+	p, err := newProgram([]string{"stdin"}, bytes.NewBuffer([]byte("paths:\n"+
+		"  optional:\n"+
+		"    readerRtcpTimeout: 1s\n"+
+		"  required:\n"+
+		"    readerRtcpTimeout: 1s\n"+
+		"    requireReaderRtcp: yes\n")))
+	require.NoError(t, err)
+	defer p.close()
+
+	for _, path := range []string{"optional", "required"} {
+		nconn, conn := testDial(t)
+		defer nconn.Close()
+		testPublish(t, conn, path, testSdp)
+	}
+
+	// receiver report without report blocks
+	rr := []byte{0x80, 201, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01}
+	serverAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8001}
+
+	type reader struct {
+		nconn  net.Conn
+		closed bool
+	}
+	var readers []reader
+
+	for i, ca := range []struct {
+		path   string
+		rr     string
+		closed bool
+	}{
+		{"optional", "never", false},
+		{"required", "never", true},
+		{"optional", "always", false},
+		{"required", "always", false},
+		{"optional", "once", true},
+		{"required", "once", true},
+	} {
+		rtpPort := 36000 + i*2
+
+		rtcpConn, err := net.ListenPacket("udp", "127.0.0.1:"+strconv.FormatInt(int64(rtpPort+1), 10))
+		require.NoError(t, err)
+		defer rtcpConn.Close()
+
+		nconn, conn := testDial(t)
+		defer nconn.Close()
+
+		testDo(t, conn, gortsplib.DESCRIBE, ca.path, nil, nil)
+		testDo(t, conn, gortsplib.SETUP, ca.path+"/trackID=0", gortsplib.Header{
+			"Transport": []string{fmt.Sprintf("RTP/AVP/UDP;unicast;client_port=%d-%d", rtpPort, rtpPort+1)},
+		}, nil)
+		testDo(t, conn, gortsplib.PLAY, ca.path, nil, nil)
+
+		switch ca.rr {
+		case "once":
+			_, err := rtcpConn.WriteTo(rr, serverAddr)
+			require.NoError(t, err)
+
+		case "always":
+			go func() {
+				for {
+					_, err := rtcpConn.WriteTo(rr, serverAddr)
+					if err != nil {
+						return
+					}
+					time.Sleep(200 * time.Millisecond)
+				}
+			}()
+		}
+
+		readers = append(readers, reader{nconn, ca.closed})
+	}
+
+	// wait for the first check of the readers
+	time.Sleep(clientCheckStreamInterval + 1*time.Second)
+
+	for i, r := range readers {
+		r.nconn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := r.nconn.Read(make([]byte, 1))
+		nerr, ok := err.(net.Error)
+		if r.closed {
+			require.False(t, ok && nerr.Timeout(), "reader %d is still open", i)
+		} else {
+			require.True(t, ok && nerr.Timeout(), "reader %d has been closed", i)
+		}
+	}
+}
+
+func TestStatsd(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	p, err := newProgram([]string{"stdin"}, bytes.NewBuffer([]byte("statsdAddress: "+pc.LocalAddr().String()+"\n"+
+		"statsdInterval: 100ms\n"+
+		"statsdPrefix: test\n")))
+	require.NoError(t, err)
+	defer p.close()
+
+	nconn, _ := testDial(t)
+	defer nconn.Close()
+
+	// wait for a packet that contains the client
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		require.NoError(t, err)
+		if strings.Contains(string(buf[:n]), "test.clients:1|g\n") {
+			require.Contains(t, string(buf[:n]), "test.publishers:0|g\n")
+			require.Contains(t, string(buf[:n]), "test.readers:0|g\n")
+			break
+		}
+	}
+}
+
+func TestApiMute(t *testing.T) {
+	p, err := newProgram([]string{"stdin"}, bytes.NewBuffer([]byte("api: yes\n"+
+		"apiAddress: 127.0.0.1:9998\n")))
+	require.NoError(t, err)
+	defer p.close()
+
+	post := func(path string) int {
+		res, err := http.Post("http://127.0.0.1:9998/v1/paths/"+path, "", nil)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	pnconn, pconn := testDial(t)
+	defer pnconn.Close()
+	testPublish(t, pconn, "teststream", testSdp)
+
+	rnconn, rconn := testDial(t)
+	defer rnconn.Close()
+	testPlayTcp(t, rconn, "teststream")
+
+	rtpReceived := make(chan struct{}, 1)
+	go func() {
+		frame := &gortsplib.InterleavedFrame{Content: make([]byte, 2048)}
+		for {
+			frame.Content = frame.Content[:cap(frame.Content)]
+			err := rconn.ReadFrame(frame)
+			if err != nil {
+				return
+			}
+			if frame.StreamType == gortsplib.StreamTypeRtp {
+				select {
+				case rtpReceived <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	waitRtp := func(timeout time.Duration) bool {
+		select {
+		case <-rtpReceived:
+			return true
+		case <-time.After(timeout):
+			return false
+		}
+	}
+
+	require.True(t, waitRtp(5*time.Second))
+
+	require.Equal(t, http.StatusNotFound, post("nonexisting/mute"))
+	require.Equal(t, http.StatusOK, post("teststream/mute"))
+
+	// discard the frames that were sent before the path was muted
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case <-rtpReceived:
+	default:
+	}
+	require.False(t, waitRtp(500*time.Millisecond))
+
+	require.Equal(t, http.StatusOK, post("teststream/unmute"))
+	require.True(t, waitRtp(5*time.Second))
+}
+
+func TestApiDrain(t *testing.T) {
+	p, err := newProgram([]string{"stdin"}, bytes.NewBuffer([]byte("api: yes\n"+
+		"apiAddress: 127.0.0.1:9998\n"+
+		"paths:\n"+
+		"  teststream:\n")))
+	require.NoError(t, err)
+	defer p.close()
+
+	// connections of previous tests are not reused
+	hc := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	post := func(path string) int {
+		res, err := hc.Post("http://127.0.0.1:9998/v1/paths/"+path, "", nil)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	require.Equal(t, http.StatusNotFound, post("nonexisting/drain"))
+	require.Equal(t, http.StatusOK, post("teststream/drain"))
+
+	nconn, conn := testDial(t)
+	defer nconn.Close()
+	u, err := url.Parse("rtsp://127.0.0.1:8554/teststream")
+	require.NoError(t, err)
+	res, err := conn.Do(&gortsplib.Request{
+		Method: gortsplib.ANNOUNCE,
+		Url:    u,
+		Header: gortsplib.Header{
+			"Content-Type":   []string{"application/sdp"},
+			"Content-Length": []string{strconv.FormatInt(int64(len(testSdp)), 10)},
+		},
+		Content: []byte(testSdp),
+	})
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StatusServiceUnavailable, res.StatusCode)
+
+	require.Equal(t, http.StatusOK, post("teststream/undrain"))
+}
+
+func TestSlowReaderPolicy(t *testing.T) {
+	// frames have different sizes, in order to detect a buffer that has been
+	// overwritten by another frame
+	frameForSeq := func(seq uint16) []byte {
+		buf := make([]byte, 12+1+int(seq%200))
+		buf[0] = 0x80
+		buf[1] = 96
+		binary.BigEndian.PutUint16(buf[2:4], seq)
+		buf[12] = 0x65
+		for i := 13; i < len(buf); i++ {
+			buf[i] = byte(seq)
+		}
+		return buf
+	}
+
+	const frameCount = 3000
+
+	for _, policy := range []string{"dropNewest", "dropOldest", "disconnect"} {
+		t.Run(policy, func(t *testing.T) {
+			p, err := newProgram([]string{"stdin"}, bytes.NewBuffer([]byte("readerQueueSize: 4\n"+
+				"tcpWriteBufferSize: 4096\n"+
+				"slowReaderPolicy: "+policy+"\n")))
+			require.NoError(t, err)
+			defer p.close()
+
+			pnconn, pconn := testDial(t)
+			defer pnconn.Close()
+			testDo(t, pconn, gortsplib.ANNOUNCE, "teststream", gortsplib.Header{
+				"Content-Type":   []string{"application/sdp"},
+				"Content-Length": []string{strconv.FormatInt(int64(len(testSdp)), 10)},
+			}, []byte(testSdp))
+			testDo(t, pconn, gortsplib.SETUP, "teststream/trackID=0", gortsplib.Header{
+				"Transport": []string{"RTP/AVP/TCP;unicast;interleaved=0-1;mode=record"},
+			}, nil)
+			testDo(t, pconn, gortsplib.RECORD, "teststream", nil, nil)
+
+			rnconn, err := net.Dial("tcp", "127.0.0.1:8554")
+			require.NoError(t, err)
+			defer rnconn.Close()
+			rnconn.(*net.TCPConn).SetReadBuffer(4096)
+			rconn := gortsplib.NewConnClient(gortsplib.ConnClientConf{
+				Conn:         rnconn,
+				ReadTimeout:  1 * time.Second,
+				WriteTimeout: 5 * time.Second,
+			})
+			testPlayTcp(t, rconn, "teststream")
+
+			// the reader doesn't read while the frames are sent
+			for seq := uint16(0); seq < frameCount; seq++ {
+				err := pconn.WriteFrame(&gortsplib.InterleavedFrame{
+					TrackId:    0,
+					StreamType: gortsplib.StreamTypeRtp,
+					Content:    frameForSeq(seq),
+				})
+				require.NoError(t, err)
+			}
+			time.Sleep(500 * time.Millisecond)
+
+			received := 0
+			receivedBytes := 0
+			lastSeq := -1
+			frame := &gortsplib.InterleavedFrame{Content: make([]byte, 2048)}
+			for {
+				frame.Content = frame.Content[:cap(frame.Content)]
+				err := rconn.ReadFrame(frame)
+				if err != nil {
+					break
+				}
+				receivedBytes += len(frame.Content)
+				if frame.StreamType != gortsplib.StreamTypeRtp {
+					continue
+				}
+
+				seq := binary.BigEndian.Uint16(frame.Content[2:4])
+				require.Greater(t, int(seq), lastSeq)
+				require.Equal(t, frameForSeq(seq), frame.Content)
+				lastSeq = int(seq)
+				received++
+			}
+
+			require.Greater(t, received, 0)
+			require.Less(t, received, frameCount)
+
+			switch policy {
+			case "dropNewest":
+				require.Less(t, lastSeq, frameCount-1)
+				require.Equal(t, int64(receivedBytes), p.stats.getBytesOut())
+
+			case "dropOldest":
+				require.Equal(t, frameCount-1, lastSeq)
+				require.Equal(t, int64(receivedBytes), p.stats.getBytesOut())
+			}
+		})
+	}
+}
+
 func TestProtocols(t *testing.T) {
 	for _, conf := range [][3]string{
 		{"udp", "udp", "ffmpeg"},
@@ -101,63 +682,1488 @@ func TestProtocols(t *testing.T) {
 		{"tcp", "udp", "vlc"},
 		{"tcp", "tcp", "vlc"},
 	} {
-		t.Run(strings.Join(conf[:], "_"), func(t *testing.T) {
-			p, err := newProgram([]string{}, bytes.NewBuffer(nil))
-			require.NoError(t, err)
-			defer p.close()
+		t.Run(strings.Join(conf[:], "_"), func(t *testing.T) {
+			p, err := newProgram([]string{}, bytes.NewBuffer(nil))
+			require.NoError(t, err)
+			defer p.close()
+
+			time.Sleep(1 * time.Second)
+
+			cnt1, err := newContainer("ffmpeg", "source", []string{
+				"-hide_banner",
+				"-loglevel", "panic",
+				"-re",
+				"-stream_loop", "-1",
+				"-i", "/emptyvideo.ts",
+				"-c", "copy",
+				"-f", "rtsp",
+				"-rtsp_transport", conf[0],
+				"rtsp://" + ownDockerIp + ":8554/teststream",
+			})
+			require.NoError(t, err)
+			defer cnt1.close()
+
+			time.Sleep(1 * time.Second)
+
+			if conf[2] == "ffmpeg" {
+				cnt2, err := newContainer("ffmpeg", "dest", []string{
+					"-hide_banner",
+					"-loglevel", "panic",
+					"-rtsp_transport", conf[1],
+					"-i", "rtsp://" + ownDockerIp + ":8554/teststream",
+					"-vframes", "1",
+					"-f", "image2",
+					"-y", "/dev/null",
+				})
+				require.NoError(t, err)
+				defer cnt2.close()
+
+				code := cnt2.wait()
+				require.Equal(t, 0, code)
+
+			} else {
+				args := []string{}
+				if conf[1] == "tcp" {
+					args = append(args, "--rtsp-tcp")
+				}
+				args = append(args, "rtsp://"+ownDockerIp+":8554/teststream")
+
+				cnt2, err := newContainer("vlc", "dest", args)
+				require.NoError(t, err)
+				defer cnt2.close()
+
+				code := cnt2.wait()
+				require.Equal(t, 0, code)
+			}
+		})
+	}
+}
+
+func TestBareTransport(t *testing.T) {
+	p, err := newProgram([]string{}, bytes.NewBuffer(nil))
+	require.NoError(t, err)
+	defer p.close()
+
+	time.Sleep(1 * time.Second)
+
+	u, err := url.Parse("rtsp://localhost:8554/teststream")
+	require.NoError(t, err)
+
+	tu, err := url.Parse("rtsp://localhost:8554/teststream/trackID=0")
+	require.NoError(t, err)
+
+	nconn1, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn1.Close()
+	conn1 := gortsplib.NewConnClient(gortsplib.ConnClientConf{Conn: nconn1})
+
+	sdpText := "v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=Stream\r\n" +
+		"c=IN IP4 127.0.0.1\r\n" +
+		"t=0 0\r\n" +
+		"m=video 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H264/90000\r\n"
+
+	res, err := conn1.Do(&gortsplib.Request{
+		Method: gortsplib.ANNOUNCE,
+		Url:    u,
+		Header: gortsplib.Header{
+			"Content-Type":   []string{"application/sdp"},
+			"Content-Length": []string{fmt.Sprintf("%d", len(sdpText))},
+		},
+		Content: []byte(sdpText),
+	})
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+	// a transport without lower-transport defaults to UDP
+	res, err = conn1.Do(&gortsplib.Request{
+		Method: gortsplib.SETUP,
+		Url:    tu,
+		Header: gortsplib.Header{
+			"Transport": []string{"RTP/AVP;unicast;client_port=35466-35467;mode=record"},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+	require.Contains(t, res.Header["Transport"][0], "RTP/AVP/UDP")
+
+	res, err = conn1.Do(&gortsplib.Request{
+		Method: gortsplib.RECORD,
+		Url:    u,
+	})
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+	nconn2, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn2.Close()
+	conn2 := gortsplib.NewConnClient(gortsplib.ConnClientConf{Conn: nconn2})
+
+	res, err = conn2.Do(&gortsplib.Request{
+		Method: gortsplib.SETUP,
+		Url:    tu,
+		Header: gortsplib.Header{
+			"Transport": []string{"RTP/AVP;unicast;client_port=35468-35469"},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+	require.Contains(t, res.Header["Transport"][0], "RTP/AVP/UDP")
+}
+
+func TestTransportPorts(t *testing.T) {
+	for _, ca := range []struct {
+		name     string
+		in       string
+		rtpPort  int
+		rtcpPort int
+	}{
+		{"range", "RTP/AVP;unicast;client_port=5000-5001", 5000, 5001},
+		{"single", "RTP/AVP;unicast;client_port=5000", 5000, 5001},
+		{"spaces", "RTP/AVP; unicast; client_port=5000-5001", 5000, 5001},
+		{"missing", "RTP/AVP;unicast", 0, 0},
+		{"zero", "RTP/AVP;unicast;client_port=0-1", 0, 0},
+		{"too big", "RTP/AVP;unicast;client_port=70000-70001", 0, 0},
+		{"last port", "RTP/AVP;unicast;client_port=65535", 0, 0},
+		{"garbage", "RTP/AVP;unicast;client_port=5000-5001-5002", 0, 0},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			rtpPort, rtcpPort := readTransportPorts(readHeaderTransport(ca.in), "client_port")
+			require.Equal(t, ca.rtpPort, rtpPort)
+			require.Equal(t, ca.rtcpPort, rtcpPort)
+		})
+	}
+}
+
+func TestSetupTransport(t *testing.T) {
+	p, err := newProgram([]string{}, bytes.NewBuffer(nil))
+	require.NoError(t, err)
+	defer p.close()
+
+	time.Sleep(1 * time.Second)
+
+	sdpText := "v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=Stream\r\n" +
+		"c=IN IP4 127.0.0.1\r\n" +
+		"t=0 0\r\n" +
+		"m=video 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H264/90000\r\n" +
+		"m=audio 0 RTP/AVP 97\r\n" +
+		"a=rtpmap:97 MPEG4-GENERIC/44100/2\r\n"
+
+	for _, ca := range []struct {
+		name string
+		req  []string
+		res  []string
+	}{
+		{
+			"udp",
+			[]string{
+				"RTP/AVP;unicast;client_port=35466-35467;mode=record",
+				"RTP/AVP/UDP; unicast; client_port=35468; mode=record",
+			},
+			[]string{
+				"RTP/AVP/UDP;unicast;client_port=35466-35467;server_port=8000-8001",
+				"RTP/AVP/UDP;unicast;client_port=35468-35469;server_port=8000-8001",
+			},
+		},
+		{
+			"tcp",
+			[]string{
+				"RTP/AVP/TCP;unicast;interleaved=0-1;mode=record",
+				"RTP/AVP/TCP;unicast;interleaved=2-3;mode=record",
+			},
+			[]string{
+				"RTP/AVP/TCP;unicast;interleaved=0-1",
+				"RTP/AVP/TCP;unicast;interleaved=2-3",
+			},
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			u, err := url.Parse("rtsp://localhost:8554/" + ca.name)
+			require.NoError(t, err)
+
+			nconn, err := net.Dial("tcp", u.Host)
+			require.NoError(t, err)
+			defer nconn.Close()
+			conn := gortsplib.NewConnClient(gortsplib.ConnClientConf{Conn: nconn})
+
+			res, err := conn.Do(&gortsplib.Request{
+				Method: gortsplib.ANNOUNCE,
+				Url:    u,
+				Header: gortsplib.Header{
+					"Content-Type":   []string{"application/sdp"},
+					"Content-Length": []string{fmt.Sprintf("%d", len(sdpText))},
+				},
+				Content: []byte(sdpText),
+			})
+			require.NoError(t, err)
+			require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+			for i := range ca.req {
+				tu, err := url.Parse(fmt.Sprintf("rtsp://localhost:8554/%s/trackID=%d", ca.name, i))
+				require.NoError(t, err)
+
+				res, err = conn.Do(&gortsplib.Request{
+					Method: gortsplib.SETUP,
+					Url:    tu,
+					Header: gortsplib.Header{
+						"Transport": []string{ca.req[i]},
+					},
+				})
+				require.NoError(t, err)
+				require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+				require.Equal(t, []string{ca.res[i]}, res.Header["Transport"])
+			}
+		})
+	}
+}
+
+func TestConfUdpPorts(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		conf string
+		err  string
+	}{
+		{
+			"rtp port odd",
+			"rtpPort: 8001\n" +
+				"rtcpPort: 8002\n",
+			"rtp port must be even",
+		},
+		{
+			"rtcp port not consecutive",
+			"rtpPort: 8000\n" +
+				"rtcpPort: 8003\n",
+			"rtcp and rtp ports must be consecutive",
+		},
+		{
+			"rtp port inside range",
+			"rtpPort: 10010\n" +
+				"rtcpPort: 10011\n" +
+				"rtpPortMin: 10000\n" +
+				"rtpPortMax: 10100\n",
+			"rtp and rtcp ports (10010-10011) can't be inside the range rtpPortMin-rtpPortMax (10000-10100)",
+		},
+		{
+			"rtcp port at range start",
+			"rtpPort: 9998\n" +
+				"rtcpPort: 9999\n" +
+				"rtpPortMin: 9998\n" +
+				"rtpPortMax: 10100\n",
+			"rtp and rtcp ports (9998-9999) can't be inside the range rtpPortMin-rtpPortMax (9998-10100)",
+		},
+		{
+			"range min odd",
+			"rtpPortMin: 10001\n" +
+				"rtpPortMax: 10100\n",
+			"rtpPortMin must be even",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			_, err := loadConf("stdin", strings.NewReader(ca.conf))
+			require.EqualError(t, err, ca.err)
+		})
+	}
+
+	_, err := loadConf("stdin", strings.NewReader("rtpPort: 9998\n"+
+		"rtcpPort: 9999\n"+
+		"rtpPortMin: 10000\n"+
+		"rtpPortMax: 10100\n"))
+	require.NoError(t, err)
+}
+
+func TestProgramWithConf(t *testing.T) {
+	conf := &conf{
+		RtspPort: 8555,
+		RtpPort:  8010,
+		RtcpPort: 8011,
+	}
+	err := conf.fill()
+	require.NoError(t, err)
+
+	p, err := newProgramWithConf(conf)
+	require.NoError(t, err)
+	defer p.close()
+
+	u, err := url.Parse("rtsp://localhost:8555/teststream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+	conn := gortsplib.NewConnClient(gortsplib.ConnClientConf{Conn: nconn})
+
+	res, err := conn.Options(u)
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+}
+
+func TestPushTo(t *testing.T) {
+	conf, err := loadConf("stdin", strings.NewReader("rtspPort: 8555\n"+
+		"rtpPort: 8010\n"+
+		"rtcpPort: 8011\n"+
+		"paths:\n"+
+		"  all:\n"+
+		"  src:\n"+
+		"    pushTo: rtsp://localhost:8555/dst\n"))
+	require.NoError(t, err)
+
+	p, err := newProgramWithConf(conf)
+	require.NoError(t, err)
+	defer p.close()
+
+	dial := func() *gortsplib.ConnClient {
+		nconn, err := net.Dial("tcp", "localhost:8555")
+		require.NoError(t, err)
+		return gortsplib.NewConnClient(gortsplib.ConnClientConf{
+			Conn:         nconn,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 5 * time.Second,
+		})
+	}
+
+	do := func(conn *gortsplib.ConnClient, req *gortsplib.Request) *gortsplib.Response {
+		res, err := conn.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+
+	src, _ := url.Parse("rtsp://localhost:8555/src")
+	dst, _ := url.Parse("rtsp://localhost:8555/dst")
+
+	pconn := dial()
+	defer pconn.NetConn().Close()
+
+	res := do(pconn, &gortsplib.Request{
+		Method: gortsplib.ANNOUNCE,
+		Url:    src,
+		Header: gortsplib.Header{
+			"Content-Type":   []string{"application/sdp"},
+			"Content-Length": []string{strconv.FormatInt(int64(len(loopbackSdp)), 10)},
+		},
+		Content: []byte(loopbackSdp),
+	})
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+	res = do(pconn, &gortsplib.Request{
+		Method: gortsplib.SETUP,
+		Url:    &url.URL{Scheme: "rtsp", Host: src.Host, Path: "/src/trackID=0"},
+		Header: gortsplib.Header{
+			"Transport": []string{"RTP/AVP/TCP;unicast;interleaved=0-1;mode=record"},
+		},
+	})
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+	res = do(pconn, &gortsplib.Request{Method: gortsplib.RECORD, Url: src})
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+	// wait for the pusher to publish on the destination path
+	var rconn *gortsplib.ConnClient
+	for i := 0; ; i++ {
+		rconn = dial()
+		res = do(rconn, &gortsplib.Request{Method: gortsplib.DESCRIBE, Url: dst})
+		if res.StatusCode == gortsplib.StatusOK {
+			break
+		}
+		rconn.NetConn().Close()
+		require.Less(t, i, 50)
+		time.Sleep(100 * time.Millisecond)
+	}
+	defer rconn.NetConn().Close()
+
+	res = do(rconn, &gortsplib.Request{
+		Method: gortsplib.SETUP,
+		Url:    &url.URL{Scheme: "rtsp", Host: dst.Host, Path: "/dst/trackID=0"},
+		Header: gortsplib.Header{
+			"Transport": []string{"RTP/AVP/TCP;unicast;interleaved=0-1"},
+		},
+	})
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+	res = do(rconn, &gortsplib.Request{Method: gortsplib.PLAY, Url: dst})
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+	go func() {
+		for seq := uint16(0); ; seq++ {
+			err := pconn.WriteFrame(&gortsplib.InterleavedFrame{
+				TrackId:    0,
+				StreamType: gortsplib.StreamTypeRtp,
+				Content:    loopbackFrame(seq),
+			})
+			if err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	frame := &gortsplib.InterleavedFrame{Content: make([]byte, 2048)}
+	for {
+		frame.Content = frame.Content[:cap(frame.Content)]
+		err := rconn.ReadFrame(frame)
+		require.NoError(t, err)
+		if frame.StreamType == gortsplib.StreamTypeRtp {
+			break
+		}
+	}
+	seq := uint16(frame.Content[2])<<8 | uint16(frame.Content[3])
+	require.Equal(t, loopbackFrame(seq), frame.Content)
+}
+
+func TestSourceTransport(t *testing.T) {
+	for _, ca := range []struct {
+		name        string
+		in          string
+		interleaved string
+		serverPort  string
+	}{
+		{"standard", "RTP/AVP/TCP;unicast;interleaved=0-1", "0-1", ""},
+		{"case and spaces", "RTP/AVP/TCP; unicast; Interleaved = 2-3", "2-3", ""},
+		{"quoted", "RTP/AVP/TCP;unicast;interleaved=\"4-5\";mode=\"PLAY\"", "4-5", ""},
+		{"many transports", "RTP/AVP;unicast;server_port=6970,RTP/AVP;multicast;port=5000-5001", "", "6970"},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			th := readSourceTransport(ca.in)
+			require.Equal(t, ca.interleaved, th.GetValue("interleaved"))
+			require.Equal(t, ca.serverPort, th.GetValue("server_port"))
+		})
+	}
+}
+
+// a camera that returns channels different from the requested ones, with a
+// Transport header that doesn't follow RFC 2326 strictly
+func TestSourceInterleavedChannels(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:8566")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		nconn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer nconn.Close()
+		conn := gortsplib.NewConnServer(gortsplib.ConnServerConf{
+			Conn:         nconn,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 5 * time.Second,
+		})
+
+		for {
+			req, err := conn.ReadRequest()
+			if err != nil {
+				return
+			}
+
+			res := &gortsplib.Response{
+				StatusCode: gortsplib.StatusOK,
+				Header: gortsplib.Header{
+					"CSeq": req.Header["CSeq"],
+				},
+			}
+
+			switch req.Method {
+			case gortsplib.DESCRIBE:
+				res.Header["Content-Type"] = []string{"application/sdp"}
+				res.Content = []byte(loopbackSdp)
+
+			case gortsplib.SETUP:
+				res.Header["Transport"] = []string{"RTP/AVP/TCP;unicast;Interleaved = 2-3;ssrc=0A1B2C3D;mode=\"PLAY\""}
+				res.Header["Session"] = []string{"12345678"}
+			}
+
+			err = conn.WriteResponse(res)
+			if err != nil {
+				return
+			}
+
+			if req.Method == gortsplib.PLAY {
+				break
+			}
+		}
+
+		for seq := uint16(0); ; seq++ {
+			err := conn.WriteFrame(&gortsplib.InterleavedFrame{
+				TrackId:    1,
+				StreamType: gortsplib.StreamTypeRtp,
+				Content:    loopbackFrame(seq),
+			})
+			if err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	conf, err := loadConf("stdin", strings.NewReader("rtspPort: 8558\n"+
+		"protocols: [tcp]\n"+
+		"paths:\n"+
+		"  cam:\n"+
+		"    source: rtsp://localhost:8566/stream\n"+
+		"    sourceProtocol: tcp\n"))
+	require.NoError(t, err)
+
+	p, err := newProgramWithConf(conf)
+	require.NoError(t, err)
+	defer p.close()
+
+	u, _ := url.Parse("rtsp://localhost:8558/cam")
+
+	var conn *gortsplib.ConnClient
+	for i := 0; ; i++ {
+		nconn, err := net.Dial("tcp", u.Host)
+		require.NoError(t, err)
+		conn = gortsplib.NewConnClient(gortsplib.ConnClientConf{
+			Conn:         nconn,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 5 * time.Second,
+		})
+		res, err := conn.Do(&gortsplib.Request{Method: gortsplib.DESCRIBE, Url: u})
+		require.NoError(t, err)
+		if res.StatusCode == gortsplib.StatusOK {
+			break
+		}
+		nconn.Close()
+		require.Less(t, i, 50)
+		time.Sleep(100 * time.Millisecond)
+	}
+	defer conn.NetConn().Close()
+
+	res, err := conn.Do(&gortsplib.Request{
+		Method: gortsplib.SETUP,
+		Url:    &url.URL{Scheme: "rtsp", Host: u.Host, Path: "/cam/trackID=0"},
+		Header: gortsplib.Header{
+			"Transport": []string{"RTP/AVP/TCP;unicast;interleaved=0-1"},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+	res, err = conn.Do(&gortsplib.Request{Method: gortsplib.PLAY, Url: u})
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+	frame := &gortsplib.InterleavedFrame{Content: make([]byte, 2048)}
+	for {
+		frame.Content = frame.Content[:cap(frame.Content)]
+		err := conn.ReadFrame(frame)
+		require.NoError(t, err)
+		if frame.StreamType == gortsplib.StreamTypeRtp {
+			break
+		}
+	}
+	require.Equal(t, 0, frame.TrackId)
+	seq := uint16(frame.Content[2])<<8 | uint16(frame.Content[3])
+	require.Equal(t, loopbackFrame(seq), frame.Content)
+}
+
+func TestSourceEvents(t *testing.T) {
+	events := make(chan sourceEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var evt sourceEvent
+		err := json.NewDecoder(r.Body).Decode(&evt)
+		require.NoError(t, err)
+		events <- evt
+	}))
+	defer server.Close()
+
+	// the source points to a closed port
+	conf, err := loadConf("stdin", strings.NewReader("rtspPort: 8557\n"+
+		"protocols: [tcp]\n"+
+		"sourceEventsUrl: "+server.URL+"\n"+
+		"paths:\n"+
+		"  cam:\n"+
+		"    source: rtsp://localhost:1/stream\n"+
+		"    sourceProtocol: tcp\n"))
+	require.NoError(t, err)
+
+	p, err := newProgramWithConf(conf)
+	require.NoError(t, err)
+	defer p.close()
+
+	for _, expected := range [][2]string{
+		{"stopped", "connecting"},
+		{"connecting", "error"},
+	} {
+		select {
+		case evt := <-events:
+			require.Equal(t, "cam", evt.Path)
+			require.Equal(t, "rtsp://localhost:1/stream", evt.Url)
+			require.Equal(t, expected, [2]string{evt.PreviousState, evt.State})
+		case <-time.After(5 * time.Second):
+			t.Fatal("event not received")
+		}
+	}
+}
+
+func TestConfErrorKinds(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		conf string
+		kind error
+	}{
+		{
+			"syntax",
+			"rtspPort: [8554\n",
+			errConfSyntax,
+		},
+		{
+			"unknown field",
+			"rtspPortt: 8554\n",
+			errConfUnknownField,
+		},
+		{
+			"rtsp port out of range",
+			"rtspPort: 70000\n",
+			errConfInvalidPort,
+		},
+		{
+			"rtp port odd",
+			"rtpPort: 8001\n" +
+				"rtcpPort: 8002\n",
+			errConfInvalidPort,
+		},
+		{
+			"api port used by rtsp",
+			"api: true\n" +
+				"apiAddress: :8554\n",
+			errConfInvalidPort,
+		},
+		{
+			"source scheme",
+			"paths:\n" +
+				"  cam:\n" +
+				"    source: ftp://host/stream\n",
+			errConfInvalidSourceUrl,
+		},
+		{
+			"fallback scheme",
+			"paths:\n" +
+				"  cam:\n" +
+				"    source: rtsp://host/stream\n" +
+				"    sourceFallbacks: [file:///stream.mp4]\n",
+			errConfInvalidSourceUrl,
+		},
+		{
+			"slow reader policy",
+			"slowReaderPolicy: wait\n",
+			errConfInvalid,
+		},
+		{
+			"rtcp interval",
+			"paths:\n" +
+				"  cam:\n" +
+				"    rtcpInterval: 100ms\n",
+			errConfInvalid,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			_, err := loadConf("stdin", strings.NewReader(ca.conf))
+			require.Error(t, err)
+			require.True(t, errors.Is(err, ca.kind), err.Error())
+		})
+	}
+
+	_, err := loadConf("/nonexistent/rtsp-simple-server.yml", nil)
+	require.True(t, errors.Is(err, errConfNotFound))
+	require.NotEmpty(t, confErrorHint(err))
+}
+
+func TestConfSourcePublisher(t *testing.T) {
+	conf, err := loadConf("stdin", strings.NewReader("paths:\n"+
+		"  cam1:\n"+
+		"    source: publisher\n"+
+		"  cam2:\n"+
+		"    source: record\n"))
+	require.NoError(t, err)
+	require.Equal(t, "record", conf.Paths["cam1"].Source)
+	require.Equal(t, "record", conf.Paths["cam2"].Source)
+
+	_, err = loadConf("stdin", strings.NewReader("paths:\n"+
+		"  cam:\n"+
+		"    source: publish\n"))
+	require.True(t, errors.Is(err, errConfInvalidSourceUrl))
+	require.Contains(t, err.Error(), "'publisher'")
+}
+
+func TestConfEnv(t *testing.T) {
+	conf := &conf{}
+	err := yaml.Unmarshal([]byte("rtspPort: 8555\n"+
+		"paths:\n"+
+		"  Cam_1:\n"+
+		"    source: rtsp://original/stream\n"), conf)
+	require.NoError(t, err)
+
+	err = loadConfEnv(conf, []string{
+		"RTSP_RTSPPORT=8556",
+		"RTSP_PROTOCOLS=[tcp]",
+		"RTSP_READTIMEOUT=20s",
+		"RTSP_PATHS_CAM_1_SOURCEPROTOCOL=tcp",
+		"RTSP_PATHS_OTHER_SOURCE=rtsp://other/stream",
+		"RTSP_UNKNOWN=value",
+		"OTHER_RTSPPORT=8557",
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 8556, conf.RtspPort)
+	require.Equal(t, []string{"tcp"}, conf.Protocols)
+	require.Equal(t, 20*time.Second, conf.ReadTimeout)
+	require.Equal(t, "rtsp://original/stream", conf.Paths["Cam_1"].Source)
+	require.Equal(t, "tcp", conf.Paths["Cam_1"].SourceProtocol)
+	require.Equal(t, "rtsp://other/stream", conf.Paths["other"].Source)
+
+	err = loadConfEnv(conf, []string{"RTSP_RTSPPORT=abc"})
+	require.True(t, errors.Is(err, errConfInvalid))
+}
+
+func TestSetupUdpPortsInUse(t *testing.T) {
+	p, err := newProgram([]string{}, bytes.NewBuffer(nil))
+	require.NoError(t, err)
+	defer p.close()
+
+	time.Sleep(1 * time.Second)
+
+	sdpText := "v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=Stream\r\n" +
+		"c=IN IP4 127.0.0.1\r\n" +
+		"t=0 0\r\n" +
+		"m=video 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H264/90000\r\n"
+
+	setup := func(nconn net.Conn, path string) *gortsplib.Response {
+		conn := gortsplib.NewConnClient(gortsplib.ConnClientConf{Conn: nconn})
+
+		u, err := url.Parse("rtsp://localhost:8554/" + path)
+		require.NoError(t, err)
+
+		res, err := conn.Do(&gortsplib.Request{
+			Method: gortsplib.ANNOUNCE,
+			Url:    u,
+			Header: gortsplib.Header{
+				"Content-Type":   []string{"application/sdp"},
+				"Content-Length": []string{strconv.FormatInt(int64(len(sdpText)), 10)},
+			},
+			Content: []byte(sdpText),
+		})
+		require.NoError(t, err)
+		require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+		tu, err := url.Parse("rtsp://localhost:8554/" + path + "/trackID=0")
+		require.NoError(t, err)
+
+		res, err = conn.Do(&gortsplib.Request{
+			Method: gortsplib.SETUP,
+			Url:    tu,
+			Header: gortsplib.Header{
+				"Transport": []string{"RTP/AVP;unicast;client_port=35466-35467;mode=record"},
+			},
+		})
+		require.NoError(t, err)
+		return res
+	}
+
+	nconn1, err := net.Dial("tcp", "localhost:8554")
+	require.NoError(t, err)
+	defer nconn1.Close()
+	require.Equal(t, gortsplib.StatusOK, setup(nconn1, "first").StatusCode)
+
+	// a second session with the same IP and ports would receive the packets
+	// of the first one
+	nconn2, err := net.Dial("tcp", "localhost:8554")
+	require.NoError(t, err)
+	defer nconn2.Close()
+	require.Equal(t, gortsplib.StatusBadRequest, setup(nconn2, "second").StatusCode)
+}
+
+func TestRequestHeaderSize(t *testing.T) {
+	p, err := newProgram([]string{}, bytes.NewBuffer(nil))
+	require.NoError(t, err)
+	defer p.close()
+
+	time.Sleep(1 * time.Second)
+
+	sdpText := "v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=" + strings.Repeat("a", 3000) + "\r\n" +
+		"c=IN IP4 127.0.0.1\r\n" +
+		"t=0 0\r\n" +
+		"m=video 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H264/90000\r\n"
+
+	nconn, err := net.Dial("tcp", "localhost:8554")
+	require.NoError(t, err)
+	defer nconn.Close()
+	conn := gortsplib.NewConnClient(gortsplib.ConnClientConf{Conn: nconn})
+
+	u, err := url.Parse("rtsp://localhost:8554/teststream")
+	require.NoError(t, err)
+
+	// bodies are not subject to the limit
+	res, err := conn.Do(&gortsplib.Request{
+		Method: gortsplib.ANNOUNCE,
+		Url:    u,
+		Header: gortsplib.Header{
+			"Content-Type":   []string{"application/sdp"},
+			"Content-Length": []string{strconv.FormatInt(int64(len(sdpText)), 10)},
+		},
+		Content: []byte(sdpText),
+	})
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+	header := gortsplib.Header{}
+	for i := 0; i < 8; i++ {
+		header["X-Header-"+strconv.FormatInt(int64(i), 10)] = []string{strings.Repeat("a", 800)}
+	}
+
+	_, err = conn.Do(&gortsplib.Request{
+		Method: gortsplib.OPTIONS,
+		Url:    u,
+		Header: header,
+	})
+	require.Error(t, err)
+}
+
+func TestErrorStatusCode(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		err  error
+		code gortsplib.StatusCode
+	}{
+		{"generic", fmt.Errorf("generic"), gortsplib.StatusBadRequest},
+		{"draining", errPathDraining, gortsplib.StatusServiceUnavailable},
+		{"auth", errAuthCritical, gortsplib.StatusUnauthorized},
+		{"not found", errorWithStatus(gortsplib.StatusNotFound, "no one is streaming on path '%s'", "test"), gortsplib.StatusNotFound},
+		{"state", errorWithStatus(gortsplib.StatusMethodNotValidInThisState, "not all tracks have been setup"), gortsplib.StatusMethodNotValidInThisState},
+		{"transport", errorWithStatus(gortsplib.StatusUnsupportedTransport, "UDP is disabled"), gortsplib.StatusUnsupportedTransport},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			require.Equal(t, ca.code, errorStatusCode(ca.err))
+		})
+	}
+}
 
-			time.Sleep(1 * time.Second)
+func TestStatusCodes(t *testing.T) {
+	p, err := newProgram([]string{}, bytes.NewBuffer(nil))
+	require.NoError(t, err)
+	defer p.close()
 
-			cnt1, err := newContainer("ffmpeg", "source", []string{
-				"-hide_banner",
-				"-loglevel", "panic",
-				"-re",
-				"-stream_loop", "-1",
-				"-i", "/emptyvideo.ts",
-				"-c", "copy",
-				"-f", "rtsp",
-				"-rtsp_transport", conf[0],
-				"rtsp://" + ownDockerIp + ":8554/teststream",
-			})
-			require.NoError(t, err)
-			defer cnt1.close()
+	time.Sleep(1 * time.Second)
 
-			time.Sleep(1 * time.Second)
+	do := func(conn *gortsplib.ConnClient, method gortsplib.Method, path string, header gortsplib.Header) gortsplib.StatusCode {
+		u, err := url.Parse("rtsp://localhost:8554/" + path)
+		require.NoError(t, err)
+		res, err := conn.Do(&gortsplib.Request{Method: method, Url: u, Header: header})
+		require.NoError(t, err)
+		return res.StatusCode
+	}
 
-			if conf[2] == "ffmpeg" {
-				cnt2, err := newContainer("ffmpeg", "dest", []string{
-					"-hide_banner",
-					"-loglevel", "panic",
-					"-rtsp_transport", conf[1],
-					"-i", "rtsp://" + ownDockerIp + ":8554/teststream",
-					"-vframes", "1",
-					"-f", "image2",
-					"-y", "/dev/null",
-				})
-				require.NoError(t, err)
-				defer cnt2.close()
+	t.Run("not found", func(t *testing.T) {
+		nconn, err := net.Dial("tcp", "localhost:8554")
+		require.NoError(t, err)
+		defer nconn.Close()
+		conn := gortsplib.NewConnClient(gortsplib.ConnClientConf{Conn: nconn})
 
-				code := cnt2.wait()
-				require.Equal(t, 0, code)
+		require.Equal(t, gortsplib.StatusNotFound, do(conn, gortsplib.SETUP, "teststream/trackID=0", gortsplib.Header{
+			"Transport": []string{"RTP/AVP/TCP;unicast;interleaved=0-1"},
+		}))
+	})
+
+	t.Run("invalid state", func(t *testing.T) {
+		nconn, err := net.Dial("tcp", "localhost:8554")
+		require.NoError(t, err)
+		defer nconn.Close()
+		conn := gortsplib.NewConnClient(gortsplib.ConnClientConf{Conn: nconn})
+
+		require.Equal(t, gortsplib.StatusMethodNotValidInThisState, do(conn, gortsplib.PLAY, "teststream", nil))
+	})
+
+	t.Run("session not found", func(t *testing.T) {
+		nconn, err := net.Dial("tcp", "localhost:8554")
+		require.NoError(t, err)
+		defer nconn.Close()
+		conn := gortsplib.NewConnClient(gortsplib.ConnClientConf{Conn: nconn})
+
+		require.Equal(t, gortsplib.StatusSessionNotFound, do(conn, gortsplib.PLAY, "teststream", gortsplib.Header{
+			"Session": []string{"abcdef"},
+		}))
+	})
+
+	t.Run("scale", func(t *testing.T) {
+		nconn, err := net.Dial("tcp", "localhost:8554")
+		require.NoError(t, err)
+		defer nconn.Close()
+		conn := gortsplib.NewConnClient(gortsplib.ConnClientConf{Conn: nconn})
+
+		// the session is kept
+		require.Equal(t, gortsplib.StatusHeaderFieldNotValidForResource, do(conn, gortsplib.PLAY, "teststream", gortsplib.Header{
+			"Scale": []string{"2.0"},
+		}))
+		require.Equal(t, gortsplib.StatusOK, do(conn, gortsplib.OPTIONS, "teststream", nil))
+	})
+
+	t.Run("not implemented", func(t *testing.T) {
+		nconn, err := net.Dial("tcp", "localhost:8554")
+		require.NoError(t, err)
+		defer nconn.Close()
+		conn := gortsplib.NewConnClient(gortsplib.ConnClientConf{Conn: nconn})
+
+		// the session is kept
+		require.Equal(t, gortsplib.StatusNotImplemented, do(conn, gortsplib.Method("FOO"), "teststream", nil))
+		require.Equal(t, gortsplib.StatusOK, do(conn, gortsplib.OPTIONS, "teststream", nil))
+	})
+}
+
+func TestTeardown(t *testing.T) {
+	p, err := newProgram([]string{}, bytes.NewBuffer(nil))
+	require.NoError(t, err)
+	defer p.close()
+
+	time.Sleep(1 * time.Second)
+
+	sdpText := "v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=Stream\r\n" +
+		"c=IN IP4 127.0.0.1\r\n" +
+		"t=0 0\r\n" +
+		"m=video 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H264/90000\r\n"
+
+	dial := func() (net.Conn, *gortsplib.ConnClient) {
+		nconn, err := net.Dial("tcp", "localhost:8554")
+		require.NoError(t, err)
+		return nconn, gortsplib.NewConnClient(gortsplib.ConnClientConf{Conn: nconn})
+	}
+
+	do := func(conn *gortsplib.ConnClient, method gortsplib.Method, path string, header gortsplib.Header, content []byte) {
+		u, err := url.Parse("rtsp://localhost:8554/" + path)
+		require.NoError(t, err)
+		res, err := conn.Do(&gortsplib.Request{Method: method, Url: u, Header: header, Content: content})
+		require.NoError(t, err)
+		require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+	}
+
+	announce := func(conn *gortsplib.ConnClient, path string) {
+		do(conn, gortsplib.ANNOUNCE, path, gortsplib.Header{
+			"Content-Type":   []string{"application/sdp"},
+			"Content-Length": []string{strconv.FormatInt(int64(len(sdpText)), 10)},
+		}, []byte(sdpText))
+	}
+
+	setupRecord := func(conn *gortsplib.ConnClient, path string) {
+		do(conn, gortsplib.SETUP, path+"/trackID=0", gortsplib.Header{
+			"Transport": []string{"RTP/AVP/TCP;unicast;interleaved=0-1;mode=record"},
+		}, nil)
+	}
+
+	setupPlay := func(conn *gortsplib.ConnClient, path string) {
+		do(conn, gortsplib.SETUP, path+"/trackID=0", gortsplib.Header{
+			"Transport": []string{"RTP/AVP/TCP;unicast;interleaved=0-1"},
+		}, nil)
+	}
+
+	waitCount := func(counter *int64, v int64) {
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt64(counter) == v
+		}, 2*time.Second, 10*time.Millisecond)
+	}
+
+	// the server answers and then closes the connection
+	teardown := func(nconn net.Conn, conn *gortsplib.ConnClient, path string) {
+		do(conn, gortsplib.TEARDOWN, path, nil, nil)
+		nconn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err := nconn.Read(make([]byte, 1))
+		require.Equal(t, io.EOF, err)
+		nconn.Close()
+	}
+
+	// publisher of the path that is read
+	pubNconn, pubConn := dial()
+	defer pubNconn.Close()
+	announce(pubConn, "teststream")
+	setupRecord(pubConn, "teststream")
+	do(pubConn, gortsplib.RECORD, "teststream", nil, nil)
+
+	t.Run("starting", func(t *testing.T) {
+		nconn, conn := dial()
+		do(conn, gortsplib.OPTIONS, "teststream", nil, nil)
+		teardown(nconn, conn, "teststream")
+	})
+
+	t.Run("pre play", func(t *testing.T) {
+		nconn, conn := dial()
+		do(conn, gortsplib.DESCRIBE, "teststream", nil, nil)
+		setupPlay(conn, "teststream")
+		teardown(nconn, conn, "teststream")
+	})
+
+	t.Run("play", func(t *testing.T) {
+		nconn, conn := dial()
+		do(conn, gortsplib.DESCRIBE, "teststream", nil, nil)
+		setupPlay(conn, "teststream")
+		do(conn, gortsplib.PLAY, "teststream", nil, nil)
+		waitCount(&p.stats.receiverCount, 1)
+
+		teardown(nconn, conn, "teststream")
+		waitCount(&p.stats.receiverCount, 0)
+	})
+
+	t.Run("pre record", func(t *testing.T) {
+		nconn, conn := dial()
+		announce(conn, "teststream2")
+		setupRecord(conn, "teststream2")
+		teardown(nconn, conn, "teststream2")
+	})
+
+	t.Run("record", func(t *testing.T) {
+		nconn, conn := dial()
+		announce(conn, "teststream2")
+		setupRecord(conn, "teststream2")
+		do(conn, gortsplib.RECORD, "teststream2", nil, nil)
+		waitCount(&p.stats.publisherCount, 2)
+
+		teardown(nconn, conn, "teststream2")
+		waitCount(&p.stats.publisherCount, 1)
+
+		// the path can be published again
+		nconn, conn = dial()
+		defer nconn.Close()
+		announce(conn, "teststream2")
+	})
+}
+
+func TestReadSetupTrackId(t *testing.T) {
+	for _, ca := range []struct {
+		urlPath string
+		path    string
+		id      int
+	}{
+		{"/teststream/trackID=1", "teststream", 1},
+		{"/teststream/trackID=0/", "teststream", 0},
+		{"/cam/main/trackID=2", "cam/main", 2},
+		{"/teststream", "teststream", -1},
+		{"/teststream/trackID=abc", "teststream", -1},
+	} {
+		require.Equal(t, ca.id, readSetupTrackId(ca.urlPath, ca.path), ca.urlPath)
+	}
+}
+
+func TestPathPatterns(t *testing.T) {
+	confText := "paths:\n" +
+		"  site/*/cam:\n" +
+		"  ~^cam[0-9]+$:\n"
+
+	conf, err := loadConf("stdin", strings.NewReader(confText))
+	require.NoError(t, err)
+	require.Equal(t, conf.Paths["site/*/cam"], conf.findConfForPath("site/a/cam"))
+	require.Equal(t, conf.Paths["~^cam[0-9]+$"], conf.findConfForPath("cam12"))
+	require.Nil(t, conf.findConfForPath("site/a/b/cam"))
+	require.Nil(t, conf.findConfForPath("site"))
+
+	p, err := newProgram([]string{"stdin"}, bytes.NewBuffer([]byte(confText)))
+	require.NoError(t, err)
+	defer p.close()
+
+	status := func(method gortsplib.Method, path string) gortsplib.StatusCode {
+		nconn, conn := testDial(t)
+		defer nconn.Close()
+		u, err := url.Parse("rtsp://127.0.0.1:8554/" + path)
+		require.NoError(t, err)
+		res, err := conn.Do(&gortsplib.Request{
+			Method: method,
+			Url:    u,
+			Header: gortsplib.Header{
+				"Content-Type":   []string{"application/sdp"},
+				"Content-Length": []string{strconv.FormatInt(int64(len(testSdp)), 10)},
+			},
+			Content: []byte(testSdp),
+		})
+		require.NoError(t, err)
+		return res.StatusCode
+	}
+
+	for _, path := range []string{"site/a/cam", "cam1"} {
+		t.Run(path, func(t *testing.T) {
+			pnconn, pconn := testDial(t)
+			defer pnconn.Close()
+			testPublish(t, pconn, path, testSdp)
+
+			rnconn, rconn := testDial(t)
+			defer rnconn.Close()
+			testPlayTcp(t, rconn, path)
+			testReadRtp(t, rconn)
+		})
+	}
+
+	// paths matched by the same pattern are distinct
+	require.Equal(t, gortsplib.StatusOK, status(gortsplib.ANNOUNCE, "site/b/cam"))
+	require.Equal(t, gortsplib.StatusNotFound, status(gortsplib.DESCRIBE, "site/c/cam"))
+
+	require.NotEqual(t, gortsplib.StatusOK, status(gortsplib.ANNOUNCE, "site/a/b/cam"))
+	require.NotEqual(t, gortsplib.StatusOK, status(gortsplib.DESCRIBE, "site/a/other"))
+	require.NotEqual(t, gortsplib.StatusOK, status(gortsplib.ANNOUNCE, "camera"))
+}
 
+func TestCheckReadToken(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	valid := "1600003600-" + readTokenSignature("secret", "cam", 1600003600)
+
+	for _, ca := range []struct {
+		name  string
+		path  string
+		token string
+		err   string
+	}{
+		{"valid", "cam", valid, ""},
+		{"other path", "cam2", valid, "invalid token signature"},
+		{"wrong secret", "cam", "1600003600-" + readTokenSignature("other", "cam", 1600003600), "invalid token signature"},
+		{"changed expiry", "cam", "1600007200-" + readTokenSignature("secret", "cam", 1600003600), "invalid token signature"},
+		{"expired", "cam", "1599999999-" + readTokenSignature("secret", "cam", 1599999999), "token has expired"},
+		{"malformed", "cam", "abcdef", "invalid token"},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			err := checkReadToken("secret", ca.path, ca.token, now)
+			if ca.err == "" {
+				require.NoError(t, err)
 			} else {
-				args := []string{}
-				if conf[1] == "tcp" {
-					args = append(args, "--rtsp-tcp")
+				require.EqualError(t, err, ca.err)
+			}
+		})
+	}
+}
+
+func TestSourceTlsMinVersion(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{SerialNumber: big.NewInt(1)}, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	for _, ca := range []struct {
+		name          string
+		minVersion    string
+		serverVersion uint16
+		ok            bool
+	}{
+		{"default tls 1.0", "", tls.VersionTLS10, false},
+		{"default tls 1.1", "", tls.VersionTLS11, false},
+		{"default tls 1.2", "", tls.VersionTLS12, true},
+		{"1.0 tls 1.0", "1.0", tls.VersionTLS10, true},
+		{"1.3 tls 1.2", "1.3", tls.VersionTLS12, false},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			confText := ""
+			if ca.minVersion != "" {
+				confText = "tlsMinVersion: \"" + ca.minVersion + "\"\n"
+			}
+			conf, err := loadConf("stdin", strings.NewReader(confText))
+			require.NoError(t, err)
+
+			l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   ca.serverVersion,
+				MaxVersion:   ca.serverVersion,
+			})
+			require.NoError(t, err)
+			defer l.Close()
+
+			go func() {
+				nconn, err := l.Accept()
+				if err != nil {
+					return
 				}
-				args = append(args, "rtsp://"+ownDockerIp+":8554/teststream")
+				nconn.(*tls.Conn).Handshake()
+				nconn.Close()
+			}()
 
-				cnt2, err := newContainer("vlc", "dest", args)
+			nconn, err := tls.Dial("tcp", l.Addr().String(),
+				sourceTlsConfig("127.0.0.1", nil, true, conf.tlsMinVersionParsed))
+			if ca.ok {
 				require.NoError(t, err)
-				defer cnt2.close()
-
-				code := cnt2.wait()
-				require.Equal(t, 0, code)
+				nconn.Close()
+			} else {
+				require.Error(t, err)
 			}
 		})
 	}
 }
 
+func TestSdpForServerHevc(t *testing.T) {
+	sdpText := "v=0\r\n" +
+		"o=- 0 0 IN IP4 192.168.1.10\r\n" +
+		"s=Camera\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"t=0 0\r\n" +
+		"m=video 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H265/90000\r\n" +
+		"a=fmtp:96 sprop-vps=QAEMAf//AWAAAAMAkAAAAwAAAwB4mZgJ; sprop-sps=QgEBAWAAAAMAkAAAAwAAAwB4oAPAgBDlmZpJMrwFAgAAAwACAAADADIQ; sprop-pps=RAHA8vA8kAA=\r\n" +
+		"a=control:track1\r\n" +
+		"m=audio 0 RTP/AVP 97\r\n" +
+		"a=rtpmap:97 MPEG4-GENERIC/16000/1\r\n" +
+		"a=fmtp:97 streamtype=5; profile-level-id=15; mode=AAC-hbr; config=1408; sizeLength=13; indexLength=3; indexDeltaLength=3\r\n" +
+		"a=control:track2\r\n"
+
+	sin := &sdp.SessionDescription{}
+	err := sin.Unmarshal(sdpText)
+	require.NoError(t, err)
+
+	sout, _ := sdpForServer(sin)
+	require.Equal(t, 2, len(sout.MediaDescriptions))
+
+	// payload types, rtpmap and fmtp must be preserved regardless of the codec
+	for i, min := range sin.MediaDescriptions {
+		mout := sout.MediaDescriptions[i]
+		require.Equal(t, min.MediaName.Formats, mout.MediaName.Formats)
+
+		for _, key := range []string{"rtpmap", "fmtp"} {
+			vin, _ := min.Attribute(key)
+			vout, _ := mout.Attribute(key)
+			require.Equal(t, vin, vout)
+		}
+
+		control, _ := mout.Attribute("control")
+		require.Equal(t, fmt.Sprintf("trackID=%d", i), control)
+	}
+}
+
+// MJPEG uses a static payload type, without rtpmap
+const testSdpMjpeg = "v=0\r\n" +
+	"o=- 0 0 IN IP4 192.168.1.20\r\n" +
+	"s=Camera\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"t=0 0\r\n" +
+	"m=video 0 RTP/AVP 26\r\n" +
+	"a=control:track1\r\n"
+
+func TestSdpForServerMjpeg(t *testing.T) {
+	sin := &sdp.SessionDescription{}
+	err := sin.Unmarshal(testSdpMjpeg)
+	require.NoError(t, err)
+
+	sout, _ := sdpForServer(sin)
+	require.Equal(t, 1, len(sout.MediaDescriptions))
+	require.Equal(t, "video", sout.MediaDescriptions[0].MediaName.Media)
+	require.Equal(t, []string{"26"}, sout.MediaDescriptions[0].MediaName.Formats)
+
+	control, _ := sout.MediaDescriptions[0].Attribute("control")
+	require.Equal(t, "trackID=0", control)
+}
+
+func TestKeyframeBuffer(t *testing.T) {
+	sin := &sdp.SessionDescription{}
+	err := sin.Unmarshal("v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=Stream\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"t=0 0\r\n" +
+		"m=video 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H264/90000\r\n")
+	require.NoError(t, err)
+
+	kb := newKeyframeBuffer(sin.MediaDescriptions[0])
+	require.NotNil(t, kb)
+
+	seq := uint16(0)
+	pkt := func(ts uint32, marker bool, payload []byte) []byte {
+		seq++
+		buf := make([]byte, 12+len(payload))
+		buf[0] = 0x80
+		buf[1] = 96
+		if marker {
+			buf[1] |= 0x80
+		}
+		binary.BigEndian.PutUint16(buf[2:4], seq)
+		binary.BigEndian.PutUint32(buf[4:8], ts)
+		copy(buf[12:], payload)
+		return buf
+	}
+
+	sps := []byte{0x67, 0x01, 0x02}
+	pps := []byte{0x68, 0x03}
+
+	// SPS and PPS in a STAP-A, IDR in a FU-A
+	kb.onRtp(pkt(1000, false, []byte{0x18, 0x00, 0x03, 0x67, 0x01, 0x02, 0x00, 0x02, 0x68, 0x03}))
+	kb.onRtp(pkt(1000, false, []byte{0x7c, 0x85, 0xaa, 0xbb}))
+	require.Nil(t, kb.keyframe())
+	kb.onRtp(pkt(1000, true, []byte{0x7c, 0x45, 0xcc}))
+
+	annexB := func(nalus ...[]byte) []byte {
+		var ret []byte
+		for _, nalu := range nalus {
+			ret = append(append(ret, 0, 0, 0, 1), nalu...)
+		}
+		return ret
+	}
+
+	expected := annexB(sps, pps, []byte{0x65, 0xaa, 0xbb, 0xcc})
+	require.Equal(t, expected, kb.keyframe())
+
+	// non-IDR frames don't replace the keyframe
+	kb.onRtp(pkt(4000, true, []byte{0x41, 0x01}))
+	require.Equal(t, expected, kb.keyframe())
+
+	// keyframes with lost packets are discarded
+	kb.onRtp(pkt(7000, false, []byte{0x7c, 0x85, 0xdd}))
+	seq++
+	kb.onRtp(pkt(7000, true, []byte{0x7c, 0x45, 0xee}))
+	require.Equal(t, expected, kb.keyframe())
+
+	// single NAL unit IDR
+	kb.onRtp(pkt(10000, true, []byte{0x65, 0x11}))
+	require.Equal(t, annexB(sps, pps, []byte{0x65, 0x11}), kb.keyframe())
+}
+
+func TestTimestampRewriter(t *testing.T) {
+	start := time.Now()
+	tr := newTimestampRewriter(90000, start)
+
+	pkt := func(ts uint32) []byte {
+		buf := make([]byte, 12)
+		buf[0] = 0x80
+		buf[1] = 96
+		binary.BigEndian.PutUint32(buf[4:8], ts)
+		return buf
+	}
+	outTs := func(frame []byte) uint32 {
+		return binary.BigEndian.Uint32(frame[4:8])
+	}
+	sr := func(ts uint32) []byte {
+		byts, err := rtcp.Marshal([]rtcp.Packet{&rtcp.SenderReport{SSRC: 1, RTPTime: ts}})
+		require.NoError(t, err)
+		return byts
+	}
+
+	// sender reports are dropped until the offset is known
+	require.Nil(t, tr.rewriteRtcp(sr(1000)))
+
+	// the first timestamp is mapped to the clock of the server
+	now := start.Add(10 * time.Second)
+	require.Equal(t, uint32(900000), outTs(tr.rewriteRtp(pkt(1000), now)))
+
+	// differences are preserved
+	now = now.Add(40 * time.Millisecond)
+	require.Equal(t, uint32(903600), outTs(tr.rewriteRtp(pkt(4600), now)))
+
+	pkts, err := rtcp.Unmarshal(tr.rewriteRtcp(sr(4600)))
+	require.NoError(t, err)
+	require.Equal(t, uint32(903600), pkts[0].(*rtcp.SenderReport).RTPTime)
+
+	// discontinuities are mapped again to the clock of the server
+	now = now.Add(40 * time.Millisecond)
+	require.Equal(t, uint32(907200), outTs(tr.rewriteRtp(pkt(500000000), now)))
+}
+
+func TestRelayMjpeg(t *testing.T) {
+	p, err := newProgram([]string{}, bytes.NewBuffer(nil))
+	require.NoError(t, err)
+	defer p.close()
+
+	time.Sleep(1 * time.Second)
+
+	u, err := url.Parse("rtsp://localhost:8554/mjpeg")
+	require.NoError(t, err)
+
+	tu, err := url.Parse("rtsp://localhost:8554/mjpeg/trackID=0")
+	require.NoError(t, err)
+
+	nconn1, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn1.Close()
+	conn1 := gortsplib.NewConnClient(gortsplib.ConnClientConf{Conn: nconn1})
+
+	res, err := conn1.Do(&gortsplib.Request{
+		Method: gortsplib.ANNOUNCE,
+		Url:    u,
+		Header: gortsplib.Header{
+			"Content-Type":   []string{"application/sdp"},
+			"Content-Length": []string{fmt.Sprintf("%d", len(testSdpMjpeg))},
+		},
+		Content: []byte(testSdpMjpeg),
+	})
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+	res, err = conn1.Do(&gortsplib.Request{
+		Method: gortsplib.SETUP,
+		Url:    tu,
+		Header: gortsplib.Header{
+			"Transport": []string{"RTP/AVP/TCP;unicast;interleaved=0-1;mode=record"},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+	res, err = conn1.Do(&gortsplib.Request{
+		Method: gortsplib.RECORD,
+		Url:    u,
+	})
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+	nconn2, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn2.Close()
+	conn2 := gortsplib.NewConnClient(gortsplib.ConnClientConf{Conn: nconn2})
+
+	res, err = conn2.Do(&gortsplib.Request{
+		Method: gortsplib.DESCRIBE,
+		Url:    u,
+	})
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+	require.Contains(t, string(res.Content), "m=video 0 RTP/AVP 26\r\n")
+
+	res, err = conn2.Do(&gortsplib.Request{
+		Method: gortsplib.SETUP,
+		Url:    tu,
+		Header: gortsplib.Header{
+			"Transport": []string{"RTP/AVP/TCP;unicast;interleaved=0-1"},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+	res, err = conn2.Do(&gortsplib.Request{
+		Method: gortsplib.PLAY,
+		Url:    u,
+	})
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StatusOK, res.StatusCode)
+
+	// RTP header (PT 26, marker set), RFC 2435 JPEG header
+	// (type 1, Q 80, 640x480) and the beginning of the scan data
+	pkt := []byte{
+		0x80, 0x9a, 0x00, 0x01, 0x00, 0x00, 0x0b, 0xb8, 0x12, 0x34, 0x56, 0x78,
+		0x00, 0x00, 0x00, 0x00, 0x01, 0x50, 0x50, 0x3c,
+		0xfa, 0x28, 0xa2, 0x8a, 0x00, 0x28, 0xa2, 0x8a,
+	}
+
+	// the reader may need some time to start receiving
+	for i := 0; i < 5; i++ {
+		err = conn1.WriteFrame(&gortsplib.InterleavedFrame{
+			TrackId:    0,
+			StreamType: gortsplib.StreamTypeRtp,
+			Content:    pkt,
+		})
+		require.NoError(t, err)
+	}
+
+	frame := &gortsplib.InterleavedFrame{Content: make([]byte, 2048)}
+	err = conn2.ReadFrame(frame)
+	require.NoError(t, err)
+	require.Equal(t, gortsplib.StreamTypeRtp, frame.StreamType)
+	require.Equal(t, pkt, frame.Content)
+}
+
 func TestAuth(t *testing.T) {
 	t.Run("publish", func(t *testing.T) {
 		stdin := []byte("\n" +
@@ -331,3 +2337,128 @@ func TestProxy(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkStats(b *testing.B) {
+	p, err := newProgram([]string{}, bytes.NewBuffer(nil))
+	require.NoError(b, err)
+	defer p.close()
+
+	// stats are read without passing through the event loop, therefore
+	// reads don't compete with frame forwarding
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p.stats.get()
+		}
+	})
+}
+
+// BenchmarkFrameLatency measures the time needed by a publisher to hand a
+// frame over to the program, while the program is busy with other events
+func BenchmarkFrameLatency(b *testing.B) {
+	p, err := newProgram([]string{}, bytes.NewBuffer(nil))
+	require.NoError(b, err)
+	defer p.close()
+
+	stop := make(chan struct{})
+	controlDone := make(chan struct{})
+	go func() {
+		defer close(controlDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			res := make(chan []string)
+			p.events <- programEventApiHealth{res}
+			<-res
+		}
+	}()
+
+	frame := make([]byte, 1200)
+	durations := make([]time.Duration, b.N)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		p.frames <- programEventClientFrameTcp{"mystream", 0, gortsplib.StreamTypeRtp, frameBuffers.copy(frame)}
+		durations[i] = time.Since(start)
+	}
+	b.StopTimer()
+
+	close(stop)
+	<-controlDone
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	b.ReportMetric(float64(durations[b.N/2].Nanoseconds()), "p50-ns/frame")
+	b.ReportMetric(float64(durations[b.N*99/100].Nanoseconds()), "p99-ns/frame")
+}
+
+func BenchmarkForwardFrame(b *testing.B) {
+	for _, readerCount := range []int{10, 200} {
+		for _, parallel := range []bool{false, true} {
+			b.Run(fmt.Sprintf("readers=%d/parallel=%v", readerCount, parallel), func(b *testing.B) {
+				defer func(v int) { forwardFrameParallelMin = v }(forwardFrameParallelMin)
+				if !parallel {
+					forwardFrameParallelMin = readerCount + 1
+				}
+
+				conf := &conf{}
+				err := conf.fill()
+				require.NoError(b, err)
+
+				p := &program{
+					conf:       conf,
+					clients:    make(map[*serverClient]struct{}),
+					readers:    make(map[string]map[*serverClient]struct{}),
+					mutedPaths: make(map[string]struct{}),
+					paramSets:  make(map[string][]*parameterSets),
+					keyframes:  make(map[string][]*keyframeBuffer),
+					pushers:    make(map[string]*pusher),
+					wsClients:  make(map[*serverWsClient]struct{}),
+				}
+
+				var wg sync.WaitGroup
+				for i := 0; i < readerCount; i++ {
+					c := &serverClient{
+						p:              p,
+						path:           "mypath",
+						state:          clientStatePlay,
+						streamProtocol: streamProtocolTcp,
+						streamTracks:   []*track{{}},
+						trackIndexes:   []int{0},
+						events:         make(chan serverClientEvent, conf.ReaderQueueSize),
+					}
+					p.clients[c] = struct{}{}
+					p.addReader(c)
+
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for rawEvt := range c.events {
+							frameBuffers.put(rawEvt.(serverClientEventFrameTcp).frame.Content)
+						}
+					}()
+				}
+
+				frame := make([]byte, 1400)
+				frame[0] = 0x80
+				frame[1] = 96
+
+				b.SetBytes(int64(len(frame) * readerCount))
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					p.forwardFrame("mypath", 0, gortsplib.StreamTypeRtp, frame)
+				}
+
+				b.StopTimer()
+				for c := range p.clients {
+					close(c.events)
+				}
+				wg.Wait()
+			})
+		}
+	}
+}
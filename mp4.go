@@ -0,0 +1,589 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// mp4Sample is a sample of a track of a MP4 file
+type mp4Sample struct {
+	offset int64
+	size   uint32
+	dts    int64 // in timescale units
+	cts    int32 // composition offset, in timescale units
+	sync   bool
+}
+
+// mp4Track is a H264 or AAC track of a MP4 file
+type mp4Track struct {
+	codec     string // avc1 or mp4a
+	timescale uint32
+	duration  int64 // in timescale units, sum of the sample durations
+	samples   []mp4Sample
+
+	// only if codec is avc1
+	nalLenSize int
+	sps        []byte
+	pps        []byte
+
+	// only if codec is mp4a
+	aacConfig  []byte // AudioSpecificConfig
+	sampleRate int
+	channels   int
+}
+
+// mp4File contains the tracks of a MP4 file that can be streamed, and the
+// codecs of the tracks that can't
+type mp4File struct {
+	tracks      []*mp4Track
+	unsupported []string
+}
+
+type mp4Box struct {
+	typ     string
+	content []byte
+}
+
+// mp4ReadBoxes splits a buffer into boxes
+func mp4ReadBoxes(b []byte) ([]mp4Box, error) {
+	var ret []mp4Box
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return nil, fmt.Errorf("truncated box")
+		}
+
+		size := uint64(binary.BigEndian.Uint32(b[0:4]))
+		typ := string(b[4:8])
+		hlen := uint64(8)
+
+		switch size {
+		case 0:
+			size = uint64(len(b))
+
+		case 1:
+			if len(b) < 16 {
+				return nil, fmt.Errorf("truncated box '%s'", typ)
+			}
+			size = binary.BigEndian.Uint64(b[8:16])
+			hlen = 16
+		}
+
+		if size < hlen || size > uint64(len(b)) {
+			return nil, fmt.Errorf("invalid size of box '%s'", typ)
+		}
+
+		ret = append(ret, mp4Box{typ, b[hlen:size]})
+		b = b[size:]
+	}
+	return ret, nil
+}
+
+func mp4FindBox(boxes []mp4Box, typ string) []byte {
+	for _, box := range boxes {
+		if box.typ == typ {
+			return box.content
+		}
+	}
+	return nil
+}
+
+// readMp4 reads the sample tables of a MP4 file. The file must not be
+// fragmented.
+func readMp4(fpath string) (*mp4File, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// find the moov box, that can be placed after the media data
+	var moov []byte
+	var pos int64
+	for moov == nil {
+		var header [16]byte
+		_, err := f.ReadAt(header[:8], pos)
+		if err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("moov box not found")
+			}
+			return nil, err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		typ := string(header[4:8])
+		hlen := int64(8)
+
+		switch size {
+		case 0:
+			st, err := f.Stat()
+			if err != nil {
+				return nil, err
+			}
+			size = st.Size() - pos
+
+		case 1:
+			_, err := f.ReadAt(header[8:16], pos+8)
+			if err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			hlen = 16
+		}
+
+		if size < hlen {
+			return nil, fmt.Errorf("invalid size of box '%s'", typ)
+		}
+
+		if typ == "moov" {
+			moov = make([]byte, size-hlen)
+			_, err := f.ReadAt(moov, pos+hlen)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		pos += size
+	}
+
+	boxes, err := mp4ReadBoxes(moov)
+	if err != nil {
+		return nil, err
+	}
+
+	if mp4FindBox(boxes, "mvex") != nil {
+		return nil, fmt.Errorf("fragmented MP4 files are not supported")
+	}
+
+	mf := &mp4File{}
+	for _, box := range boxes {
+		if box.typ != "trak" {
+			continue
+		}
+
+		track, codec, err := mp4ReadTrack(box.content)
+		if err != nil {
+			return nil, err
+		}
+		if track == nil {
+			mf.unsupported = append(mf.unsupported, codec)
+			continue
+		}
+
+		mf.tracks = append(mf.tracks, track)
+	}
+
+	if len(mf.tracks) == 0 {
+		return nil, fmt.Errorf("the file doesn't contain any H264 or AAC track")
+	}
+
+	return mf, nil
+}
+
+// mp4ReadTrack returns a nil track and the codec if the codec is not supported
+func mp4ReadTrack(trak []byte) (*mp4Track, string, error) {
+	trakBoxes, err := mp4ReadBoxes(trak)
+	if err != nil {
+		return nil, "", err
+	}
+
+	mdiaBoxes, err := mp4ReadBoxes(mp4FindBox(trakBoxes, "mdia"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	track := &mp4Track{}
+
+	mdhd := mp4FindBox(mdiaBoxes, "mdhd")
+	switch {
+	case len(mdhd) >= 24 && mdhd[0] == 0:
+		track.timescale = binary.BigEndian.Uint32(mdhd[12:16])
+
+	case len(mdhd) >= 36 && mdhd[0] == 1:
+		track.timescale = binary.BigEndian.Uint32(mdhd[20:24])
+
+	default:
+		return nil, "", fmt.Errorf("invalid mdhd box")
+	}
+	if track.timescale == 0 {
+		return nil, "", fmt.Errorf("invalid timescale")
+	}
+
+	minfBoxes, err := mp4ReadBoxes(mp4FindBox(mdiaBoxes, "minf"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	stblBoxes, err := mp4ReadBoxes(mp4FindBox(minfBoxes, "stbl"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	stsd := mp4FindBox(stblBoxes, "stsd")
+	if len(stsd) < 8 {
+		return nil, "", fmt.Errorf("invalid stsd box")
+	}
+	entries, err := mp4ReadBoxes(stsd[8:])
+	if err != nil {
+		return nil, "", err
+	}
+	if len(entries) == 0 {
+		return nil, "", fmt.Errorf("invalid stsd box")
+	}
+	entry := entries[0]
+
+	switch entry.typ {
+	case "avc1", "avc3":
+		err := track.readAvc1(entry.content)
+		if err != nil {
+			return nil, "", err
+		}
+
+	case "mp4a":
+		err := track.readMp4a(entry.content)
+		if err != nil {
+			return nil, "", err
+		}
+
+	default:
+		return nil, entry.typ, nil
+	}
+
+	err = track.readSamples(stblBoxes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return track, track.codec, nil
+}
+
+func (t *mp4Track) readAvc1(b []byte) error {
+	// skip the fields of the visual sample entry
+	if len(b) < 78 {
+		return fmt.Errorf("invalid avc1 box")
+	}
+	boxes, err := mp4ReadBoxes(b[78:])
+	if err != nil {
+		return err
+	}
+
+	avcc := mp4FindBox(boxes, "avcC")
+	if len(avcc) < 7 {
+		return fmt.Errorf("avcC box is missing")
+	}
+
+	t.codec = "avc1"
+	t.nalLenSize = int(avcc[4]&0x03) + 1
+
+	pos := 6
+	readParams := func(count int) ([]byte, error) {
+		var first []byte
+		for i := 0; i < count; i++ {
+			if len(avcc) < pos+2 {
+				return nil, fmt.Errorf("invalid avcC box")
+			}
+			l := int(binary.BigEndian.Uint16(avcc[pos:]))
+			pos += 2
+			if len(avcc) < pos+l {
+				return nil, fmt.Errorf("invalid avcC box")
+			}
+			if first == nil {
+				first = avcc[pos : pos+l]
+			}
+			pos += l
+		}
+		return first, nil
+	}
+
+	t.sps, err = readParams(int(avcc[5] & 0x1f))
+	if err != nil {
+		return err
+	}
+
+	if len(avcc) < pos+1 {
+		return fmt.Errorf("invalid avcC box")
+	}
+	count := int(avcc[pos])
+	pos++
+	t.pps, err = readParams(count)
+	if err != nil {
+		return err
+	}
+
+	if len(t.sps) < 4 || t.pps == nil {
+		return fmt.Errorf("SPS or PPS is missing")
+	}
+	return nil
+}
+
+func (t *mp4Track) readMp4a(b []byte) error {
+	// skip the fields of the audio sample entry
+	if len(b) < 28 {
+		return fmt.Errorf("invalid mp4a box")
+	}
+	entryChannels := int(binary.BigEndian.Uint16(b[16:18]))
+	boxes, err := mp4ReadBoxes(b[28:])
+	if err != nil {
+		return err
+	}
+
+	esds := mp4FindBox(boxes, "esds")
+	if len(esds) < 4 {
+		return fmt.Errorf("esds box is missing")
+	}
+
+	// read the descriptors, that are nested, until the decoder specific info
+	b = esds[4:]
+	readDescriptor := func() (byte, []byte, error) {
+		if len(b) < 2 {
+			return 0, nil, fmt.Errorf("invalid esds box")
+		}
+		tag := b[0]
+		l := 0
+		i := 1
+		for ; i <= 4; i++ {
+			if len(b) <= i {
+				return 0, nil, fmt.Errorf("invalid esds box")
+			}
+			l = l<<7 | int(b[i]&0x7f)
+			if b[i]&0x80 == 0 {
+				break
+			}
+		}
+		i++
+		if len(b) < i+l {
+			return 0, nil, fmt.Errorf("invalid esds box")
+		}
+		content := b[i : i+l]
+		b = b[i+l:]
+		return tag, content, nil
+	}
+
+	tag, content, err := readDescriptor()
+	if err != nil {
+		return err
+	}
+	if tag != 0x03 || len(content) < 3 {
+		return fmt.Errorf("invalid esds box")
+	}
+	flags := content[2]
+	b = content[3:]
+	if flags&0x80 != 0 {
+		if len(b) < 2 {
+			return fmt.Errorf("invalid esds box")
+		}
+		b = b[2:]
+	}
+	if flags&0x40 != 0 {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return fmt.Errorf("invalid esds box")
+		}
+		b = b[1+int(b[0]):]
+	}
+	if flags&0x20 != 0 {
+		if len(b) < 2 {
+			return fmt.Errorf("invalid esds box")
+		}
+		b = b[2:]
+	}
+
+	tag, content, err = readDescriptor()
+	if err != nil {
+		return err
+	}
+	if tag != 0x04 || len(content) < 13 {
+		return fmt.Errorf("invalid esds box")
+	}
+	if content[0] != 0x40 {
+		return fmt.Errorf("unsupported audio object type 0x%x", content[0])
+	}
+	b = content[13:]
+
+	tag, content, err = readDescriptor()
+	if err != nil {
+		return err
+	}
+	if tag != 0x05 || len(content) < 2 {
+		return fmt.Errorf("AudioSpecificConfig is missing")
+	}
+
+	t.codec = "mp4a"
+	t.aacConfig = content
+
+	// the sample rate and the channel count are read from the
+	// AudioSpecificConfig, since the ones of the sample entry are not
+	// reliable
+	sampleRates := []int{96000, 88200, 64000, 48000, 44100, 32000, 24000,
+		22050, 16000, 12000, 11025, 8000, 7350}
+	freqIndex := int(content[0]&0x07)<<1 | int(content[1]>>7)
+	switch {
+	case freqIndex < len(sampleRates):
+		t.sampleRate = sampleRates[freqIndex]
+		t.channels = int(content[1]>>3) & 0x0f
+
+	case freqIndex == 15:
+		if len(content) < 5 {
+			return fmt.Errorf("invalid AudioSpecificConfig")
+		}
+		t.sampleRate = int(content[1]&0x7f)<<17 | int(content[2])<<9 |
+			int(content[3])<<1 | int(content[4]>>7)
+		t.channels = int(content[4]>>3) & 0x0f
+
+	default:
+		return fmt.Errorf("invalid AudioSpecificConfig")
+	}
+	if t.channels == 0 {
+		t.channels = entryChannels
+	}
+
+	return nil
+}
+
+func (t *mp4Track) readSamples(stblBoxes []mp4Box) error {
+	// sizes
+	stsz := mp4FindBox(stblBoxes, "stsz")
+	if len(stsz) < 12 {
+		return fmt.Errorf("invalid stsz box")
+	}
+	fixedSize := binary.BigEndian.Uint32(stsz[4:8])
+	count := int(binary.BigEndian.Uint32(stsz[8:12]))
+	if fixedSize == 0 && len(stsz) < 12+count*4 {
+		return fmt.Errorf("invalid stsz box")
+	}
+	t.samples = make([]mp4Sample, count)
+	for i := range t.samples {
+		if fixedSize != 0 {
+			t.samples[i].size = fixedSize
+		} else {
+			t.samples[i].size = binary.BigEndian.Uint32(stsz[12+i*4:])
+		}
+	}
+
+	// chunk offsets
+	var chunkOffsets []int64
+	if stco := mp4FindBox(stblBoxes, "stco"); stco != nil {
+		if len(stco) < 8 {
+			return fmt.Errorf("invalid stco box")
+		}
+		n := int(binary.BigEndian.Uint32(stco[4:8]))
+		if len(stco) < 8+n*4 {
+			return fmt.Errorf("invalid stco box")
+		}
+		for i := 0; i < n; i++ {
+			chunkOffsets = append(chunkOffsets, int64(binary.BigEndian.Uint32(stco[8+i*4:])))
+		}
+	} else if co64 := mp4FindBox(stblBoxes, "co64"); co64 != nil {
+		if len(co64) < 8 {
+			return fmt.Errorf("invalid co64 box")
+		}
+		n := int(binary.BigEndian.Uint32(co64[4:8]))
+		if len(co64) < 8+n*8 {
+			return fmt.Errorf("invalid co64 box")
+		}
+		for i := 0; i < n; i++ {
+			chunkOffsets = append(chunkOffsets, int64(binary.BigEndian.Uint64(co64[8+i*8:])))
+		}
+	} else {
+		return fmt.Errorf("chunk offsets are missing")
+	}
+
+	// samples of each chunk
+	stsc := mp4FindBox(stblBoxes, "stsc")
+	if len(stsc) < 8 {
+		return fmt.Errorf("invalid stsc box")
+	}
+	n := int(binary.BigEndian.Uint32(stsc[4:8]))
+	if len(stsc) < 8+n*12 {
+		return fmt.Errorf("invalid stsc box")
+	}
+	sampleIdx := 0
+	for i := 0; i < n; i++ {
+		firstChunk := int(binary.BigEndian.Uint32(stsc[8+i*12:])) - 1
+		samplesPerChunk := int(binary.BigEndian.Uint32(stsc[8+i*12+4:]))
+		lastChunk := len(chunkOffsets) - 1
+		if i < n-1 {
+			lastChunk = int(binary.BigEndian.Uint32(stsc[8+(i+1)*12:])) - 2
+		}
+		if firstChunk < 0 || lastChunk >= len(chunkOffsets) {
+			return fmt.Errorf("invalid stsc box")
+		}
+
+		for chunk := firstChunk; chunk <= lastChunk; chunk++ {
+			offset := chunkOffsets[chunk]
+			for j := 0; j < samplesPerChunk && sampleIdx < count; j++ {
+				t.samples[sampleIdx].offset = offset
+				offset += int64(t.samples[sampleIdx].size)
+				sampleIdx++
+			}
+		}
+	}
+	if sampleIdx != count {
+		return fmt.Errorf("invalid stsc box")
+	}
+
+	// decoding times
+	stts := mp4FindBox(stblBoxes, "stts")
+	if len(stts) < 8 {
+		return fmt.Errorf("invalid stts box")
+	}
+	n = int(binary.BigEndian.Uint32(stts[4:8]))
+	if len(stts) < 8+n*8 {
+		return fmt.Errorf("invalid stts box")
+	}
+	sampleIdx = 0
+	var dts int64
+	for i := 0; i < n; i++ {
+		sampleCount := int(binary.BigEndian.Uint32(stts[8+i*8:]))
+		delta := int64(binary.BigEndian.Uint32(stts[8+i*8+4:]))
+		for j := 0; j < sampleCount && sampleIdx < count; j++ {
+			t.samples[sampleIdx].dts = dts
+			dts += delta
+			sampleIdx++
+		}
+	}
+	t.duration = dts
+
+	// composition offsets, optional
+	if ctts := mp4FindBox(stblBoxes, "ctts"); ctts != nil {
+		if len(ctts) < 8 {
+			return fmt.Errorf("invalid ctts box")
+		}
+		n = int(binary.BigEndian.Uint32(ctts[4:8]))
+		if len(ctts) < 8+n*8 {
+			return fmt.Errorf("invalid ctts box")
+		}
+		sampleIdx = 0
+		for i := 0; i < n; i++ {
+			sampleCount := int(binary.BigEndian.Uint32(ctts[8+i*8:]))
+			offset := int32(binary.BigEndian.Uint32(ctts[8+i*8+4:]))
+			for j := 0; j < sampleCount && sampleIdx < count; j++ {
+				t.samples[sampleIdx].cts = offset
+				sampleIdx++
+			}
+		}
+	}
+
+	// sync samples, optional. When missing, all samples are sync samples
+	if stss := mp4FindBox(stblBoxes, "stss"); stss != nil {
+		if len(stss) < 8 {
+			return fmt.Errorf("invalid stss box")
+		}
+		n = int(binary.BigEndian.Uint32(stss[4:8]))
+		if len(stss) < 8+n*4 {
+			return fmt.Errorf("invalid stss box")
+		}
+		for i := 0; i < n; i++ {
+			num := int(binary.BigEndian.Uint32(stss[8+i*4:]))
+			if num >= 1 && num <= count {
+				t.samples[num-1].sync = true
+			}
+		}
+	} else {
+		for i := range t.samples {
+			t.samples[i].sync = true
+		}
+	}
+
+	return nil
+}
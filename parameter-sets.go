@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+
+	"github.com/pion/sdp"
+)
+
+// parameterSets contains the last parameter sets of a H264 or H265 track of
+// a publisher, that are sent to readers before the first frame, in order to
+// allow decoders to start without waiting for the next ones.
+// The sets are initialized with the ones of the SDP, and are replaced by the
+// ones found inside the stream. It is owned by the program.
+type parameterSets struct {
+	h265 bool
+	sets [3][]byte // H264: SPS, PPS; H265: VPS, SPS, PPS
+}
+
+// newParameterSets returns nil if the media is not H264 or H265
+func newParameterSets(m *sdp.MediaDescription) *parameterSets {
+	ps := &parameterSets{}
+	fmtp := sdpMediaFmtp(m)
+
+	decode := func(v string) []byte {
+		byts, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(byts) == 0 {
+			return nil
+		}
+		return byts
+	}
+
+	switch sdpMediaEncoding(m) {
+	case "H264":
+		if v, ok := fmtp["sprop-parameter-sets"]; ok {
+			tmp := strings.Split(v, ",")
+			if len(tmp) >= 2 {
+				ps.sets[0] = decode(tmp[0])
+				ps.sets[1] = decode(tmp[1])
+			}
+		}
+
+	case "H265", "HEVC":
+		ps.h265 = true
+		ps.sets[0] = decode(fmtp["sprop-vps"])
+		ps.sets[1] = decode(fmtp["sprop-sps"])
+		ps.sets[2] = decode(fmtp["sprop-pps"])
+
+	default:
+		return nil
+	}
+
+	return ps
+}
+
+func (ps *parameterSets) store(nalu []byte) {
+	if len(nalu) == 0 {
+		return
+	}
+
+	i := -1
+	if ps.h265 {
+		switch (nalu[0] >> 1) & 0x3f {
+		case 32: // VPS
+			i = 0
+		case 33: // SPS
+			i = 1
+		case 34: // PPS
+			i = 2
+		}
+	} else {
+		switch nalu[0] & 0x1f {
+		case 7: // SPS
+			i = 0
+		case 8: // PPS
+			i = 1
+		}
+	}
+
+	if i >= 0 {
+		ps.sets[i] = append(ps.sets[i][:0], nalu...)
+	}
+}
+
+// onRtp stores the parameter sets contained in a RTP packet, as single NAL
+// units or aggregated. Fragmented parameter sets are ignored.
+func (ps *parameterSets) onRtp(frame []byte) {
+	payload := rtpPayload(frame)
+	if payload == nil {
+		return
+	}
+
+	// aggregation packets (STAP-A or AP) contain NAL units prefixed by their size
+	var aggregated []byte
+	if ps.h265 {
+		switch (payload[0] >> 1) & 0x3f {
+		case 48:
+			if len(payload) < 2 {
+				return
+			}
+			aggregated = payload[2:]
+		case 49: // FU
+			return
+		}
+	} else {
+		switch payload[0] & 0x1f {
+		case 24:
+			aggregated = payload[1:]
+		case 28: // FU-A
+			return
+		}
+	}
+
+	if aggregated == nil {
+		ps.store(payload)
+		return
+	}
+
+	for len(aggregated) >= 2 {
+		size := int(binary.BigEndian.Uint16(aggregated))
+		if size == 0 || len(aggregated) < 2+size {
+			return
+		}
+		ps.store(aggregated[2 : 2+size])
+		aggregated = aggregated[2+size:]
+	}
+}
+
+// packets returns RTP packets that contain the parameter sets, and that
+// precede the given packet, with which they share SSRC and timestamp
+func (ps *parameterSets) packets(frame []byte) [][]byte {
+	if len(frame) < 12 {
+		return nil
+	}
+
+	var sets [][]byte
+	for _, set := range ps.sets {
+		if set != nil {
+			sets = append(sets, set)
+		}
+	}
+
+	seq := binary.BigEndian.Uint16(frame[2:4]) - uint16(len(sets))
+
+	ret := make([][]byte, len(sets))
+	for i, set := range sets {
+		pkt := make([]byte, 12+len(set))
+		pkt[0] = 0x80
+		pkt[1] = frame[1] & 0x7f // marker is not set
+		binary.BigEndian.PutUint16(pkt[2:4], seq+uint16(i))
+		copy(pkt[4:12], frame[4:12])
+		copy(pkt[12:], set)
+		ret[i] = pkt
+	}
+	return ret
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	httppprof "net/http/pprof"
+)
+
+type pprof struct {
+	p        *program
+	listener net.Listener
+	server   *http.Server
+
+	done chan struct{}
+}
+
+func newPprof(p *program) (*pprof, error) {
+	listener, err := net.Listen("tcp", p.conf.PprofAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	pp := &pprof{
+		p:        p,
+		listener: listener,
+		done:     make(chan struct{}),
+	}
+
+	// handlers are registered into a dedicated mux, the default one is left
+	// untouched, since it may be used by the program that embeds the server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+
+	pp.server = &http.Server{
+		Handler: mux,
+	}
+
+	pp.log("opened on %s", listener.Addr())
+	return pp, nil
+}
+
+func (pp *pprof) log(format string, args ...interface{}) {
+	pp.p.log("[pprof] "+format, args...)
+}
+
+func (pp *pprof) run() {
+	err := pp.server.Serve(pp.listener)
+	if err != http.ErrServerClosed {
+		pp.log("ERR: %s", err)
+	}
+
+	close(pp.done)
+}
+
+func (pp *pprof) close() {
+	pp.server.Close()
+	<-pp.done
+}
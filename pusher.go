@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib"
+)
+
+type pusherFrame struct {
+	trackId    int
+	streamType gortsplib.StreamType
+	buf        []byte
+}
+
+// pusher publishes the stream of a path to another RTSP server, through
+// ANNOUNCE and RECORD, as long as the path has a ready publisher or source.
+// Frames are sent with the TCP transport.
+type pusher struct {
+	framesDropped uint64 // accessed atomically, must be the first field for 64-bit alignment
+	recording     int32  // accessed atomically, 1 when frames are accepted
+	p             *program
+	path          string
+	u             *url.URL
+	sdpText       []byte // SDP of the publisher of the path, nil if there's none
+
+	sdp       chan []byte // buffered, receives the SDP of the publisher when it changes
+	queue     chan pusherFrame
+	terminate chan struct{}
+	done      chan struct{}
+}
+
+func newPusher(p *program, path string, pconf *ConfPath) *pusher {
+	return &pusher{
+		p:         p,
+		path:      path,
+		u:         pconf.pushToParsed,
+		sdp:       make(chan []byte, 1),
+		queue:     make(chan pusherFrame, p.conf.ReaderQueueSize),
+		terminate: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (pu *pusher) log(format string, args ...interface{}) {
+	pu.p.log("[pusher "+pu.path+"] "+format, args...)
+}
+
+// setSdp is called by the program when a publisher of the path becomes ready
+// (sdpText is its SDP) or is gone (sdpText is nil). It never blocks; only the
+// last value is kept.
+func (pu *pusher) setSdp(sdpText []byte) {
+	select {
+	case <-pu.sdp:
+	default:
+	}
+	pu.sdp <- sdpText
+}
+
+// writeFrame is called by the program; the frame is copied, since its buffer
+// is reused, and dropped if the remote server is slower than the publisher.
+// It returns whether the frame has been queued
+func (pu *pusher) writeFrame(trackId int, streamType gortsplib.StreamType, frame []byte) bool {
+	if atomic.LoadInt32(&pu.recording) == 0 {
+		return false
+	}
+
+	buf := make([]byte, len(frame))
+	copy(buf, frame)
+
+	select {
+	case pu.queue <- pusherFrame{trackId, streamType, buf}:
+		return true
+	default:
+		atomic.AddUint64(&pu.framesDropped, 1)
+		return false
+	}
+}
+
+func (pu *pusher) run() {
+outer:
+	for {
+		// wait for a publisher
+		for pu.sdpText == nil {
+			select {
+			case pu.sdpText = <-pu.sdp:
+			case <-pu.terminate:
+				break outer
+			}
+		}
+
+		if !pu.do() {
+			break
+		}
+	}
+
+	close(pu.done)
+}
+
+// wait waits before connecting again; it returns false if the pusher
+// must be closed
+func (pu *pusher) wait() bool {
+	t := time.NewTimer(sourceRetryInterval)
+	defer t.Stop()
+
+	select {
+	case <-pu.terminate:
+		return false
+
+	case pu.sdpText = <-pu.sdp:
+		return true
+
+	case <-t.C:
+		return true
+	}
+}
+
+func (pu *pusher) do() bool {
+	pu.log("connecting to %s", redactUrl(pu.u.String()))
+
+	var nconn net.Conn
+	var err error
+	dialDone := make(chan struct{})
+	go func() {
+		nconn, err = net.DialTimeout("tcp", pu.u.Host, pu.p.conf.ReadTimeout)
+		close(dialDone)
+	}()
+
+	select {
+	case <-pu.terminate:
+		<-dialDone
+		if err == nil {
+			nconn.Close()
+		}
+		return false
+	case <-dialDone:
+	}
+
+	if err != nil {
+		pu.log("ERR: %s", err)
+		return pu.wait()
+	}
+	defer nconn.Close()
+
+	conn := gortsplib.NewConnClient(gortsplib.ConnClientConf{
+		Conn:         nconn,
+		ReadTimeout:  pu.p.conf.ReadTimeout,
+		WriteTimeout: pu.p.conf.WriteTimeout,
+	})
+
+	err = pu.announce(conn)
+	if err != nil {
+		pu.log("ERR: %s", err)
+		return pu.wait()
+	}
+
+	pu.log("pushing to %s", redactUrl(pu.u.String()))
+	atomic.StoreInt32(&pu.recording, 1)
+
+	// the remote server can send receiver reports, that are discarded
+	readDone := make(chan error, 1)
+	go func() {
+		frame := &gortsplib.InterleavedFrame{Content: make([]byte, 0, 64*1024)}
+		for {
+			frame.Content = frame.Content[:cap(frame.Content)]
+			_, err := conn.ReadFrameOrResponse(frame)
+			if err != nil {
+				readDone <- err
+				return
+			}
+		}
+	}()
+
+	stop := func() {
+		atomic.StoreInt32(&pu.recording, 0)
+		for len(pu.queue) > 0 {
+			<-pu.queue
+		}
+		nconn.Close()
+		<-readDone
+	}
+
+	for {
+		select {
+		case f := <-pu.queue:
+			err := conn.WriteFrame(&gortsplib.InterleavedFrame{
+				TrackId:    f.trackId,
+				StreamType: f.streamType,
+				Content:    f.buf,
+			})
+			if err != nil {
+				pu.log("ERR: %s", err)
+				stop()
+				return pu.wait()
+			}
+
+		case pu.sdpText = <-pu.sdp:
+			// the publisher is gone or has changed
+			conn.Do(&gortsplib.Request{Method: gortsplib.TEARDOWN, Url: pu.u, SkipResponse: true})
+			stop()
+			pu.log("stopped (%d frames dropped)", atomic.LoadUint64(&pu.framesDropped))
+			return true
+
+		case err := <-readDone:
+			pu.log("ERR: %s", err)
+			readDone <- err
+			stop()
+			return pu.wait()
+
+		case <-pu.terminate:
+			conn.Do(&gortsplib.Request{Method: gortsplib.TEARDOWN, Url: pu.u, SkipResponse: true})
+			stop()
+			return false
+		}
+	}
+}
+
+// announce publishes the SDP to the remote server and setups all the tracks
+// with the TCP transport
+func (pu *pusher) announce(conn *gortsplib.ConnClient) error {
+	do := func(req *gortsplib.Request) error {
+		res, err := conn.Do(req)
+		if err != nil {
+			return fmt.Errorf("%s failed: %s", req.Method, err)
+		}
+		if res.StatusCode != gortsplib.StatusOK {
+			return fmt.Errorf("%s failed: %d %s", req.Method, res.StatusCode, res.StatusMessage)
+		}
+		return nil
+	}
+
+	_, err := conn.Options(pu.u)
+	if err != nil {
+		return err
+	}
+
+	err = do(&gortsplib.Request{
+		Method: gortsplib.ANNOUNCE,
+		Url:    pu.u,
+		Header: gortsplib.Header{
+			"Content-Type":   []string{"application/sdp"},
+			"Content-Length": []string{strconv.FormatInt(int64(len(pu.sdpText)), 10)},
+		},
+		Content: pu.sdpText,
+	})
+	if err != nil {
+		return err
+	}
+
+	for trackId := range sdpMedias(pu.sdpText) {
+		trackUrl := *pu.u
+		trackUrl.Path += "/trackID=" + strconv.FormatInt(int64(trackId), 10)
+
+		err = do(&gortsplib.Request{
+			Method: gortsplib.SETUP,
+			Url:    &trackUrl,
+			Header: gortsplib.Header{
+				"Transport": []string{fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;mode=record",
+					trackId*2, trackId*2+1)},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return do(&gortsplib.Request{Method: gortsplib.RECORD, Url: pu.u})
+}
+
+func (pu *pusher) close() {
+	close(pu.terminate)
+	<-pu.done
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"time"
+)
+
+type reorderEntry struct {
+	buf     []byte
+	arrival time.Time
+}
+
+// reorderBuffer sorts the RTP packets of a track by sequence number.
+// Packets that arrive in advance are kept until the missing ones arrive, the
+// buffer is full or they are older than the timeout; packets that arrive
+// after the ones that follow them have been forwarded are discarded.
+// It is owned by the program.
+type reorderBuffer struct {
+	depth       int
+	timeout     time.Duration
+	initialized bool
+	nextSeq     uint16
+	pending     map[uint16]reorderEntry
+}
+
+func newReorderBuffer(depth int, timeout time.Duration) *reorderBuffer {
+	return &reorderBuffer{
+		depth:   depth,
+		timeout: timeout,
+		pending: make(map[uint16]reorderEntry),
+	}
+}
+
+// push adds a packet and calls cb with the packets that can be forwarded, in
+// order. The packet is copied, since buf is reused by the caller.
+func (rb *reorderBuffer) push(buf []byte, now time.Time, cb func([]byte)) {
+	if len(buf) < 12 {
+		return
+	}
+	seq := uint16(buf[2])<<8 | uint16(buf[3])
+
+	if !rb.initialized {
+		rb.initialized = true
+		rb.nextSeq = seq
+	}
+
+	diff := int16(seq - rb.nextSeq)
+
+	switch {
+	case diff == 0:
+		cb(buf)
+		rb.nextSeq++
+		rb.flushConsecutive(cb)
+
+	case diff < 0:
+		// a big jump backwards means that the publisher restarted the sequence
+		if int(-diff) > rb.depth*4 {
+			rb.flushAll(cb)
+			cb(buf)
+			rb.nextSeq = seq + 1
+		}
+
+	default:
+		if _, ok := rb.pending[seq]; ok {
+			return
+		}
+
+		rb.pending[seq] = reorderEntry{
+			buf:     append([]byte(nil), buf...),
+			arrival: now,
+		}
+
+		// skip the missing packets when the buffer is full
+		for len(rb.pending) >= rb.depth || int(diff) >= rb.depth*4 {
+			rb.skipToFirstPending()
+			rb.flushConsecutive(cb)
+			diff = int16(seq - rb.nextSeq)
+		}
+	}
+}
+
+// check forwards the packets that have been waiting for longer than the
+// timeout, skipping the missing ones
+func (rb *reorderBuffer) check(now time.Time, cb func([]byte)) {
+	for len(rb.pending) > 0 {
+		expired := false
+		for _, e := range rb.pending {
+			if now.Sub(e.arrival) >= rb.timeout {
+				expired = true
+				break
+			}
+		}
+		if !expired {
+			return
+		}
+
+		rb.skipToFirstPending()
+		rb.flushConsecutive(cb)
+	}
+}
+
+func (rb *reorderBuffer) firstPendingSeq() uint16 {
+	first := rb.nextSeq
+	minDiff := -1
+	for seq := range rb.pending {
+		d := int(uint16(seq - rb.nextSeq))
+		if minDiff < 0 || d < minDiff {
+			minDiff = d
+			first = seq
+		}
+	}
+	return first
+}
+
+func (rb *reorderBuffer) skipToFirstPending() {
+	if len(rb.pending) > 0 {
+		rb.nextSeq = rb.firstPendingSeq()
+	}
+}
+
+func (rb *reorderBuffer) flushConsecutive(cb func([]byte)) {
+	for {
+		e, ok := rb.pending[rb.nextSeq]
+		if !ok {
+			return
+		}
+		delete(rb.pending, rb.nextSeq)
+		cb(e.buf)
+		rb.nextSeq++
+	}
+}
+
+func (rb *reorderBuffer) flushAll(cb func([]byte)) {
+	for len(rb.pending) > 0 {
+		rb.skipToFirstPending()
+		rb.flushConsecutive(cb)
+	}
+}
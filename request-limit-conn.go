@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+type requestLimitState int
+
+const (
+	requestLimitStateStart requestLimitState = iota
+	requestLimitStateHeader
+	requestLimitStateFrameHeader
+	requestLimitStateContent
+)
+
+// requestLimitConn closes connections whose requests have a request line and
+// headers bigger than a limit. The stream is followed while it is read, in
+// order to skip the bodies of the requests and the interleaved frames, that
+// are not subject to the limit.
+type requestLimitConn struct {
+	lastRead int64 // unix nanoseconds, accessed atomically, must be the first field for 64-bit alignment
+	net.Conn
+	limit int
+
+	state       requestLimitState
+	headerSize  int
+	line        []byte // current header line
+	contentLen  int
+	frameHeader []byte
+	skip        int
+}
+
+func newRequestLimitConn(nconn net.Conn, limit int) *requestLimitConn {
+	return &requestLimitConn{
+		Conn:  nconn,
+		limit: limit,
+	}
+}
+
+func (rc *requestLimitConn) Read(b []byte) (int, error) {
+	n, err := rc.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&rc.lastRead, time.Now().UnixNano())
+	}
+
+	for i := 0; i < n; i++ {
+		switch rc.state {
+		case requestLimitStateStart:
+			// interleaved frames start with a dollar sign
+			if b[i] == '$' {
+				rc.state = requestLimitStateFrameHeader
+				rc.frameHeader = rc.frameHeader[:0]
+				continue
+			}
+
+			rc.state = requestLimitStateHeader
+			rc.headerSize = 0
+			rc.line = rc.line[:0]
+			rc.contentLen = 0
+			i--
+
+		case requestLimitStateHeader:
+			rc.headerSize++
+			if rc.headerSize > rc.limit {
+				return 0, fmt.Errorf("request line and headers exceed maxRequestHeaderSize (%d bytes)", rc.limit)
+			}
+
+			if b[i] != '\n' {
+				rc.line = append(rc.line, b[i])
+				continue
+			}
+
+			line := bytes.TrimSuffix(rc.line, []byte("\r"))
+			rc.line = rc.line[:0]
+
+			if len(line) > 0 {
+				kv := bytes.SplitN(line, []byte(":"), 2)
+				if len(kv) == 2 && bytes.EqualFold(bytes.TrimSpace(kv[0]), []byte("Content-Length")) {
+					rc.contentLen, _ = strconv.Atoi(string(bytes.TrimSpace(kv[1])))
+				}
+				continue
+			}
+
+			// end of the headers
+			rc.skip = rc.contentLen
+			rc.state = requestLimitStateContent
+			if rc.skip <= 0 {
+				rc.state = requestLimitStateStart
+			}
+
+		case requestLimitStateFrameHeader:
+			// channel and size
+			rc.frameHeader = append(rc.frameHeader, b[i])
+			if len(rc.frameHeader) == 3 {
+				rc.skip = int(rc.frameHeader[1])<<8 | int(rc.frameHeader[2])
+				rc.state = requestLimitStateContent
+				if rc.skip == 0 {
+					rc.state = requestLimitStateStart
+				}
+			}
+
+		case requestLimitStateContent:
+			l := n - i
+			if l > rc.skip {
+				l = rc.skip
+			}
+			rc.skip -= l
+			i += l - 1
+			if rc.skip == 0 {
+				rc.state = requestLimitStateStart
+			}
+		}
+	}
+
+	return n, err
+}
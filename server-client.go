@@ -7,7 +7,10 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aler9/gortsplib"
@@ -15,8 +18,8 @@ import (
 )
 
 const (
-	clientCheckStreamInterval    = 5 * time.Second
-	clientReceiverReportInterval = 10 * time.Second
+	clientCheckStreamInterval   = 5 * time.Second
+	malformedRequestLogInterval = 1 * time.Minute
 )
 
 type serverClientEvent interface {
@@ -36,6 +39,7 @@ const (
 	clientStateAnnounce
 	clientStatePrePlay
 	clientStatePlay
+	clientStatePause
 	clientStatePreRecord
 	clientStateRecord
 )
@@ -54,6 +58,9 @@ func (cs serverClientState) String() string {
 	case clientStatePlay:
 		return "PLAY"
 
+	case clientStatePause:
+		return "PAUSE"
+
 	case clientStatePreRecord:
 		return "PRE_RECORD"
 
@@ -64,37 +71,51 @@ func (cs serverClientState) String() string {
 }
 
 type serverClient struct {
+	udpLastRtcpTime int64 // unix nanoseconds, accessed atomically, must be the first field for 64-bit alignment
 	p               *program
+	id              string
 	conn            *gortsplib.ConnServer
+	connectedAt     time.Time
+	listenerMode    listenerMode // whether the client is allowed to publish or read
 	state           serverClientState
 	path            string
 	authUser        string
 	authPass        string
 	authHelper      *gortsplib.AuthServer
 	authFailures    int
+	tokenValid      bool
+	tokenPath       string                  // path whose read token has been validated
 	streamSdpText   []byte                  // only if publisher
 	streamSdpParsed *sdp.SessionDescription // only if publisher
 	streamProtocol  streamProtocol
 	streamTracks    []*track
+	trackIndexes    []int              // only if reader, the index in streamTracks of each track of the publisher, or -1
+	currentReq      *gortsplib.Request // request that is being handled, only if logRequests is enabled
+	teardownReq     *gortsplib.Request // set when the client sends a TEARDOWN
 	RtcpReceivers   []*gortsplib.RtcpReceiver
 	readBuf         *doubleBuffer
-	writeBuf        *doubleBuffer
+	writeMutex      sync.Mutex // responses and frames can be written by different goroutines
 
-	events chan serverClientEvent // only if state = Play and streamProtocol = TCP
-	done   chan struct{}
+	events           chan serverClientEvent // only if state = Play and streamProtocol = TCP
+	slowReaderClosed bool                   // owned by the program
+	expiredClosed    bool                   // owned by the program
+	done             chan struct{}
 }
 
-func newServerClient(p *program, nconn net.Conn) *serverClient {
+func newServerClient(p *program, nconn net.Conn, mode listenerMode, id string) *serverClient {
 	c := &serverClient{
-		p: p,
+		p:  p,
+		id: id,
 		conn: gortsplib.NewConnServer(gortsplib.ConnServerConf{
-			Conn:         nconn,
+			Conn:         newRequestLimitConn(nconn, p.conf.MaxRequestHeaderSize),
 			ReadTimeout:  p.conf.ReadTimeout,
 			WriteTimeout: p.conf.WriteTimeout,
 		}),
-		state:   clientStateStarting,
-		readBuf: newDoubleBuffer(512 * 1024),
-		done:    make(chan struct{}),
+		connectedAt:  time.Now(),
+		listenerMode: mode,
+		state:        clientStateStarting,
+		readBuf:      newDoubleBuffer(512 * 1024),
+		done:         make(chan struct{}),
 	}
 
 	go c.run()
@@ -102,7 +123,32 @@ func newServerClient(p *program, nconn net.Conn) *serverClient {
 }
 
 func (c *serverClient) log(format string, args ...interface{}) {
-	c.p.log("[client %s] "+format, append([]interface{}{c.conn.NetConn().RemoteAddr().String()}, args...)...)
+	c.p.log("[client %s %s] "+format, append([]interface{}{c.id, c.conn.NetConn().RemoteAddr().String()}, args...)...)
+}
+
+// summary returns a description of the session, that is printed when the
+// client disconnects
+func (c *serverClient) summary() string {
+	duration := time.Since(c.connectedAt).Round(time.Second)
+
+	if c.path == "" {
+		return fmt.Sprintf("connected for %s", duration)
+	}
+
+	role := "reader"
+	switch c.state {
+	case clientStateAnnounce, clientStatePreRecord, clientStateRecord:
+		role = "publisher"
+	}
+
+	var bytesIn, bytesOut uint64
+	for _, t := range c.streamTracks {
+		bytesIn += atomic.LoadUint64(&t.counters.rtpBytesIn)
+		bytesOut += atomic.LoadUint64(&t.counters.rtpBytesOut)
+	}
+
+	return fmt.Sprintf("%s on path '%s' via %s, connected for %s, %d bytes received, %d bytes sent",
+		role, c.path, c.streamProtocol, duration, bytesIn, bytesOut)
 }
 
 func (c *serverClient) ip() net.IP {
@@ -113,6 +159,15 @@ func (c *serverClient) zone() string {
 	return c.conn.NetConn().RemoteAddr().(*net.TCPAddr).Zone
 }
 
+// startReading is called by the program when the client starts or resumes
+// reading, since decoders need a keyframe and the parameter sets to start
+func (c *serverClient) startReading() {
+	for _, t := range c.streamTracks {
+		t.waitingKeyframe = t.waitKeyframe
+		t.paramSetsPending = true
+	}
+}
+
 func (c *serverClient) publisherIsReady() bool {
 	return c.state == clientStateRecord
 }
@@ -125,16 +180,29 @@ func (c *serverClient) publisherSdpParsed() *sdp.SessionDescription {
 	return c.streamSdpParsed
 }
 
+// startCommand starts an external command, or only logs it if runDryRun is
+// enabled. It returns nil if the command has not been started
+func (c *serverClient) startCommand(cmdstr string) *exec.Cmd {
+	if c.p.conf.RunDryRun {
+		c.log("dry run, command not started: %s (expanded: %s)", cmdstr, os.ExpandEnv(cmdstr))
+		return nil
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", cmdstr)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Start()
+	if err != nil {
+		c.log("ERR: %s", err)
+		return nil
+	}
+	return cmd
+}
+
 func (c *serverClient) run() {
 	var runOnConnectCmd *exec.Cmd
 	if c.p.conf.RunOnConnect != "" {
-		runOnConnectCmd = exec.Command("/bin/sh", "-c", c.p.conf.RunOnConnect)
-		runOnConnectCmd.Stdout = os.Stdout
-		runOnConnectCmd.Stderr = os.Stderr
-		err := runOnConnectCmd.Start()
-		if err != nil {
-			c.log("ERR: %s", err)
-		}
+		runOnConnectCmd = c.startCommand(c.p.conf.RunOnConnect)
 	}
 
 outer:
@@ -142,7 +210,11 @@ outer:
 		req, err := c.conn.ReadRequest()
 		if err != nil {
 			if err != io.EOF {
-				c.log("ERR: %s", err)
+				// errors that are not network errors are caused by malformed
+				// requests, that are logged once per IP to avoid floods
+				if _, ok := err.(net.Error); ok || c.p.errorLog.allow(c.ip().String()) {
+					c.log("ERR: %s", err)
+				}
 			}
 			break outer
 		}
@@ -153,6 +225,21 @@ outer:
 		}
 	}
 
+	// the response to TEARDOWN is sent after reading or publishing has been
+	// stopped, in order not to send frames after it
+	if c.teardownReq != nil {
+		if c.p.conf.LogRequests {
+			c.currentReq = c.teardownReq
+		}
+		c.writeResponse(&gortsplib.Response{
+			StatusCode: gortsplib.StatusOK,
+			Header: gortsplib.Header{
+				"CSeq":    c.teardownReq.Header["CSeq"],
+				"Session": []string{serverClientSessionId},
+			},
+		})
+	}
+
 	done := make(chan struct{})
 	c.p.events <- programEventClientClose{done, c}
 	<-done
@@ -172,6 +259,29 @@ func (c *serverClient) close() {
 	<-c.done
 }
 
+func (c *serverClient) writeResponse(res *gortsplib.Response) {
+	if !c.p.conf.DisableServerHeader {
+		if res.Header == nil {
+			res.Header = gortsplib.Header{}
+		}
+		res.Header["Server"] = []string{c.p.conf.ServerName}
+	}
+
+	if c.currentReq != nil {
+		c.log("%s %s -> %d", c.currentReq.Method, c.currentReq.Url.Path, res.StatusCode)
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.WriteResponse(res)
+}
+
+func (c *serverClient) writeFrame(frame *gortsplib.InterleavedFrame) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.conn.WriteFrame(frame)
+}
+
 func (c *serverClient) writeResError(req *gortsplib.Request, code gortsplib.StatusCode, err error) {
 	c.log("ERR: %s", err)
 
@@ -180,27 +290,98 @@ func (c *serverClient) writeResError(req *gortsplib.Request, code gortsplib.Stat
 		header["CSeq"] = cseq
 	}
 
-	c.conn.WriteResponse(&gortsplib.Response{
+	c.writeResponse(&gortsplib.Response{
 		StatusCode: code,
 		Header:     header,
 	})
 }
 
+func (c *serverClient) writeResRedirect(req *gortsplib.Request, location string) {
+	c.log("redirecting to '%s'", location)
+
+	c.writeResponse(&gortsplib.Response{
+		StatusCode: gortsplib.StatusFound,
+		Header: gortsplib.Header{
+			"CSeq":     req.Header["CSeq"],
+			"Location": []string{location},
+		},
+	})
+}
+
 func (c *serverClient) findConfForPath(path string) *ConfPath {
-	if pconf, ok := c.p.conf.Paths[path]; ok {
-		return pconf
-	}
+	return c.p.conf.findConfForPath(path)
+}
 
-	if pconf, ok := c.p.conf.Paths["all"]; ok {
-		return pconf
-	}
+// methods implemented by handleRequest(), that are advertised in the
+// Public header of OPTIONS responses. Keep in sync with handleRequest()
+var serverClientMethods = []gortsplib.Method{
+	gortsplib.OPTIONS,
+	gortsplib.DESCRIBE,
+	gortsplib.ANNOUNCE,
+	gortsplib.SETUP,
+	gortsplib.PLAY,
+	gortsplib.PAUSE,
+	gortsplib.RECORD,
+	gortsplib.GET_PARAMETER,
+	gortsplib.SET_PARAMETER,
+	gortsplib.TEARDOWN,
+}
 
-	return nil
+// serverClientPublic returns the value of the Public header
+func serverClientPublic() string {
+	var ret []string
+	for _, m := range serverClientMethods {
+		ret = append(ret, string(m))
+	}
+	return strings.Join(ret, ", ")
 }
 
+// the server handles a single session per connection, that has always the
+// same id
+const serverClientSessionId = "12345678"
+
 var errAuthCritical = errors.New("auth critical")
 var errAuthNotCritical = errors.New("auth not critical")
 
+var errPathDraining = errors.New("path is draining")
+var errPathNotConfigured = errors.New("path is not configured")
+var errEgressCapReached = errors.New("egress cap reached")
+
+// statusError is an error of the program that is sent to clients with a
+// specific status code
+type statusError struct {
+	code gortsplib.StatusCode
+	err  error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func errorWithStatus(code gortsplib.StatusCode, format string, args ...interface{}) error {
+	return &statusError{code, fmt.Errorf(format, args...)}
+}
+
+// status codes of the errors that are not statusErrors
+var errorStatusCodes = map[error]gortsplib.StatusCode{
+	errPathDraining:     gortsplib.StatusServiceUnavailable,
+	errEgressCapReached: gortsplib.StatusServiceUnavailable,
+	errAuthCritical:     gortsplib.StatusUnauthorized,
+	errAuthNotCritical:  gortsplib.StatusUnauthorized,
+}
+
+// errorStatusCode returns the status code that is sent to clients when a
+// request fails because of an error. Unknown errors are sent as bad requests
+func errorStatusCode(err error) gortsplib.StatusCode {
+	if se, ok := err.(*statusError); ok {
+		return se.code
+	}
+	if code, ok := errorStatusCodes[err]; ok {
+		return code
+	}
+	return gortsplib.StatusBadRequest
+}
+
 func (c *serverClient) authenticate(ips []interface{}, user string, pass string, req *gortsplib.Request) error {
 	// validate ip
 	err := func() error {
@@ -210,7 +391,7 @@ func (c *serverClient) authenticate(ips []interface{}, user string, pass string,
 
 		ip := c.ip()
 		if !ipEqualOrInRange(ip, ips) {
-			c.log("ERR: ip '%s' not allowed", ip)
+			c.writeResError(req, gortsplib.StatusUnauthorized, fmt.Errorf("ip '%s' not allowed", ip))
 			return errAuthCritical
 		}
 
@@ -256,7 +437,7 @@ func (c *serverClient) authenticate(ips []interface{}, user string, pass string,
 				retErr = errAuthNotCritical
 			}
 
-			c.conn.WriteResponse(&gortsplib.Response{
+			c.writeResponse(&gortsplib.Response{
 				StatusCode: gortsplib.StatusUnauthorized,
 				Header: gortsplib.Header{
 					"CSeq":             req.Header["CSeq"],
@@ -279,9 +460,54 @@ func (c *serverClient) authenticate(ips []interface{}, user string, pass string,
 	return nil
 }
 
+// authenticateRead checks the permissions of a reader. If the path has a
+// readTokenSecret, a valid token in the query replaces the credentials; once
+// a token is valid, it is not requested again by the following requests of
+// the session, since clients don't always keep the query in SETUP urls.
+func (c *serverClient) authenticateRead(pconf *ConfPath, path string, req *gortsplib.Request) error {
+	if pconf.ReadTokenSecret == "" {
+		return c.authenticate(pconf.readIpsParsed, pconf.ReadUser, pconf.ReadPass, req)
+	}
+
+	if !c.tokenValid || c.tokenPath != path {
+		token := req.Url.Query().Get(pconf.ReadTokenParam)
+		if token == "" {
+			if pconf.ReadUser != "" {
+				return c.authenticate(pconf.readIpsParsed, pconf.ReadUser, pconf.ReadPass, req)
+			}
+
+			c.writeResError(req, gortsplib.StatusUnauthorized,
+				fmt.Errorf("query parameter '%s' is missing", pconf.ReadTokenParam))
+			return errAuthCritical
+		}
+
+		// SETUP urls can be built by appending the control attribute
+		// to an url that contains the query
+		if n := strings.Index(token, "/"); n >= 0 {
+			token = token[:n]
+		}
+
+		err := checkReadToken(pconf.ReadTokenSecret, path, token, time.Now())
+		if err != nil {
+			c.writeResError(req, gortsplib.StatusUnauthorized, err)
+			return errAuthCritical
+		}
+
+		c.tokenValid = true
+		c.tokenPath = path
+	}
+
+	return c.authenticate(pconf.readIpsParsed, "", "", req)
+}
+
 func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 	c.log(string(req.Method))
 
+	if c.p.conf.LogRequests {
+		c.currentReq = req
+		defer func() { c.currentReq = nil }()
+	}
+
 	cseq, ok := req.Header["CSeq"]
 	if !ok || len(cseq) != 1 {
 		c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("cseq missing"))
@@ -296,7 +522,20 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 			ret = ret[1:]
 		}
 
-		// strip any subpath
+		// the path is the longest prefix that is the name of a path or that
+		// matches a pattern, in order to support multi-segment paths and
+		// sub-sources. Otherwise, any subpath is stripped
+		for end := len(ret); end > 0; end = strings.LastIndex(ret[:end], "/") {
+			name := ret[:end]
+			last := name[strings.LastIndex(name, "/")+1:]
+			if last == "" || strings.HasPrefix(last, "trackID=") {
+				continue
+			}
+			if c.p.conf.findNamedConfForPath(name) != nil {
+				return name
+			}
+		}
+
 		if n := strings.Index(ret, "/"); n >= 0 {
 			ret = ret[:n]
 		}
@@ -304,30 +543,42 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 		return ret
 	}()
 
+	switch req.Method {
+	case gortsplib.DESCRIBE, gortsplib.ANNOUNCE, gortsplib.SETUP:
+		err := checkPathName(path, c.p.conf.allowedPathRegexpParsed)
+		if err != nil {
+			c.writeResError(req, gortsplib.StatusBadRequest, err)
+			return false
+		}
+	}
+
+	switch req.Method {
+	case gortsplib.PLAY, gortsplib.RECORD, gortsplib.PAUSE:
+		if sx, ok := req.Header["Session"]; ok && len(sx) == 1 {
+			if id := strings.TrimSpace(strings.SplitN(sx[0], ";", 2)[0]); id != serverClientSessionId {
+				c.writeResError(req, gortsplib.StatusSessionNotFound, fmt.Errorf("session '%s' not found", id))
+				return false
+			}
+		}
+	}
+
 	switch req.Method {
 	case gortsplib.OPTIONS:
 		// do not check state, since OPTIONS can be requested
 		// in any state
 
-		c.conn.WriteResponse(&gortsplib.Response{
+		c.writeResponse(&gortsplib.Response{
 			StatusCode: gortsplib.StatusOK,
 			Header: gortsplib.Header{
-				"CSeq": cseq,
-				"Public": []string{strings.Join([]string{
-					string(gortsplib.DESCRIBE),
-					string(gortsplib.ANNOUNCE),
-					string(gortsplib.SETUP),
-					string(gortsplib.PLAY),
-					string(gortsplib.RECORD),
-					string(gortsplib.TEARDOWN),
-				}, ", ")},
+				"CSeq":   cseq,
+				"Public": []string{serverClientPublic()},
 			},
 		})
 		return true
 
 	case gortsplib.DESCRIBE:
 		if c.state != clientStateStarting {
-			c.writeResError(req, gortsplib.StatusBadRequest,
+			c.writeResError(req, gortsplib.StatusMethodNotValidInThisState,
 				fmt.Errorf("client is in state '%s' instead of '%s'", c.state, clientStateStarting))
 			return false
 		}
@@ -339,7 +590,22 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 			return false
 		}
 
-		err := c.authenticate(pconf.readIpsParsed, pconf.ReadUser, pconf.ReadPass, req)
+		if pconf.DisableRead {
+			c.writeResError(req, gortsplib.StatusForbidden, fmt.Errorf("reading from path '%s' is disabled", path))
+			return false
+		}
+
+		if c.listenerMode == listenerModePublish {
+			c.writeResError(req, gortsplib.StatusForbidden, fmt.Errorf("reading is not allowed on this listener"))
+			return false
+		}
+
+		if pconf.Redirect != "" {
+			c.writeResRedirect(req, pconf.Redirect)
+			return false
+		}
+
+		err := c.authenticateRead(pconf, path, req)
 		if err != nil {
 			if err == errAuthCritical {
 				return false
@@ -347,28 +613,43 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 			return true
 		}
 
-		res := make(chan []byte)
+		// the channel is buffered since the program may answer after the
+		// timeout, when waiting for an on-demand source
+		res := make(chan describeRes, 1)
 		c.p.events <- programEventClientDescribe{path, res}
-		sdp := <-res
-		if sdp == nil {
+		var dres describeRes
+		select {
+		case dres = <-res:
+		case <-time.After(pconf.SourceOnDemandStartTimeout):
+		}
+		if dres.err == errPathDraining {
+			c.writeResError(req, gortsplib.StatusServiceUnavailable, fmt.Errorf("path '%s' is draining", path))
+			return false
+		}
+		if dres.sdpText == nil {
 			c.writeResError(req, gortsplib.StatusNotFound, fmt.Errorf("no one is publishing on path '%s'", path))
 			return false
 		}
 
-		c.conn.WriteResponse(&gortsplib.Response{
+		sdpText := dres.sdpText
+		if pconf.sdpRemoveAttributesParsed != nil || pconf.sdpAddAttributesParsed != nil {
+			sdpText = sdpRewrite(dres.sdpParsed, pconf.sdpRemoveAttributesParsed, pconf.sdpAddAttributesParsed)
+		}
+
+		c.writeResponse(&gortsplib.Response{
 			StatusCode: gortsplib.StatusOK,
 			Header: gortsplib.Header{
 				"CSeq":         cseq,
 				"Content-Base": []string{req.Url.String() + "/"},
 				"Content-Type": []string{"application/sdp"},
 			},
-			Content: sdp,
+			Content: sdpText,
 		})
 		return true
 
 	case gortsplib.ANNOUNCE:
 		if c.state != clientStateStarting {
-			c.writeResError(req, gortsplib.StatusBadRequest,
+			c.writeResError(req, gortsplib.StatusMethodNotValidInThisState,
 				fmt.Errorf("client is in state '%s' instead of '%s'", c.state, clientStateStarting))
 			return false
 		}
@@ -385,6 +666,16 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 			return false
 		}
 
+		if pconf.DisablePublish {
+			c.writeResError(req, gortsplib.StatusForbidden, fmt.Errorf("publishing to path '%s' is disabled", path))
+			return false
+		}
+
+		if c.listenerMode == listenerModeRead {
+			c.writeResError(req, gortsplib.StatusForbidden, fmt.Errorf("publishing is not allowed on this listener"))
+			return false
+		}
+
 		err := c.authenticate(pconf.publishIpsParsed, pconf.PublishUser, pconf.PublishPass, req)
 		if err != nil {
 			if err == errAuthCritical {
@@ -420,15 +711,19 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 		res := make(chan error)
 		c.p.events <- programEventClientAnnounce{res, c, path}
 		err = <-res
+		if err == errPathDraining {
+			c.writeResError(req, gortsplib.StatusServiceUnavailable, fmt.Errorf("path '%s' is draining", path))
+			return false
+		}
 		if err != nil {
-			c.writeResError(req, gortsplib.StatusBadRequest, err)
+			c.writeResError(req, errorStatusCode(err), err)
 			return false
 		}
 
 		c.streamSdpText = req.Content
 		c.streamSdpParsed = sdpParsed
 
-		c.conn.WriteResponse(&gortsplib.Response{
+		c.writeResponse(&gortsplib.Response{
 			StatusCode: gortsplib.StatusOK,
 			Header: gortsplib.Header{
 				"CSeq": cseq,
@@ -443,7 +738,7 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 			return false
 		}
 
-		th := gortsplib.ReadHeaderTransport(tsRaw[0])
+		th := readHeaderTransport(tsRaw[0])
 		if _, ok := th["multicast"]; ok {
 			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("multicast is not supported"))
 			return false
@@ -459,7 +754,23 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 				return false
 			}
 
-			err := c.authenticate(pconf.readIpsParsed, pconf.ReadUser, pconf.ReadPass, req)
+			if pconf.DisableRead {
+				c.writeResError(req, gortsplib.StatusForbidden, fmt.Errorf("reading from path '%s' is disabled", path))
+				return false
+			}
+
+			if c.listenerMode == listenerModePublish {
+				c.writeResError(req, gortsplib.StatusForbidden, fmt.Errorf("reading is not allowed on this listener"))
+				return false
+			}
+
+			// clients that skip DESCRIBE are redirected here
+			if pconf.Redirect != "" {
+				c.writeResRedirect(req, pconf.Redirect)
+				return false
+			}
+
+			err := c.authenticateRead(pconf, path, req)
 			if err != nil {
 				if err == errAuthCritical {
 					return false
@@ -484,7 +795,12 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 					return false
 				}
 
-				rtpPort, rtcpPort := th.GetPorts("client_port")
+				if _, ok := pconf.readProtocolsParsed[streamProtocolUdp]; !ok {
+					c.writeResError(req, gortsplib.StatusUnsupportedTransport, fmt.Errorf("UDP is not allowed for readers of path '%s'", path))
+					return false
+				}
+
+				rtpPort, rtcpPort := readTransportPorts(th, "client_port")
 				if rtpPort == 0 || rtcpPort == 0 {
 					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("transport header does not have valid client ports (%s)", tsRaw[0]))
 					return false
@@ -501,24 +817,25 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 				}
 
 				res := make(chan error)
-				c.p.events <- programEventClientSetupPlay{res, c, path, streamProtocolUdp, rtpPort, rtcpPort}
+				c.p.events <- programEventClientSetupPlay{res, c, path, readSetupTrackId(req.Url.Path, path), streamProtocolUdp, rtpPort, rtcpPort}
 				err = <-res
+				if err == errPathDraining {
+					c.writeResError(req, gortsplib.StatusServiceUnavailable, fmt.Errorf("path '%s' is draining", path))
+					return false
+				}
 				if err != nil {
-					c.writeResError(req, gortsplib.StatusBadRequest, err)
+					c.writeResError(req, errorStatusCode(err), err)
 					return false
 				}
 
-				c.conn.WriteResponse(&gortsplib.Response{
+				c.writeResponse(&gortsplib.Response{
 					StatusCode: gortsplib.StatusOK,
 					Header: gortsplib.Header{
 						"CSeq": cseq,
-						"Transport": []string{strings.Join([]string{
-							"RTP/AVP/UDP",
-							"unicast",
-							fmt.Sprintf("client_port=%d-%d", rtpPort, rtcpPort),
-							fmt.Sprintf("server_port=%d-%d", c.p.conf.RtpPort, c.p.conf.RtcpPort),
-						}, ";")},
-						"Session": []string{"12345678"},
+						"Transport": []string{headerTransportUdp(rtpPort, rtcpPort,
+							c.streamTracks[len(c.streamTracks)-1].rtpl.port,
+							c.streamTracks[len(c.streamTracks)-1].rtcpl.port)},
+						"Session": []string{serverClientSessionId},
 					},
 				})
 				return true
@@ -530,6 +847,11 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 					return false
 				}
 
+				if _, ok := pconf.readProtocolsParsed[streamProtocolTcp]; !ok {
+					c.writeResError(req, gortsplib.StatusUnsupportedTransport, fmt.Errorf("TCP is not allowed for readers of path '%s'", path))
+					return false
+				}
+
 				if c.path != "" && path != c.path {
 					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("path has changed"))
 					return false
@@ -541,25 +863,23 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 				}
 
 				res := make(chan error)
-				c.p.events <- programEventClientSetupPlay{res, c, path, streamProtocolTcp, 0, 0}
+				c.p.events <- programEventClientSetupPlay{res, c, path, readSetupTrackId(req.Url.Path, path), streamProtocolTcp, 0, 0}
 				err = <-res
+				if err == errPathDraining {
+					c.writeResError(req, gortsplib.StatusServiceUnavailable, fmt.Errorf("path '%s' is draining", path))
+					return false
+				}
 				if err != nil {
-					c.writeResError(req, gortsplib.StatusBadRequest, err)
+					c.writeResError(req, errorStatusCode(err), err)
 					return false
 				}
 
-				interleaved := fmt.Sprintf("%d-%d", ((len(c.streamTracks) - 1) * 2), ((len(c.streamTracks)-1)*2)+1)
-
-				c.conn.WriteResponse(&gortsplib.Response{
+				c.writeResponse(&gortsplib.Response{
 					StatusCode: gortsplib.StatusOK,
 					Header: gortsplib.Header{
-						"CSeq": cseq,
-						"Transport": []string{strings.Join([]string{
-							"RTP/AVP/TCP",
-							"unicast",
-							fmt.Sprintf("interleaved=%s", interleaved),
-						}, ";")},
-						"Session": []string{"12345678"},
+						"CSeq":      cseq,
+						"Transport": []string{headerTransportTcp(len(c.streamTracks) - 1)},
+						"Session":   []string{serverClientSessionId},
 					},
 				})
 				return true
@@ -599,7 +919,7 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 					return false
 				}
 
-				rtpPort, rtcpPort := th.GetPorts("client_port")
+				rtpPort, rtcpPort := readTransportPorts(th, "client_port")
 				if rtpPort == 0 || rtcpPort == 0 {
 					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("transport header does not have valid client ports (%s)", tsRaw[0]))
 					return false
@@ -619,21 +939,18 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 				c.p.events <- programEventClientSetupRecord{res, c, streamProtocolUdp, rtpPort, rtcpPort}
 				err := <-res
 				if err != nil {
-					c.writeResError(req, gortsplib.StatusBadRequest, err)
+					c.writeResError(req, errorStatusCode(err), err)
 					return false
 				}
 
-				c.conn.WriteResponse(&gortsplib.Response{
+				c.writeResponse(&gortsplib.Response{
 					StatusCode: gortsplib.StatusOK,
 					Header: gortsplib.Header{
 						"CSeq": cseq,
-						"Transport": []string{strings.Join([]string{
-							"RTP/AVP/UDP",
-							"unicast",
-							fmt.Sprintf("client_port=%d-%d", rtpPort, rtcpPort),
-							fmt.Sprintf("server_port=%d-%d", c.p.conf.RtpPort, c.p.conf.RtcpPort),
-						}, ";")},
-						"Session": []string{"12345678"},
+						"Transport": []string{headerTransportUdp(rtpPort, rtcpPort,
+							c.streamTracks[len(c.streamTracks)-1].rtpl.port,
+							c.streamTracks[len(c.streamTracks)-1].rtcpl.port)},
+						"Session": []string{serverClientSessionId},
 					},
 				})
 				return true
@@ -656,9 +973,10 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 					return false
 				}
 
-				expInterleaved := fmt.Sprintf("%d-%d", 0+len(c.streamTracks)*2, 1+len(c.streamTracks)*2)
-				if interleaved != expInterleaved {
-					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("wrong interleaved value, expected '%s', got '%s'", expInterleaved, interleaved))
+				rtpChannel, rtcpChannel, ok := parseTransportRange(interleaved, 255)
+				if !ok || rtpChannel != len(c.streamTracks)*2 || rtcpChannel != 1+len(c.streamTracks)*2 {
+					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("wrong interleaved value, expected '%d-%d', got '%s'",
+						len(c.streamTracks)*2, 1+len(c.streamTracks)*2, interleaved))
 					return false
 				}
 
@@ -671,20 +989,16 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 				c.p.events <- programEventClientSetupRecord{res, c, streamProtocolTcp, 0, 0}
 				err := <-res
 				if err != nil {
-					c.writeResError(req, gortsplib.StatusBadRequest, err)
+					c.writeResError(req, errorStatusCode(err), err)
 					return false
 				}
 
-				c.conn.WriteResponse(&gortsplib.Response{
+				c.writeResponse(&gortsplib.Response{
 					StatusCode: gortsplib.StatusOK,
 					Header: gortsplib.Header{
-						"CSeq": cseq,
-						"Transport": []string{strings.Join([]string{
-							"RTP/AVP/TCP",
-							"unicast",
-							fmt.Sprintf("interleaved=%s", interleaved),
-						}, ";")},
-						"Session": []string{"12345678"},
+						"CSeq":      cseq,
+						"Transport": []string{headerTransportTcp(len(c.streamTracks) - 1)},
+						"Session":   []string{serverClientSessionId},
 					},
 				})
 				return true
@@ -695,13 +1009,46 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 			}
 
 		default:
-			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("client is in state '%s'", c.state))
+			c.writeResError(req, gortsplib.StatusMethodNotValidInThisState, fmt.Errorf("client is in state '%s'", c.state))
 			return false
 		}
 
 	case gortsplib.PLAY:
+		// trick play is not supported, since all paths are live; the session
+		// is kept, in order to allow clients to play at normal speed
+		if v, ok := req.Header["Scale"]; ok && len(v) == 1 {
+			scale, err := strconv.ParseFloat(strings.TrimSpace(v[0]), 64)
+			if err != nil || scale != 1 {
+				c.writeResError(req, gortsplib.StatusHeaderFieldNotValidForResource,
+					fmt.Errorf("scale '%s' is not supported, since paths are live", v[0]))
+				return true
+			}
+		}
+
+		// resume after PAUSE
+		if c.state == clientStatePause {
+			if path != c.path {
+				c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("path has changed"))
+				return false
+			}
+
+			// write response before setting state, like below
+			c.writeResponse(&gortsplib.Response{
+				StatusCode: gortsplib.StatusOK,
+				Header: gortsplib.Header{
+					"CSeq":    cseq,
+					"Session": []string{serverClientSessionId},
+				},
+			})
+
+			done := make(chan struct{})
+			c.p.events <- programEventClientResume{done, c}
+			<-done
+			return true
+		}
+
 		if c.state != clientStatePrePlay {
-			c.writeResError(req, gortsplib.StatusBadRequest,
+			c.writeResError(req, gortsplib.StatusMethodNotValidInThisState,
 				fmt.Errorf("client is in state '%s' instead of '%s'", c.state, clientStatePrePlay))
 			return false
 		}
@@ -716,27 +1063,52 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 		c.p.events <- programEventClientPlay1{res, c}
 		err := <-res
 		if err != nil {
-			c.writeResError(req, gortsplib.StatusBadRequest, err)
+			c.writeResError(req, errorStatusCode(err), err)
 			return false
 		}
 
 		// write response before setting state
 		// otherwise, in case of TCP connections, RTP packets could be sent
 		// before the response
-		c.conn.WriteResponse(&gortsplib.Response{
+		c.writeResponse(&gortsplib.Response{
 			StatusCode: gortsplib.StatusOK,
 			Header: gortsplib.Header{
 				"CSeq":    cseq,
-				"Session": []string{"12345678"},
+				"Session": []string{serverClientSessionId},
 			},
 		})
 
 		c.runPlay(path)
 		return false
 
+	case gortsplib.PAUSE:
+		if c.state != clientStatePlay {
+			c.writeResError(req, gortsplib.StatusMethodNotValidInThisState,
+				fmt.Errorf("client is in state '%s' instead of '%s'", c.state, clientStatePlay))
+			return false
+		}
+
+		if path != c.path {
+			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("path has changed"))
+			return false
+		}
+
+		done := make(chan struct{})
+		c.p.events <- programEventClientPause{done, c}
+		<-done
+
+		c.writeResponse(&gortsplib.Response{
+			StatusCode: gortsplib.StatusOK,
+			Header: gortsplib.Header{
+				"CSeq":    cseq,
+				"Session": []string{serverClientSessionId},
+			},
+		})
+		return true
+
 	case gortsplib.RECORD:
 		if c.state != clientStatePreRecord {
-			c.writeResError(req, gortsplib.StatusBadRequest,
+			c.writeResError(req, gortsplib.StatusMethodNotValidInThisState,
 				fmt.Errorf("client is in state '%s' instead of '%s'", c.state, clientStatePreRecord))
 			return false
 		}
@@ -751,33 +1123,151 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 			return false
 		}
 
-		c.conn.WriteResponse(&gortsplib.Response{
+		c.writeResponse(&gortsplib.Response{
 			StatusCode: gortsplib.StatusOK,
 			Header: gortsplib.Header{
 				"CSeq":    cseq,
-				"Session": []string{"12345678"},
+				"Session": []string{serverClientSessionId},
 			},
 		})
 
 		c.runRecord(path)
 		return false
 
+	case gortsplib.GET_PARAMETER, gortsplib.SET_PARAMETER:
+		// requests with parameters are forwarded to the source of the path
+		if len(req.Content) > 0 || req.Method == gortsplib.SET_PARAMETER {
+			return c.forwardParameterRequest(req, path)
+		}
+
+		// do not check state, since GET_PARAMETER is used by some clients
+		// as a keepalive in any state
+		c.writeResponse(&gortsplib.Response{
+			StatusCode: gortsplib.StatusOK,
+			Header: gortsplib.Header{
+				"CSeq":         cseq,
+				"Content-Type": []string{"text/parameters"},
+			},
+		})
+		return true
+
 	case gortsplib.TEARDOWN:
-		// close connection silently
+		// the session is stopped by the caller, that sends the response
+		c.teardownReq = req
 		return false
 
 	default:
-		c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("unhandled method '%s'", req.Method))
+		// the session is kept, since clients can probe unsupported methods
+		c.log("ERR: method '%s' is not implemented", req.Method)
+		c.writeResponse(&gortsplib.Response{
+			StatusCode: gortsplib.StatusNotImplemented,
+			Header: gortsplib.Header{
+				"CSeq":   cseq,
+				"Public": []string{serverClientPublic()},
+			},
+		})
+		return true
+	}
+}
+
+func (c *serverClient) forwardParameterRequest(req *gortsplib.Request, path string) bool {
+	pconf := c.findConfForPath(path)
+	if pconf == nil {
+		c.writeResError(req, gortsplib.StatusBadRequest,
+			fmt.Errorf("unable to find a valid configuration for path '%s'", path))
 		return false
 	}
+
+	err := c.authenticateRead(pconf, path, req)
+	if err != nil {
+		if err == errAuthCritical {
+			return false
+		}
+		return true
+	}
+
+	sres := make(chan *source)
+	c.p.events <- programEventClientGetSource{path, sres}
+	s := <-sres
+	if s == nil {
+		c.writeResError(req, gortsplib.StatusParameterNotUnderstood,
+			fmt.Errorf("path '%s' is not provided by a ready RTSP source", path))
+		return true
+	}
+
+	preq := sourceParameterRequest{req, make(chan *gortsplib.Response, 1)}
+
+	var res *gortsplib.Response
+	select {
+	case s.parameterRequests <- preq:
+		select {
+		case res = <-preq.res:
+		case <-time.After(c.p.conf.ReadTimeout):
+		}
+	case <-time.After(c.p.conf.ReadTimeout):
+	}
+
+	if res == nil {
+		c.writeResError(req, gortsplib.StatusBadGateway,
+			fmt.Errorf("the source of path '%s' did not answer", path))
+		return true
+	}
+
+	header := gortsplib.Header{
+		"CSeq": req.Header["CSeq"],
+	}
+	if ct, ok := res.Header["Content-Type"]; ok {
+		header["Content-Type"] = ct
+	}
+
+	c.writeResponse(&gortsplib.Response{
+		StatusCode: res.StatusCode,
+		Header:     header,
+		Content:    res.Content,
+	})
+	return true
+}
+
+// setTcpWriteBuffer sets the size of the send buffer of the TCP connection
+// and warns if the kernel has applied a smaller one
+func (c *serverClient) setTcpWriteBuffer(size int) {
+	rlc, ok := c.conn.NetConn().(*requestLimitConn)
+	if !ok {
+		return
+	}
+	nconn, ok := rlc.Conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	err := nconn.SetWriteBuffer(size)
+	if err != nil {
+		c.log("ERR: unable to set the TCP write buffer size: %s", err)
+		return
+	}
+
+	applied, ok := tcpWriteBufferSize(nconn)
+	if ok && applied < size {
+		c.log("WARN: the TCP write buffer size has been clamped by the kernel to %d bytes, "+
+			"instead of %d", applied, size)
+	}
 }
 
 func (c *serverClient) runPlay(path string) {
 	pconf := c.findConfForPath(path)
 
 	if c.streamProtocol == streamProtocolTcp {
-		c.writeBuf = newDoubleBuffer(2048)
-		c.events = make(chan serverClientEvent)
+		c.events = make(chan serverClientEvent, c.p.conf.ReaderQueueSize)
+
+		if c.p.conf.TcpWriteBufferSize > 0 {
+			c.setTcpWriteBuffer(c.p.conf.TcpWriteBufferSize)
+		}
+	}
+
+	// some clients open their receive sockets after the PLAY response,
+	// wait before sending frames in order not to lose them
+	if c.p.conf.ReaderStartDelay > 0 {
+		time.Sleep(c.p.conf.ReaderStartDelay)
 	}
 
 	done := make(chan struct{})
@@ -793,24 +1283,41 @@ func (c *serverClient) runPlay(path string) {
 
 	var runOnReadCmd *exec.Cmd
 	if pconf.RunOnRead != "" {
-		runOnReadCmd = exec.Command("/bin/sh", "-c", pconf.RunOnRead)
-		runOnReadCmd.Stdout = os.Stdout
-		runOnReadCmd.Stderr = os.Stderr
-		err := runOnReadCmd.Start()
-		if err != nil {
-			c.log("ERR: %s", err)
-		}
+		runOnReadCmd = c.startCommand(pconf.RunOnRead)
 	}
 
 	if c.streamProtocol == streamProtocolTcp {
 		readDone := make(chan error)
 		go func() {
-			buf := make([]byte, 2048)
+			frame := &gortsplib.InterleavedFrame{}
 			for {
-				_, err := c.conn.NetConn().Read(buf)
+				frame.Content = c.readBuf.swap()
+				frame.Content = frame.Content[:cap(frame.Content)]
+				recv, err := c.conn.ReadFrameOrRequest(frame)
 				if err != nil {
 					readDone <- err
-					break
+					return
+				}
+
+				switch recvt := recv.(type) {
+				case *gortsplib.InterleavedFrame:
+					// receiver reports
+					if frame.TrackId < len(c.streamTracks) {
+						c.streamTracks[frame.TrackId].counters.onFrameIn(frame.StreamType, len(frame.Content))
+
+						if c.p.conf.ForwardReaderLoss && frame.StreamType == gortsplib.StreamTypeRtcp {
+							if f, ok := rtcpFractionLost(frame.Content); ok {
+								atomic.StoreUint32(&c.streamTracks[frame.TrackId].readerFractionLost, uint32(f))
+							}
+						}
+					}
+
+				case *gortsplib.Request:
+					ok := c.handleRequest(recvt)
+					if !ok {
+						readDone <- nil
+						return
+					}
 				}
 			}
 		}()
@@ -819,7 +1326,7 @@ func (c *serverClient) runPlay(path string) {
 		for {
 			select {
 			case err := <-readDone:
-				if err != io.EOF {
+				if err != nil && err != io.EOF {
 					c.log("ERR: %s", err)
 				}
 				break outer
@@ -827,13 +1334,22 @@ func (c *serverClient) runPlay(path string) {
 			case rawEvt := <-c.events:
 				switch evt := rawEvt.(type) {
 				case serverClientEventFrameTcp:
-					c.conn.WriteFrame(evt.frame)
+					// frames are counted once they have been written, since
+					// queued frames can still be dropped
+					err := c.writeFrame(evt.frame)
+					if err == nil {
+						atomic.AddInt64(&c.p.stats.bytesOut, int64(len(evt.frame.Content)))
+					}
+					frameBuffers.put(evt.frame.Content)
 				}
 			}
 		}
 
 		go func() {
-			for range c.events {
+			for rawEvt := range c.events {
+				if evt, ok := rawEvt.(serverClientEventFrameTcp); ok {
+					frameBuffers.put(evt.frame.Content)
+				}
 			}
 		}()
 
@@ -844,21 +1360,60 @@ func (c *serverClient) runPlay(path string) {
 		close(c.events)
 
 	} else {
+		readDone := make(chan error)
+		go func() {
+			for {
+				req, err := c.conn.ReadRequest()
+				if err != nil {
+					readDone <- err
+					return
+				}
+
+				ok := c.handleRequest(req)
+				if !ok {
+					readDone <- nil
+					return
+				}
+			}
+		}()
+
+		playStart := time.Now()
+		checkStreamTicker := time.NewTicker(clientCheckStreamInterval)
+
+	outer2:
 		for {
-			req, err := c.conn.ReadRequest()
-			if err != nil {
-				if err != io.EOF {
+			select {
+			case err := <-readDone:
+				if err != nil && err != io.EOF {
 					c.log("ERR: %s", err)
 				}
-				break
-			}
+				break outer2
+
+			case <-checkStreamTicker.C:
+				// the timeout starts counting after the first receiver report,
+				// unless receiver reports are mandatory
+				lastRtcp := atomic.LoadInt64(&c.udpLastRtcpTime)
+				if lastRtcp == 0 {
+					if !pconf.RequireReaderRtcp || time.Since(playStart) < pconf.ReaderRtcpTimeout {
+						continue
+					}
+					c.log("ERR: no RTCP receiver reports received")
+
+				} else if time.Since(time.Unix(0, lastRtcp)) >= pconf.ReaderRtcpTimeout {
+					c.log("ERR: no RTCP receiver reports received in %s", pconf.ReaderRtcpTimeout)
+
+				} else {
+					continue
+				}
 
-			ok := c.handleRequest(req)
-			if !ok {
-				break
+				c.conn.NetConn().Close()
+				<-readDone
+				break outer2
 			}
 		}
 
+		checkStreamTicker.Stop()
+
 		done := make(chan struct{})
 		c.p.events <- programEventClientPlayStop{done, c}
 		<-done
@@ -882,6 +1437,10 @@ func (c *serverClient) runRecord(path string) {
 	c.p.events <- programEventClientRecord{done, c}
 	<-done
 
+	recordStart := time.Now()
+	silentTracksChecked := false
+	bitrateCheck := newBitrateCheck(c.streamTracks)
+
 	c.log("is publishing on path '%s', %d %s via %s", c.path, len(c.streamTracks), func() string {
 		if len(c.streamTracks) == 1 {
 			return "track"
@@ -891,13 +1450,7 @@ func (c *serverClient) runRecord(path string) {
 
 	var runOnPublishCmd *exec.Cmd
 	if pconf.RunOnPublish != "" {
-		runOnPublishCmd = exec.Command("/bin/sh", "-c", pconf.RunOnPublish)
-		runOnPublishCmd.Stdout = os.Stdout
-		runOnPublishCmd.Stderr = os.Stderr
-		err := runOnPublishCmd.Start()
-		if err != nil {
-			c.log("ERR: %s", err)
-		}
+		runOnPublishCmd = c.startCommand(pconf.RunOnPublish)
 	}
 
 	if c.streamProtocol == streamProtocolTcp {
@@ -911,7 +1464,7 @@ func (c *serverClient) runRecord(path string) {
 				recv, err := c.conn.ReadFrameOrRequest(frame)
 				if err != nil {
 					readDone <- err
-					break
+					return
 				}
 
 				switch recvt := recv.(type) {
@@ -919,29 +1472,30 @@ func (c *serverClient) runRecord(path string) {
 					if frame.TrackId >= len(c.streamTracks) {
 						c.log("ERR: invalid track id '%d'", frame.TrackId)
 						readDone <- nil
-						break
+						return
 					}
 
+					c.streamTracks[frame.TrackId].counters.onFrameIn(frame.StreamType, len(frame.Content))
 					c.RtcpReceivers[frame.TrackId].OnFrame(frame.StreamType, frame.Content)
-					c.p.events <- programEventClientFrameTcp{
+					c.p.frames <- programEventClientFrameTcp{
 						c.path,
 						frame.TrackId,
 						frame.StreamType,
-						frame.Content,
+						frameBuffers.copy(frame.Content),
 					}
 
 				case *gortsplib.Request:
 					ok := c.handleRequest(recvt)
 					if !ok {
 						readDone <- nil
-						break
+						return
 					}
 				}
 			}
 		}()
 
 		checkStreamTicker := time.NewTicker(clientCheckStreamInterval)
-		receiverReportTicker := time.NewTicker(clientReceiverReportInterval)
+		receiverReportTicker := time.NewTicker(pconf.RtcpInterval)
 
 	outer1:
 		for {
@@ -953,19 +1507,17 @@ func (c *serverClient) runRecord(path string) {
 				break outer1
 
 			case <-checkStreamTicker.C:
-				for trackId := range c.streamTracks {
-					if time.Since(c.RtcpReceivers[trackId].LastFrameTime()) >= c.p.conf.StreamDeadAfter {
-						c.log("ERR: stream is dead")
-						c.conn.NetConn().Close()
-						<-readDone
-						break outer1
-					}
+				if !c.checkRecord(pconf, recordStart, &silentTracksChecked, bitrateCheck) {
+					c.conn.NetConn().Close()
+					<-readDone
+					break outer1
 				}
 
 			case <-receiverReportTicker.C:
+				readersLoss := c.p.readersLoss(c.path)
 				for trackId := range c.streamTracks {
-					frame := c.RtcpReceivers[trackId].Report()
-					c.conn.WriteFrame(&gortsplib.InterleavedFrame{
+					frame := receiverReport(c.RtcpReceivers[trackId], trackId, readersLoss)
+					c.writeFrame(&gortsplib.InterleavedFrame{
 						TrackId:    trackId,
 						StreamType: gortsplib.StreamTypeRtcp,
 						Content:    frame,
@@ -984,19 +1536,19 @@ func (c *serverClient) runRecord(path string) {
 				req, err := c.conn.ReadRequest()
 				if err != nil {
 					readDone <- err
-					break
+					return
 				}
 
 				ok := c.handleRequest(req)
 				if !ok {
 					readDone <- nil
-					break
+					return
 				}
 			}
 		}()
 
 		checkStreamTicker := time.NewTicker(clientCheckStreamInterval)
-		receiverReportTicker := time.NewTicker(clientReceiverReportInterval)
+		receiverReportTicker := time.NewTicker(pconf.RtcpInterval)
 
 	outer2:
 		for {
@@ -1008,19 +1560,17 @@ func (c *serverClient) runRecord(path string) {
 				break outer2
 
 			case <-checkStreamTicker.C:
-				for trackId := range c.streamTracks {
-					if time.Since(c.RtcpReceivers[trackId].LastFrameTime()) >= c.p.conf.StreamDeadAfter {
-						c.log("ERR: stream is dead")
-						c.conn.NetConn().Close()
-						<-readDone
-						break outer2
-					}
+				if !c.checkRecord(pconf, recordStart, &silentTracksChecked, bitrateCheck) {
+					c.conn.NetConn().Close()
+					<-readDone
+					break outer2
 				}
 
 			case <-receiverReportTicker.C:
+				readersLoss := c.p.readersLoss(c.path)
 				for trackId := range c.streamTracks {
-					frame := c.RtcpReceivers[trackId].Report()
-					c.p.rtcpl.writeChan <- &udpAddrBufPair{
+					frame := receiverReport(c.RtcpReceivers[trackId], trackId, readersLoss)
+					c.streamTracks[trackId].rtcpl.writeChan <- &udpAddrBufPair{
 						addr: &net.UDPAddr{
 							IP:   c.ip(),
 							Zone: c.zone(),
@@ -1049,3 +1599,105 @@ func (c *serverClient) runRecord(path string) {
 		runOnPublishCmd.Wait()
 	}
 }
+
+// checkRecord is called periodically while the client is publishing and
+// returns false if the client must be closed, since it is not sending frames
+// or is exceeding maxBitrate
+func (c *serverClient) checkRecord(pconf *ConfPath, recordStart time.Time,
+	silentTracksChecked *bool, bitrateCheck *bitrateCheck) bool {
+	if !*silentTracksChecked && time.Since(recordStart) >= c.p.conf.TrackFirstFrameTimeout {
+		*silentTracksChecked = true
+		if c.checkSilentTracks() && c.p.conf.CloseOnSilentTrack {
+			return false
+		}
+	}
+
+	for trackId := range c.streamTracks {
+		if time.Since(c.RtcpReceivers[trackId].LastFrameTime()) >= pconf.PublishTimeout {
+			c.log("ERR: stream is dead")
+			return false
+		}
+	}
+
+	if bitrate := bitrateCheck.update(); pconf.MaxBitrate > 0 && bitrate > pconf.MaxBitrate {
+		c.log("ERR: bitrate (%d bit/s) exceeds maxBitrate (%d bit/s)", bitrate, pconf.MaxBitrate)
+		return false
+	}
+
+	return true
+}
+
+// bitrateCheck computes the incoming RTP bitrate of a publisher, since the
+// previous call to update()
+type bitrateCheck struct {
+	tracks    []*track
+	lastBytes uint64
+	lastTime  time.Time
+}
+
+func newBitrateCheck(tracks []*track) *bitrateCheck {
+	return &bitrateCheck{
+		tracks:   tracks,
+		lastTime: time.Now(),
+	}
+}
+
+func (bc *bitrateCheck) update() int {
+	var bytes uint64
+	for _, t := range bc.tracks {
+		bytes += atomic.LoadUint64(&t.counters.rtpBytesIn)
+	}
+	now := time.Now()
+
+	bitrate := int(float64(bytes-bc.lastBytes) * 8 / now.Sub(bc.lastTime).Seconds())
+
+	bc.lastBytes = bytes
+	bc.lastTime = now
+	return bitrate
+}
+
+// lastFrameTime returns the time the last RTP packet was received, on any track
+func (c *serverClient) lastFrameTime() time.Time {
+	var ret time.Time
+	for trackId := range c.streamTracks {
+		if t := c.RtcpReceivers[trackId].LastFrameTime(); t.After(ret) {
+			ret = t
+		}
+	}
+	return ret
+}
+
+// lastActivity returns the time of the last data received from the client,
+// through the RTSP connection or through UDP. It is called by the program
+func (c *serverClient) lastActivity() time.Time {
+	ret := time.Unix(0, atomic.LoadInt64(&c.conn.NetConn().(*requestLimitConn).lastRead))
+
+	if t := time.Unix(0, atomic.LoadInt64(&c.udpLastRtcpTime)); t.After(ret) {
+		ret = t
+	}
+
+	if c.state == clientStateRecord {
+		if t := c.lastFrameTime(); t.After(ret) {
+			ret = t
+		}
+	}
+
+	// nothing has been received yet
+	if ret.Before(c.connectedAt) {
+		ret = c.connectedAt
+	}
+	return ret
+}
+
+// log the tracks that have not sent any RTP packet since RECORD
+// and return whether there's at least one of them
+func (c *serverClient) checkSilentTracks() bool {
+	found := false
+	for trackId, t := range c.streamTracks {
+		if atomic.LoadUint64(&t.counters.rtpPacketsIn) == 0 {
+			c.log("WARN: track %d has not sent any frame since RECORD", trackId)
+			found = true
+		}
+	}
+	return found
+}
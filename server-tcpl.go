@@ -2,30 +2,117 @@ package main
 
 import (
 	"net"
+	"time"
 )
 
+type listenerMode int
+
+const (
+	listenerModeAll listenerMode = iota
+	listenerModePublish
+	listenerModeRead
+)
+
+type connRateEntry struct {
+	start  time.Time
+	count  int
+	logged bool
+}
+
+// connRateLimiter limits the number of new connections that each IP can open
+// within a window. It is used by a single listener goroutine.
+type connRateLimiter struct {
+	max         int
+	window      time.Duration
+	entries     map[string]*connRateEntry
+	lastCleanup time.Time
+}
+
+func newConnRateLimiter(max int, window time.Duration) *connRateLimiter {
+	return &connRateLimiter{
+		max:         max,
+		window:      window,
+		entries:     make(map[string]*connRateEntry),
+		lastCleanup: time.Now(),
+	}
+}
+
+// allow returns whether a connection from the given IP is accepted and, if
+// it's not, whether it's the first rejection of the current window
+func (rl *connRateLimiter) allow(ip string, now time.Time) (bool, bool) {
+	// remove the entries whose window has ended
+	if now.Sub(rl.lastCleanup) >= rl.window {
+		for key, e := range rl.entries {
+			if now.Sub(e.start) >= rl.window {
+				delete(rl.entries, key)
+			}
+		}
+		rl.lastCleanup = now
+	}
+
+	e, ok := rl.entries[ip]
+	if !ok || now.Sub(e.start) >= rl.window {
+		rl.entries[ip] = &connRateEntry{start: now, count: 1}
+		return true, false
+	}
+
+	e.count++
+	if e.count <= rl.max {
+		return true, false
+	}
+
+	first := !e.logged
+	e.logged = true
+	return false, first
+}
+
 type serverTcpListener struct {
-	p     *program
-	nconn *net.TCPListener
+	p       *program
+	nconn   *net.TCPListener
+	limiter *connRateLimiter
+	mode    listenerMode
 
 	done chan struct{}
 }
 
-func newServerTcpListener(p *program) (*serverTcpListener, error) {
+func newServerTcpListener(p *program, lconf confRtspListener) (*serverTcpListener, error) {
 	nconn, err := net.ListenTCP("tcp", &net.TCPAddr{
-		Port: p.conf.RtspPort,
+		IP:   lconf.ip,
+		Port: lconf.port,
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	if p.conf.ListenBacklog > 0 {
+		err := setListenBacklog(nconn, p.conf.ListenBacklog)
+		if err != nil {
+			nconn.Close()
+			return nil, err
+		}
+	}
+
 	l := &serverTcpListener{
 		p:     p,
 		nconn: nconn,
+		mode:  lconf.mode,
 		done:  make(chan struct{}),
 	}
 
-	l.log("opened on :%d", p.conf.RtspPort)
+	if p.conf.ConnRateLimit > 0 {
+		l.limiter = newConnRateLimiter(p.conf.ConnRateLimit, p.conf.ConnRateWindow)
+	}
+
+	switch l.mode {
+	case listenerModePublish:
+		l.log("opened on %s (publishers only)", nconn.Addr())
+
+	case listenerModeRead:
+		l.log("opened on %s (readers only)", nconn.Addr())
+
+	default:
+		l.log("opened on %s", nconn.Addr())
+	}
 	return l, nil
 }
 
@@ -40,7 +127,27 @@ func (l *serverTcpListener) run() {
 			break
 		}
 
-		l.p.events <- programEventClientNew{nconn}
+		if l.limiter != nil {
+			ip := nconn.RemoteAddr().(*net.TCPAddr).IP.String()
+			allowed, first := l.limiter.allow(ip, time.Now())
+			if !allowed {
+				if first {
+					l.log("WARN: %s opened more than %d connections in %s, further connections are rejected",
+						ip, l.p.conf.ConnRateLimit, l.p.conf.ConnRateWindow)
+				}
+				nconn.Close()
+				continue
+			}
+		}
+
+		// Nagle's algorithm delays small writes, like the ones of interleaved
+		// frames; keepalives allow to detect dead readers that don't send
+		// anything
+		nconn.SetNoDelay(!l.p.conf.DisableTcpNoDelay)
+		nconn.SetKeepAlive(true)
+		nconn.SetKeepAlivePeriod(l.p.conf.TcpKeepAlivePeriod)
+
+		l.p.events <- programEventClientNew{nconn, l.mode}
 	}
 
 	close(l.done)
@@ -15,6 +15,7 @@ type udpAddrBufPair struct {
 type serverUdpListener struct {
 	p          *program
 	nconn      *net.UDPConn
+	port       int
 	streamType gortsplib.StreamType
 	readBuf    *doubleBuffer
 	writeBuf   *doubleBuffer
@@ -25,6 +26,7 @@ type serverUdpListener struct {
 
 func newServerUdpListener(p *program, port int, streamType gortsplib.StreamType) (*serverUdpListener, error) {
 	nconn, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP:   p.conf.listenIp,
 		Port: port,
 	})
 	if err != nil {
@@ -34,6 +36,7 @@ func newServerUdpListener(p *program, port int, streamType gortsplib.StreamType)
 	l := &serverUdpListener{
 		p:          p,
 		nconn:      nconn,
+		port:       port,
 		streamType: streamType,
 		readBuf:    newDoubleBuffer(2048),
 		writeBuf:   newDoubleBuffer(2048),
@@ -41,7 +44,7 @@ func newServerUdpListener(p *program, port int, streamType gortsplib.StreamType)
 		done:       make(chan struct{}),
 	}
 
-	l.log("opened on :%d", port)
+	l.log("opened on %s", nconn.LocalAddr())
 	return l, nil
 }
 
@@ -72,10 +75,10 @@ func (l *serverUdpListener) run() {
 			break
 		}
 
-		l.p.events <- programEventClientFrameUdp{
+		l.p.frames <- programEventClientFrameUdp{
 			addr,
 			l.streamType,
-			buf[:n],
+			frameBuffers.copy(buf[:n]),
 		}
 	}
 
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib"
+)
+
+const (
+	// GUID that is appended to the key of the client in order to compute the
+	// accept key, as described in RFC 6455
+	serverWsGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	serverWsOpcodeText   = 0x01
+	serverWsOpcodeBinary = 0x02
+	serverWsOpcodeClose  = 0x08
+	serverWsOpcodePing   = 0x09
+	serverWsOpcodePong   = 0x0a
+
+	// maximum size of messages sent by browsers, that are discarded anyway
+	serverWsMaxMessageSize = 64 * 1024
+)
+
+// serverWs is a HTTP server that allows browsers to read the frames of a path
+// through a WebSocket, at the url ws://host:port/path
+type serverWs struct {
+	p        *program
+	listener net.Listener
+	server   *http.Server
+	wg       sync.WaitGroup // handlers that are running
+
+	done chan struct{}
+}
+
+func newServerWs(p *program) (*serverWs, error) {
+	listener, err := net.Listen("tcp", p.conf.WebSocketAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	ws := &serverWs{
+		p:        p,
+		listener: listener,
+		done:     make(chan struct{}),
+	}
+
+	ws.server = &http.Server{
+		Handler: http.HandlerFunc(ws.onRequest),
+	}
+
+	ws.log("opened on %s", listener.Addr())
+	return ws, nil
+}
+
+func (ws *serverWs) log(format string, args ...interface{}) {
+	ws.p.log("[WebSocket listener] "+format, args...)
+}
+
+func (ws *serverWs) run() {
+	err := ws.server.Serve(ws.listener)
+	if err != http.ErrServerClosed {
+		ws.log("ERR: %s", err)
+	}
+
+	close(ws.done)
+}
+
+// hijacked connections are not closed by the server, and are closed by the
+// program. Handlers are waited since they send events to the program
+func (ws *serverWs) close() {
+	ws.server.Close()
+	<-ws.done
+	ws.wg.Wait()
+}
+
+func (ws *serverWs) writeError(w http.ResponseWriter, r *http.Request, code int, err error) {
+	ws.log("ERR: %s: %s", r.RemoteAddr, err)
+	http.Error(w, err.Error(), code)
+}
+
+func (ws *serverWs) onRequest(w http.ResponseWriter, r *http.Request) {
+	ws.wg.Add(1)
+	defer ws.wg.Done()
+
+	path := strings.Trim(r.URL.Path, "/")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		r.Header.Get("Sec-WebSocket-Key") == "" {
+		ws.writeError(w, r, http.StatusBadRequest, fmt.Errorf("not a WebSocket request"))
+		return
+	}
+
+	err := checkPathName(path, ws.p.conf.allowedPathRegexpParsed)
+	if err != nil {
+		ws.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	pconf := ws.p.conf.findConfForPath(path)
+	if pconf == nil {
+		ws.writeError(w, r, http.StatusNotFound,
+			fmt.Errorf("unable to find a valid configuration for path '%s'", path))
+		return
+	}
+
+	if pconf.DisableRead {
+		ws.writeError(w, r, http.StatusForbidden, fmt.Errorf("reading from path '%s' is disabled", path))
+		return
+	}
+
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	if pconf.readIpsParsed != nil && (ip == nil || !ipEqualOrInRange(ip, pconf.readIpsParsed)) {
+		ws.writeError(w, r, http.StatusUnauthorized, fmt.Errorf("ip '%s' not allowed", host))
+		return
+	}
+
+	// browsers can't set the Authorization header of WebSocket requests,
+	// therefore credentials can also be passed in the query
+	if pconf.ReadUser != "" {
+		user, pass, ok := r.BasicAuth()
+		if !ok {
+			user, pass = r.URL.Query().Get("user"), r.URL.Query().Get("pass")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(user), []byte(pconf.ReadUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(pconf.ReadPass)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="rtsp-simple-server"`)
+			ws.writeError(w, r, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+			return
+		}
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		ws.writeError(w, r, http.StatusInternalServerError, fmt.Errorf("connection can't be hijacked"))
+		return
+	}
+
+	wc := &serverWsClient{
+		p:      ws.p,
+		path:   path,
+		queue:  make(chan []byte, ws.p.conf.ReaderQueueSize),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	res := make(chan error)
+	ws.p.events <- programEventWsClientNew{res, wc}
+	err = <-res
+	if err != nil {
+		code := http.StatusNotFound
+		if err == errPathDraining || err == errEgressCapReached {
+			code = http.StatusServiceUnavailable
+		}
+		ws.writeError(w, r, code, err)
+		return
+	}
+
+	nconn, brw, err := hj.Hijack()
+	if err != nil {
+		ws.log("ERR: %s", err)
+		wc.closeByProgram()
+		return
+	}
+
+	h := sha1.New()
+	h.Write([]byte(r.Header.Get("Sec-WebSocket-Key") + serverWsGuid))
+
+	nconn.SetWriteDeadline(time.Now().Add(ws.p.conf.WriteTimeout))
+	_, err = nconn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h.Sum(nil)) + "\r\n" +
+		"\r\n"))
+	if err != nil {
+		nconn.Close()
+		wc.closeByProgram()
+		return
+	}
+
+	nconn.SetDeadline(time.Time{})
+	wc.nconn = nconn
+	wc.br = brw.Reader
+	wc.connectedAt = time.Now()
+	go wc.run()
+}
+
+// serverWsClient is a reader that receives the frames of a path through a
+// WebSocket. The SDP of the path is sent as the first message, in text format;
+// then every frame is sent as a binary message, prefixed by a header that
+// contains the track id and the stream type (0 = RTP, 1 = RTCP).
+type serverWsClient struct {
+	framesDropped uint64 // accessed atomically, must be the first field for 64-bit alignment
+	p             *program
+	path          string
+	sdpText       []byte // set by the program when the client is added
+	nconn         net.Conn
+	br            *bufio.Reader
+	connectedAt   time.Time
+	bytesOut      uint64
+	writeMutex    sync.Mutex // frames and control messages are written by different goroutines
+
+	queue     chan []byte
+	closeOnce sync.Once
+	closed    chan struct{} // closed when the client must stop
+	done      chan struct{}
+}
+
+func (wc *serverWsClient) log(format string, args ...interface{}) {
+	wc.p.log("[WebSocket client %s] "+format, append([]interface{}{wc.nconn.RemoteAddr().String()}, args...)...)
+}
+
+// closeByProgram removes a client that has been added to the program but
+// never started
+func (wc *serverWsClient) closeByProgram() {
+	done := make(chan struct{})
+	wc.p.events <- programEventWsClientClose{done, wc}
+	<-done
+	close(wc.done)
+}
+
+func (wc *serverWsClient) run() {
+	wc.log("is reading from path '%s'", wc.path)
+
+	readDone := make(chan error, 1)
+	go func() {
+		readDone <- wc.runReader()
+	}()
+
+	err := func() error {
+		err := wc.writeMessage(serverWsOpcodeText, wc.sdpText)
+		if err != nil {
+			return err
+		}
+
+		for {
+			select {
+			case msg := <-wc.queue:
+				err := wc.writeMessage(serverWsOpcodeBinary, msg)
+				if err != nil {
+					return err
+				}
+				wc.bytesOut += uint64(len(msg))
+
+			case err := <-readDone:
+				readDone <- err
+				return err
+
+			case <-wc.closed:
+				wc.writeMessage(serverWsOpcodeClose, []byte{0x03, 0xe8}) // normal closure
+				return nil
+			}
+		}
+	}()
+	if err != nil && err != io.EOF {
+		wc.log("ERR: %s", err)
+	}
+
+	wc.nconn.Close()
+	<-readDone
+
+	done := make(chan struct{})
+	wc.p.events <- programEventWsClientClose{done, wc}
+	<-done
+
+	wc.log("disconnected (reader on path '%s', connected for %s, %d bytes sent, %d frames dropped)",
+		wc.path, time.Since(wc.connectedAt).Round(time.Second), wc.bytesOut, atomic.LoadUint64(&wc.framesDropped))
+
+	close(wc.done)
+}
+
+// close() can be called by the program while the client is running
+func (wc *serverWsClient) close() {
+	wc.closeOnce.Do(func() {
+		close(wc.closed)
+	})
+}
+
+// runReader reads the messages of the browser, that are discarded, and
+// answers to control messages
+func (wc *serverWsClient) runReader() error {
+	header := make([]byte, 8)
+	buf := make([]byte, serverWsMaxMessageSize)
+
+	for {
+		_, err := io.ReadFull(wc.br, header[:2])
+		if err != nil {
+			return err
+		}
+
+		opcode := header[0] & 0x0f
+		masked := (header[1] & 0x80) != 0
+		size := uint64(header[1] & 0x7f)
+
+		switch size {
+		case 126:
+			_, err := io.ReadFull(wc.br, header[:2])
+			if err != nil {
+				return err
+			}
+			size = uint64(binary.BigEndian.Uint16(header[:2]))
+
+		case 127:
+			_, err := io.ReadFull(wc.br, header[:8])
+			if err != nil {
+				return err
+			}
+			size = binary.BigEndian.Uint64(header[:8])
+		}
+
+		// messages of clients must be masked
+		if !masked {
+			return fmt.Errorf("received an unmasked message")
+		}
+		if size > serverWsMaxMessageSize {
+			return fmt.Errorf("message size (%d) exceeds the maximum (%d)", size, serverWsMaxMessageSize)
+		}
+
+		var mask [4]byte
+		_, err = io.ReadFull(wc.br, mask[:])
+		if err != nil {
+			return err
+		}
+
+		payload := buf[:size]
+		_, err = io.ReadFull(wc.br, payload)
+		if err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case serverWsOpcodeClose:
+			wc.writeMessage(serverWsOpcodeClose, payload)
+			return io.EOF
+
+		case serverWsOpcodePing:
+			err := wc.writeMessage(serverWsOpcodePong, payload)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (wc *serverWsClient) writeMessage(opcode byte, payload []byte) error {
+	var header []byte
+	switch {
+	case len(payload) < 126:
+		header = []byte{0x80 | opcode, byte(len(payload))}
+
+	case len(payload) <= 0xffff:
+		header = []byte{0x80 | opcode, 126, 0, 0}
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+
+	default:
+		header = make([]byte, 10)
+		header[0] = 0x80 | opcode
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+
+	wc.writeMutex.Lock()
+	defer wc.writeMutex.Unlock()
+
+	wc.nconn.SetWriteDeadline(time.Now().Add(wc.p.conf.WriteTimeout))
+	_, err := (&net.Buffers{header, payload}).WriteTo(wc.nconn)
+	return err
+}
+
+// writeFrame is called by the program; the frame is copied, since its buffer
+// is reused, and dropped if the client is slower than the publisher.
+// It returns whether the frame has been queued
+func (wc *serverWsClient) writeFrame(trackId int, streamType gortsplib.StreamType, frame []byte) bool {
+	msg := make([]byte, 2+len(frame))
+	msg[0] = byte(trackId)
+	if streamType == gortsplib.StreamTypeRtcp {
+		msg[1] = 1
+	}
+	copy(msg[2:], frame)
+
+	select {
+	case wc.queue <- msg:
+		return true
+	default:
+		atomic.AddUint64(&wc.framesDropped, 1)
+		return false
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	sourceEventsQueueSize = 256
+	sourceEventsTimeout   = 5 * time.Second
+)
+
+// sourceEvent is sent when a source changes state
+type sourceEvent struct {
+	Path          string `json:"path"`
+	State         string `json:"state"`
+	PreviousState string `json:"previousState"`
+	Url           string `json:"url"`
+	Time          string `json:"time"`
+}
+
+// sourceEventsHook sends the state changes of the sources to an HTTP
+// endpoint, in the order in which they happen, through POST requests with a
+// JSON body. Events are dropped if the endpoint is slower than the sources.
+type sourceEventsHook struct {
+	p         *program
+	client    *http.Client
+	ctx       context.Context
+	ctxCancel func()
+
+	queue chan sourceEvent
+	done  chan struct{}
+}
+
+func newSourceEventsHook(p *program) *sourceEventsHook {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+
+	h := &sourceEventsHook{
+		p:         p,
+		client:    &http.Client{Timeout: sourceEventsTimeout},
+		ctx:       ctx,
+		ctxCancel: ctxCancel,
+		queue:     make(chan sourceEvent, sourceEventsQueueSize),
+		done:      make(chan struct{}),
+	}
+
+	h.log("sending source events to %s", redactUrl(p.conf.SourceEventsUrl))
+	return h
+}
+
+func (h *sourceEventsHook) log(format string, args ...interface{}) {
+	h.p.log("[source events] "+format, args...)
+}
+
+// push is called by the sources; it never blocks.
+func (h *sourceEventsHook) push(evt sourceEvent) {
+	select {
+	case h.queue <- evt:
+	default:
+		h.log("WARN: queue is full, event of path '%s' dropped", evt.Path)
+	}
+}
+
+func (h *sourceEventsHook) run() {
+outer:
+	for {
+		select {
+		case evt := <-h.queue:
+			err := h.send(evt)
+			if err != nil && h.ctx.Err() == nil {
+				h.log("ERR: %s", err)
+			}
+
+		case <-h.ctx.Done():
+			break outer
+		}
+	}
+
+	close(h.done)
+}
+
+func (h *sourceEventsHook) send(evt sourceEvent) error {
+	byts, _ := json.Marshal(evt)
+
+	req, err := http.NewRequest(http.MethodPost, h.p.conf.SourceEventsUrl, bytes.NewReader(byts))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(h.ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+	return nil
+}
+
+// close is called after the sources have been closed; events that have not
+// been sent yet are discarded.
+func (h *sourceEventsHook) close() {
+	h.ctxCancel()
+	<-h.done
+}
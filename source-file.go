@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/sdp"
+)
+
+const (
+	// maximum size of the payload of the RTP packets generated from files,
+	// that allows to send them through UDP without fragmentation
+	sourceFileRtpPayloadMaxSize = 1400
+)
+
+// sourceFileTrack generates the RTP packets of a track of a file
+type sourceFileTrack struct {
+	mp4         *mp4Track
+	payloadType uint8
+	clockRate   int
+	ssrc        uint32
+	seq         uint16
+}
+
+func (t *sourceFileTrack) rtpPacket(payload []byte, ts uint32, marker bool) []byte {
+	buf := make([]byte, 12+len(payload))
+	buf[0] = 0x80
+	buf[1] = t.payloadType
+	if marker {
+		buf[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(buf[2:4], t.seq)
+	binary.BigEndian.PutUint32(buf[4:8], ts)
+	binary.BigEndian.PutUint32(buf[8:12], t.ssrc)
+	copy(buf[12:], payload)
+
+	t.seq++
+	return buf
+}
+
+// h264Packets packetizes a sample, that contains length-prefixed NALUs, as
+// described in RFC 6184. SPS and PPS are sent before every IDR frame, since
+// readers can start reading at any time.
+func (t *sourceFileTrack) h264Packets(sample []byte, sync bool, ts uint32) ([][]byte, error) {
+	var nalus [][]byte
+	if sync {
+		nalus = append(nalus, t.mp4.sps, t.mp4.pps)
+	}
+
+	for len(sample) > 0 {
+		if len(sample) < t.mp4.nalLenSize {
+			return nil, fmt.Errorf("invalid NALU length")
+		}
+		l := 0
+		for _, b := range sample[:t.mp4.nalLenSize] {
+			l = l<<8 | int(b)
+		}
+		sample = sample[t.mp4.nalLenSize:]
+		if l == 0 || l > len(sample) {
+			return nil, fmt.Errorf("invalid NALU length")
+		}
+		nalus = append(nalus, sample[:l])
+		sample = sample[l:]
+	}
+
+	var ret [][]byte
+	for i, nalu := range nalus {
+		last := (i == len(nalus)-1)
+
+		// single NAL unit packet
+		if len(nalu) <= sourceFileRtpPayloadMaxSize {
+			ret = append(ret, t.rtpPacket(nalu, ts, last))
+			continue
+		}
+
+		// fragmentation units (FU-A)
+		indicator := (nalu[0] & 0xe0) | 28
+		typ := nalu[0] & 0x1f
+		data := nalu[1:]
+		start := true
+		for len(data) > 0 {
+			n := len(data)
+			if n > sourceFileRtpPayloadMaxSize-2 {
+				n = sourceFileRtpPayloadMaxSize - 2
+			}
+			end := (n == len(data))
+
+			header := typ
+			if start {
+				header |= 0x80
+			}
+			if end {
+				header |= 0x40
+			}
+
+			payload := append([]byte{indicator, header}, data[:n]...)
+			ret = append(ret, t.rtpPacket(payload, ts, last && end))
+
+			data = data[n:]
+			start = false
+		}
+	}
+
+	return ret, nil
+}
+
+// aacPackets packetizes a sample in the AAC-hbr mode of RFC 3640, with one
+// access unit per packet
+func (t *sourceFileTrack) aacPackets(sample []byte, ts uint32) ([][]byte, error) {
+	if len(sample) >= 8192 {
+		return nil, fmt.Errorf("AAC frame is too big")
+	}
+
+	payload := make([]byte, 4+len(sample))
+	payload[0] = 0x00
+	payload[1] = 0x10 // AU-headers-length, in bits
+	payload[2] = byte(len(sample) >> 5)
+	payload[3] = byte(len(sample) << 3)
+	copy(payload[4:], sample)
+
+	return [][]byte{t.rtpPacket(payload, ts, true)}, nil
+}
+
+func (t *sourceFileTrack) media(trackId int) *sdp.MediaDescription {
+	pt := strconv.FormatInt(int64(t.payloadType), 10)
+
+	if t.mp4.codec == "avc1" {
+		return &sdp.MediaDescription{
+			MediaName: sdp.MediaName{
+				Media:   "video",
+				Protos:  []string{"RTP", "AVP"},
+				Formats: []string{pt},
+			},
+			Attributes: []sdp.Attribute{
+				{Key: "rtpmap", Value: pt + " H264/90000"},
+				{Key: "fmtp", Value: pt + " packetization-mode=1; " +
+					"sprop-parameter-sets=" + base64.StdEncoding.EncodeToString(t.mp4.sps) +
+					"," + base64.StdEncoding.EncodeToString(t.mp4.pps) + "; " +
+					"profile-level-id=" + strings.ToUpper(hex.EncodeToString(t.mp4.sps[1:4]))},
+			},
+		}
+	}
+
+	return &sdp.MediaDescription{
+		MediaName: sdp.MediaName{
+			Media:   "audio",
+			Protos:  []string{"RTP", "AVP"},
+			Formats: []string{pt},
+		},
+		Attributes: []sdp.Attribute{
+			{Key: "rtpmap", Value: pt + " mpeg4-generic/" + strconv.FormatInt(int64(t.clockRate), 10) +
+				"/" + strconv.FormatInt(int64(t.mp4.channels), 10)},
+			{Key: "fmtp", Value: pt + " profile-level-id=1; mode=AAC-hbr; sizelength=13; " +
+				"indexlength=3; indexdeltalength=3; config=" + hex.EncodeToString(t.mp4.aacConfig)},
+		},
+	}
+}
+
+// durationToTs converts a duration into the clock of a track, without
+// overflows
+func durationToTs(d time.Duration, clockRate int) int64 {
+	return int64(d/time.Second)*int64(clockRate) +
+		int64(d%time.Second)*int64(clockRate)/int64(time.Second)
+}
+
+type sourceFileSample struct {
+	trackId int
+	sample  *mp4Sample
+	dts     time.Duration
+}
+
+// runFile reads a MP4 file in real time and loops it forever
+func (s *source) runFile() bool {
+	s.log("initializing with file %s", s.filePath)
+
+	mf, err := readMp4(s.filePath)
+	if err != nil {
+		s.log("ERR: %s", err)
+		return true
+	}
+
+	for _, codec := range mf.unsupported {
+		s.log("WARN: skipping a track with unsupported codec '%s'", codec)
+	}
+
+	f, err := os.Open(s.filePath)
+	if err != nil {
+		s.log("ERR: %s", err)
+		return true
+	}
+	defer f.Close()
+
+	clientSdpParsed := &sdp.SessionDescription{}
+
+	var tracks []*sourceFileTrack
+	var samples []sourceFileSample
+	var fileDuration time.Duration
+
+	for trackId, mt := range mf.tracks {
+		t := &sourceFileTrack{
+			mp4:         mt,
+			payloadType: uint8(96 + trackId),
+			ssrc:        rand.Uint32(),
+			seq:         uint16(rand.Uint32()),
+		}
+		if mt.codec == "avc1" {
+			t.clockRate = 90000
+		} else {
+			t.clockRate = mt.sampleRate
+		}
+		tracks = append(tracks, t)
+
+		clientSdpParsed.MediaDescriptions = append(clientSdpParsed.MediaDescriptions, t.media(trackId))
+
+		toDuration := func(v int64) time.Duration {
+			return time.Duration(v/int64(mt.timescale))*time.Second +
+				time.Duration(v%int64(mt.timescale))*time.Second/time.Duration(mt.timescale)
+		}
+
+		for i := range mt.samples {
+			samples = append(samples, sourceFileSample{
+				trackId: trackId,
+				sample:  &mt.samples[i],
+				dts:     toDuration(mt.samples[i].dts),
+			})
+		}
+
+		if d := toDuration(mt.duration); d > fileDuration {
+			fileDuration = d
+		}
+	}
+
+	if fileDuration <= 0 {
+		s.log("ERR: the file has no duration")
+		return true
+	}
+
+	// samples are sent in decoding order
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].dts < samples[j].dts
+	})
+
+	serverSdpParsed, serverSdpText := sdpForServer(clientSdpParsed)
+
+	s.clientSdpParsed = clientSdpParsed
+	s.serverSdpText = serverSdpText
+	s.serverSdpParsed = serverSdpParsed
+
+	s.RtcpReceivers = make([]*gortsplib.RtcpReceiver, len(tracks))
+	s.counters = make([]*trackCounters, len(tracks))
+	for trackId := range tracks {
+		s.RtcpReceivers[trackId] = gortsplib.NewRtcpReceiver()
+		s.counters[trackId] = &trackCounters{}
+	}
+
+	s.setState(sourceStateReady)
+	s.p.events <- programEventStreamerReady{s}
+
+	ret := func() bool {
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		<-timer.C
+
+		start := time.Now()
+		var buf []byte
+
+		for loop := 0; ; loop++ {
+			loopStart := time.Duration(loop) * fileDuration
+
+			for _, fs := range samples {
+				t := tracks[fs.trackId]
+
+				timer.Reset(time.Until(start.Add(loopStart + fs.dts)))
+				select {
+				case <-timer.C:
+				case <-s.innerTerminate:
+					return false
+				}
+
+				if cap(buf) < int(fs.sample.size) {
+					buf = make([]byte, fs.sample.size)
+				}
+				buf = buf[:fs.sample.size]
+				_, err := f.ReadAt(buf, fs.sample.offset)
+				if err != nil {
+					s.log("ERR: %s", err)
+					return true
+				}
+
+				ts := uint32(durationToTs(loopStart, t.clockRate) +
+					(fs.sample.dts+int64(fs.sample.cts))*int64(t.clockRate)/int64(t.mp4.timescale))
+
+				var pkts [][]byte
+				if t.mp4.codec == "avc1" {
+					pkts, err = t.h264Packets(buf, fs.sample.sync, ts)
+				} else {
+					pkts, err = t.aacPackets(buf, ts)
+				}
+				if err != nil {
+					s.log("ERR: %s", err)
+					return true
+				}
+
+				for _, pkt := range pkts {
+					s.counters[fs.trackId].onFrameIn(gortsplib.StreamTypeRtp, len(pkt))
+					s.RtcpReceivers[fs.trackId].OnFrame(gortsplib.StreamTypeRtp, pkt)
+					s.p.frames <- programEventStreamerFrame{s, fs.trackId, gortsplib.StreamTypeRtp, pkt}
+				}
+			}
+		}
+	}()
+
+	s.p.events <- programEventStreamerNotReady{s}
+
+	for trackId := range tracks {
+		s.RtcpReceivers[trackId].Close()
+	}
+
+	return ret
+}
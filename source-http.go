@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sourceHttpTunnel is a connection to a RTSP server that is tunneled through
+// HTTP, as described in the Apple QuickTime "Tunneling RTSP and RTP over HTTP"
+// document. Responses and frames are read from a GET request, while requests
+// are sent base64-encoded in the body of a POST request.
+type sourceHttpTunnel struct {
+	getConn  net.Conn
+	getBuf   *bufio.Reader
+	postConn net.Conn
+}
+
+// tlsConfig is used only if the scheme is https
+func dialHttpTunnel(u *url.URL, timeout time.Duration, tlsConfig *tls.Config) (*sourceHttpTunnel, error) {
+	dial := func() (net.Conn, error) {
+		if u.Scheme == "https" {
+			return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", u.Host, tlsConfig)
+		}
+		return net.DialTimeout("tcp", u.Host, timeout)
+	}
+
+	cookie := strconv.FormatUint(uint64(rand.Int63()), 16)
+
+	getConn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	getConn.SetDeadline(time.Now().Add(timeout))
+	_, err = getConn.Write([]byte("GET " + u.RequestURI() + " HTTP/1.0\r\n" +
+		"Host: " + u.Host + "\r\n" +
+		"x-sessioncookie: " + cookie + "\r\n" +
+		"Accept: application/x-rtsp-tunnelled\r\n" +
+		"Pragma: no-cache\r\n" +
+		"Cache-Control: no-cache\r\n" +
+		"\r\n"))
+	if err != nil {
+		getConn.Close()
+		return nil, err
+	}
+
+	getBuf := bufio.NewReaderSize(getConn, 4096)
+	err = readHttpTunnelResponse(getBuf)
+	if err != nil {
+		getConn.Close()
+		return nil, err
+	}
+	getConn.SetDeadline(time.Time{})
+
+	postConn, err := dial()
+	if err != nil {
+		getConn.Close()
+		return nil, err
+	}
+
+	// the body of the POST request never ends, therefore the server doesn't
+	// send any response
+	postConn.SetDeadline(time.Now().Add(timeout))
+	_, err = postConn.Write([]byte("POST " + u.RequestURI() + " HTTP/1.0\r\n" +
+		"Host: " + u.Host + "\r\n" +
+		"x-sessioncookie: " + cookie + "\r\n" +
+		"Content-Type: application/x-rtsp-tunnelled\r\n" +
+		"Pragma: no-cache\r\n" +
+		"Cache-Control: no-cache\r\n" +
+		"Content-Length: 32767\r\n" +
+		"Expires: Sun, 9 Jan 1972 00:00:00 GMT\r\n" +
+		"\r\n"))
+	if err != nil {
+		getConn.Close()
+		postConn.Close()
+		return nil, err
+	}
+	postConn.SetDeadline(time.Time{})
+
+	return &sourceHttpTunnel{
+		getConn:  getConn,
+		getBuf:   getBuf,
+		postConn: postConn,
+	}, nil
+}
+
+func readHttpTunnelResponse(br *bufio.Reader) error {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "HTTP/") {
+		return fmt.Errorf("the server doesn't support RTSP over HTTP (invalid response '%s')", strings.TrimSpace(line))
+	}
+	if parts[1] != "200" {
+		return fmt.Errorf("the server doesn't support RTSP over HTTP (status code %s)", parts[1])
+	}
+
+	contentType := ""
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "Content-Type") {
+			contentType = strings.TrimSpace(kv[1])
+		}
+	}
+
+	if contentType != "application/x-rtsp-tunnelled" {
+		return fmt.Errorf("the server doesn't support RTSP over HTTP (content type '%s')", contentType)
+	}
+
+	return nil
+}
+
+func (t *sourceHttpTunnel) Read(b []byte) (int, error) {
+	return t.getBuf.Read(b)
+}
+
+// each write is encoded separately, since servers decode the body of the
+// POST request in chunks
+func (t *sourceHttpTunnel) Write(b []byte) (int, error) {
+	_, err := t.postConn.Write([]byte(base64.StdEncoding.EncodeToString(b)))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (t *sourceHttpTunnel) Close() error {
+	t.postConn.Close()
+	return t.getConn.Close()
+}
+
+func (t *sourceHttpTunnel) LocalAddr() net.Addr {
+	return t.getConn.LocalAddr()
+}
+
+func (t *sourceHttpTunnel) RemoteAddr() net.Addr {
+	return t.getConn.RemoteAddr()
+}
+
+func (t *sourceHttpTunnel) SetDeadline(d time.Time) error {
+	t.postConn.SetDeadline(d)
+	return t.getConn.SetDeadline(d)
+}
+
+func (t *sourceHttpTunnel) SetReadDeadline(d time.Time) error {
+	return t.getConn.SetReadDeadline(d)
+}
+
+func (t *sourceHttpTunnel) SetWriteDeadline(d time.Time) error {
+	return t.postConn.SetWriteDeadline(d)
+}
@@ -80,8 +80,9 @@ func (l *sourceUdpListener) run() {
 			continue
 		}
 
+		l.source.counters[l.trackId].onFrameIn(l.streamType, n)
 		l.source.RtcpReceivers[l.trackId].OnFrame(l.streamType, buf[:n])
-		l.p.events <- programEventStreamerFrame{l.source, l.trackId, l.streamType, buf[:n]}
+		l.p.frames <- programEventStreamerFrame{l.source, l.trackId, l.streamType, frameBuffers.copy(buf[:n])}
 	}
 
 	close(l.writeChan)
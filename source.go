@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"math/rand"
 	"net"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/aler9/gortsplib"
@@ -12,10 +21,10 @@ import (
 )
 
 const (
-	sourceRetryInterval          = 5 * time.Second
-	sourceCheckStreamInterval    = 5 * time.Second
-	sourceKeepaliveInterval      = 60 * time.Second
-	sourceReceiverReportInterval = 10 * time.Second
+	sourceRetryInterval       = 5 * time.Second
+	sourceCheckStreamInterval = 5 * time.Second
+	sourceKeepaliveInterval   = 60 * time.Second
+	sourceCheckIdleInterval   = 1 * time.Second
 )
 
 type sourceUdpListenerPair struct {
@@ -23,65 +32,309 @@ type sourceUdpListenerPair struct {
 	rtcpl *sourceUdpListener
 }
 
+// sourceChannel is the track and the stream type that are associated with
+// an interleaved channel
+type sourceChannel struct {
+	trackId    int
+	streamType gortsplib.StreamType
+}
+
+// interleavedChannel returns the channel of an interleaved frame, that
+// gortsplib splits into a track id and a stream type
+func interleavedChannel(frame *gortsplib.InterleavedFrame) int {
+	return frame.TrackId*2 + int(frame.StreamType)
+}
+
+// a GET_PARAMETER or SET_PARAMETER request of a reader, that is forwarded
+// to the source
+type sourceParameterRequest struct {
+	req *gortsplib.Request
+	res chan *gortsplib.Response // buffered, receives nil in case of errors
+}
+
+// sourceConn adds custom headers to the requests sent to the source.
+// ConnClient flushes its buffer after each request, therefore the request
+// line is always at the beginning of a write.
+type sourceConn struct {
+	net.Conn
+	header []byte
+}
+
+func (sc *sourceConn) Write(b []byte) (int, error) {
+	i := bytes.Index(b, []byte("\r\n"))
+	if i < 0 || !bytes.HasSuffix(b[:i], []byte(" RTSP/1.0")) {
+		return sc.Conn.Write(b)
+	}
+
+	buf := make([]byte, 0, len(b)+len(sc.header))
+	buf = append(buf, b[:i+2]...)
+	buf = append(buf, sc.header...)
+	buf = append(buf, b[i+2:]...)
+
+	_, err := sc.Conn.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// sourceTlsConfig returns the TLS configuration used to connect to a source.
+// If a fingerprint is provided, the certificate of the source is accepted if
+// its SHA256 hash matches, even if it is self-signed, and refused otherwise.
+// If insecure is true, the certificate is not verified at all.
+// Sources that don't support minVersion are refused during the handshake.
+func sourceTlsConfig(host string, fingerprint []byte, insecure bool, minVersion uint16) *tls.Config {
+	conf := &tls.Config{ServerName: host, MinVersion: minVersion}
+	if insecure {
+		conf.InsecureSkipVerify = true
+		return conf
+	}
+	if fingerprint == nil {
+		return conf
+	}
+
+	// the default verification is replaced by the one of the fingerprint
+	conf.InsecureSkipVerify = true
+	conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("the source didn't provide a certificate")
+		}
+
+		h := sha256.Sum256(rawCerts[0])
+		if !bytes.Equal(h[:], fingerprint) {
+			return fmt.Errorf("the fingerprint of the certificate of the source (%s) doesn't match sourceFingerprint",
+				hex.EncodeToString(h[:]))
+		}
+		return nil
+	}
+	return conf
+}
+
+// sourceSelectTracks returns a copy of a SDP that contains only the medias
+// of the given types, that are the only ones that are setup
+func sourceSelectTracks(sin *sdp.SessionDescription, types []string) *sdp.SessionDescription {
+	sout := *sin
+	sout.MediaDescriptions = nil
+
+	for _, m := range sin.MediaDescriptions {
+		for _, typ := range types {
+			if m.MediaName.Media == typ {
+				sout.MediaDescriptions = append(sout.MediaDescriptions, m)
+				break
+			}
+		}
+	}
+	return &sout
+}
+
+type sourceState int
+
+const (
+	sourceStateStopped sourceState = iota
+	sourceStateConnecting
+	sourceStateReady
+	sourceStateError
+	sourceStateReconnecting
+)
+
+func (ss sourceState) String() string {
+	switch ss {
+	case sourceStateStopped:
+		return "stopped"
+
+	case sourceStateConnecting:
+		return "connecting"
+
+	case sourceStateReady:
+		return "ready"
+
+	case sourceStateError:
+		return "error"
+
+	case sourceStateReconnecting:
+		return "reconnecting"
+	}
+	return "unknown"
+}
+
 type source struct {
+	readerCount     int64 // must be the first field for 64-bit alignment
+	playingCount    int64 // readers that are receiving frames, accessed atomically
 	p               *program
 	path            string
+	pconf           *ConfPath
+	urls            []*sourceUrl // the source and its fallbacks, in order
+	urlIndex        int          // url in use
 	u               *url.URL
+	tunnelUrl       *url.URL
+	tlsConfig       *tls.Config // only if the source uses TLS
+	filePath        string      // only if the source is a file
 	proto           streamProtocol
 	ready           bool
 	clientSdpParsed *sdp.SessionDescription
 	serverSdpText   []byte
 	serverSdpParsed *sdp.SessionDescription
 	RtcpReceivers   []*gortsplib.RtcpReceiver
+	counters        []*trackCounters
 	readBuf         *doubleBuffer
+	header          []byte // custom headers, already serialized
+	state           sourceState
+	channels        map[int]sourceChannel // only if TCP
+	rtcpChannels    []int                 // only if TCP, one per track
+
+	// these are owned by the program
+	describeRequests []chan describeRes
+	reorders         []*reorderBuffer // one per track, only if UDP and enabled
+
+	parameterRequests chan sourceParameterRequest
+	readersChanged    chan struct{} // buffered, notified when playingCount changes
+	start             chan struct{}
+	innerTerminate    chan struct{}
+	innerDone         chan struct{}
+	terminate         chan struct{}
+	done              chan struct{}
+}
 
-	terminate chan struct{}
-	done      chan struct{}
+// sourceUrl is one of the urls of a source, with the informations needed to
+// connect to it
+type sourceUrl struct {
+	u         *url.URL
+	tunnelUrl *url.URL
+	tlsConfig *tls.Config // only if the source uses TLS
+	filePath  string      // only if the source is a file
 }
 
-func newSource(p *program, path string, sourceStr string, sourceProtocol string) (*source, error) {
-	u, err := url.Parse(sourceStr)
+func newSourceUrl(raw string, conf *conf, pconf *ConfPath) (*sourceUrl, error) {
+	u, err := url.Parse(raw)
 	if err != nil {
-		return nil, fmt.Errorf("'%s' is not a valid RTSP url", sourceStr)
+		return nil, fmt.Errorf("'%s' is not a valid RTSP url", redactUrl(raw))
 	}
-	if u.Scheme != "rtsp" {
-		return nil, fmt.Errorf("'%s' is not a valid RTSP url", sourceStr)
-	}
-	if u.Port() == "" {
-		u.Host += ":554"
+
+	var tunnelUrl *url.URL
+	var tlsConfig *tls.Config
+	var filePath string
+	switch u.Scheme {
+	case "rtsp":
+		if u.Port() == "" {
+			u.Host += ":554"
+		}
+
+	case "rtsps":
+		if u.Port() == "" {
+			u.Host += ":322"
+		}
+		tlsConfig = sourceTlsConfig(u.Hostname(), pconf.sourceFingerprintParsed, pconf.SourceInsecureVerify, conf.tlsMinVersionParsed)
+		// the requests sent inside the TLS session use the rtsp scheme,
+		// since some servers reject the other ones
+		u.Scheme = "rtsp"
+
+	case "http", "https":
+		if u.Port() == "" {
+			if u.Scheme == "http" {
+				u.Host += ":80"
+			} else {
+				u.Host += ":443"
+			}
+		}
+		// RTSP over HTTP: the requests sent inside the tunnel use the rtsp scheme
+		tunnelUrl = &url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path, RawQuery: u.RawQuery}
+		if u.Scheme == "https" {
+			tlsConfig = sourceTlsConfig(u.Hostname(), pconf.sourceFingerprintParsed, pconf.SourceInsecureVerify, conf.tlsMinVersionParsed)
+		}
+		u.Scheme = "rtsp"
+
+	case "file":
+		if u.Host != "" || u.Path == "" {
+			return nil, fmt.Errorf("'%s' is not a valid file url, the path must be absolute", redactUrl(raw))
+		}
+		filePath = u.Path
+
+	default:
+		return nil, fmt.Errorf("'%s' is not a valid RTSP url", redactUrl(raw))
 	}
 	if u.User != nil {
 		pass, _ := u.User.Password()
 		user := u.User.Username()
 		if user != "" && pass == "" ||
 			user == "" && pass != "" {
-			fmt.Errorf("username and password must be both provided")
+			return nil, fmt.Errorf("username and password must be both provided")
+		}
+	}
+
+	// credentials are kept out of the url in the configuration, and are
+	// used by the client to authenticate
+	if pconf.SourceUser != "" {
+		u.User = url.UserPassword(pconf.SourceUser, pconf.SourcePass)
+	}
+
+	return &sourceUrl{
+		u:         u,
+		tunnelUrl: tunnelUrl,
+		tlsConfig: tlsConfig,
+		filePath:  filePath,
+	}, nil
+}
+
+func newSource(p *program, path string, pconf *ConfPath) (*source, error) {
+	var urls []*sourceUrl
+	for _, raw := range append([]string{pconf.Source}, pconf.SourceFallbacks...) {
+		su, err := newSourceUrl(raw, p.conf, pconf)
+		if err != nil {
+			return nil, err
 		}
+		urls = append(urls, su)
 	}
+	filePath := urls[0].filePath
 
 	proto, err := func() (streamProtocol, error) {
-		switch sourceProtocol {
+		switch pconf.SourceProtocol {
 		case "udp":
 			return streamProtocolUdp, nil
 
 		case "tcp":
 			return streamProtocolTcp, nil
 		}
-		return streamProtocol(0), fmt.Errorf("unsupported protocol '%s'", sourceProtocol)
+		return streamProtocol(0), fmt.Errorf("unsupported protocol '%s'", pconf.SourceProtocol)
 	}()
 	if err != nil {
 		return nil, err
 	}
 
+	// packets read from files are generated in order, and sourceProtocol
+	// doesn't apply
+	if filePath != "" {
+		proto = streamProtocolTcp
+	}
+
+	var header []byte
+	if len(pconf.SourceHeaders) > 0 {
+		var keys []string
+		for k := range pconf.SourceHeaders {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			header = append(header, []byte(k+": "+pconf.SourceHeaders[k]+"\r\n")...)
+		}
+	}
+
 	s := &source{
-		p:         p,
-		path:      path,
-		u:         u,
-		proto:     proto,
-		readBuf:   newDoubleBuffer(512 * 1024),
-		terminate: make(chan struct{}),
-		done:      make(chan struct{}),
+		p:                 p,
+		path:              path,
+		pconf:             pconf,
+		urls:              urls,
+		filePath:          filePath,
+		proto:             proto,
+		readBuf:           newDoubleBuffer(512 * 1024),
+		header:            header,
+		parameterRequests: make(chan sourceParameterRequest),
+		readersChanged:    make(chan struct{}, 1),
+		start:             make(chan struct{}, 1),
+		terminate:         make(chan struct{}),
+		done:              make(chan struct{}),
 	}
+	s.useUrl(0)
 
 	return s, nil
 }
@@ -102,37 +355,219 @@ func (s *source) publisherSdpParsed() *sdp.SessionDescription {
 	return s.serverSdpParsed
 }
 
+// addPlaying is called by the program when a reader starts or stops
+// receiving frames. It never blocks.
+func (s *source) addPlaying(delta int64) {
+	atomic.AddInt64(&s.playingCount, delta)
+	select {
+	case s.readersChanged <- struct{}{}:
+	default:
+	}
+}
+
+// readersRequest builds the SET_PARAMETER request that tells the source the
+// number of readers that are receiving frames, or returns nil if
+// sourceReadersParameter is not set
+func (s *source) readersRequest() *gortsplib.Request {
+	if s.pconf.SourceReadersParameter == "" {
+		return nil
+	}
+
+	content := []byte(s.pconf.SourceReadersParameter + ": " +
+		strconv.FormatInt(atomic.LoadInt64(&s.playingCount), 10) + "\r\n")
+
+	return &gortsplib.Request{
+		Method: gortsplib.SET_PARAMETER,
+		Url:    s.u,
+		Header: gortsplib.Header{
+			"Content-Type":   []string{"text/parameters"},
+			"Content-Length": []string{strconv.FormatInt(int64(len(content)), 10)},
+		},
+		Content: content,
+	}
+}
+
+// requestStart is called by the program. It never blocks, since the source
+// may be busy sending events to the program.
+func (s *source) requestStart() {
+	select {
+	case s.start <- struct{}{}:
+	default:
+	}
+}
+
+// setState is called by the source when its state changes, and notifies
+// the change to sourceEventsUrl, if set
+func (s *source) setState(state sourceState) {
+	if state == s.state {
+		return
+	}
+	prev := s.state
+	s.state = state
+
+	if s.p.sourceEvents != nil {
+		s.p.sourceEvents.push(sourceEvent{
+			Path:          s.path,
+			State:         state.String(),
+			PreviousState: prev.String(),
+			Url:           redactUrl(s.urlString()),
+			Time:          time.Now().UTC().Format(time.RFC3339),
+		})
+	}
+}
+
 func (s *source) run() {
+	running := false
+	lastActive := time.Now()
+
+	startInner := func() {
+		running = true
+		s.innerTerminate = make(chan struct{})
+		s.innerDone = make(chan struct{})
+		go s.runInner()
+	}
+
+	stopInner := func() {
+		running = false
+		close(s.innerTerminate)
+		<-s.innerDone
+	}
+
+	if !s.pconf.SourceOnDemand {
+		startInner()
+	}
+
+	checkIdleTicker := time.NewTicker(sourceCheckIdleInterval)
+
+outer:
 	for {
+		select {
+		case <-s.start:
+			lastActive = time.Now()
+			if !running {
+				s.log("starting on demand")
+				startInner()
+			}
+
+		case <-checkIdleTicker.C:
+			if !s.pconf.SourceOnDemand || !running {
+				continue
+			}
+
+			if atomic.LoadInt64(&s.readerCount) > 0 {
+				lastActive = time.Now()
+				continue
+			}
+
+			if time.Since(lastActive) >= s.pconf.SourceOnDemandCloseAfter {
+				s.log("stopping since there are no readers")
+				stopInner()
+				s.setState(sourceStateStopped)
+				s.p.events <- programEventSourceStopped{s}
+			}
+
+		case <-s.terminate:
+			break outer
+		}
+	}
+
+	checkIdleTicker.Stop()
+
+	if running {
+		stopInner()
+		s.setState(sourceStateStopped)
+	}
+
+	close(s.done)
+}
+
+func (s *source) runInner() {
+outer:
+	for {
+		if s.state == sourceStateStopped {
+			s.setState(sourceStateConnecting)
+		} else {
+			s.setState(sourceStateReconnecting)
+		}
+
 		ok := s.do()
 		if !ok {
 			break
 		}
+		s.setState(sourceStateError)
+
+		// fail over to the next url. The retry interval is applied only once
+		// all the urls have been tried
+		if len(s.urls) > 1 {
+			s.useUrl((s.urlIndex + 1) % len(s.urls))
+			s.log("failing over to %s", redactUrl(s.urlString()))
+			if s.urlIndex != 0 {
+				select {
+				case <-s.innerTerminate:
+					break outer
+				default:
+				}
+				continue
+			}
+		}
 
 		t := time.NewTimer(sourceRetryInterval)
 		select {
-		case <-s.terminate:
-			break
+		case <-s.innerTerminate:
+			t.Stop()
+			break outer
 		case <-t.C:
 		}
 	}
 
-	close(s.done)
+	close(s.innerDone)
+}
+
+func (s *source) useUrl(i int) {
+	s.urlIndex = i
+	s.u = s.urls[i].u
+	s.tunnelUrl = s.urls[i].tunnelUrl
+	s.tlsConfig = s.urls[i].tlsConfig
+}
+
+// urlString returns the url in use as it appears in the configuration
+func (s *source) urlString() string {
+	if s.urlIndex == 0 {
+		return s.pconf.Source
+	}
+	return s.pconf.SourceFallbacks[s.urlIndex-1]
 }
 
 func (s *source) do() bool {
+	if s.filePath != "" {
+		return s.runFile()
+	}
+
 	s.log("initializing with protocol %s", s.proto)
+	if s.tlsConfig != nil && s.pconf.SourceInsecureVerify {
+		s.log("WARN: the certificate of the source is not verified (sourceInsecureVerify is enabled), " +
+			"the connection is not protected against man-in-the-middle attacks")
+	}
 
 	var nconn net.Conn
 	var err error
 	dialDone := make(chan struct{})
 	go func() {
-		nconn, err = net.DialTimeout("tcp", s.u.Host, s.p.conf.ReadTimeout)
+		switch {
+		case s.tunnelUrl != nil:
+			nconn, err = dialHttpTunnel(s.tunnelUrl, s.p.conf.ReadTimeout, s.tlsConfig)
+
+		case s.tlsConfig != nil:
+			nconn, err = tls.DialWithDialer(&net.Dialer{Timeout: s.p.conf.ReadTimeout}, "tcp", s.u.Host, s.tlsConfig)
+
+		default:
+			nconn, err = net.DialTimeout("tcp", s.u.Host, s.p.conf.ReadTimeout)
+		}
 		close(dialDone)
 	}()
 
 	select {
-	case <-s.terminate:
+	case <-s.innerTerminate:
 		return false
 	case <-dialDone:
 	}
@@ -143,6 +578,10 @@ func (s *source) do() bool {
 	}
 	defer nconn.Close()
 
+	if s.header != nil {
+		nconn = &sourceConn{nconn, s.header}
+	}
+
 	conn := gortsplib.NewConnClient(gortsplib.ConnClientConf{
 		Conn:         nconn,
 		ReadTimeout:  s.p.conf.ReadTimeout,
@@ -161,6 +600,14 @@ func (s *source) do() bool {
 		return true
 	}
 
+	if len(s.pconf.SourceTracks) > 0 {
+		clientSdpParsed = sourceSelectTracks(clientSdpParsed, s.pconf.SourceTracks)
+		if len(clientSdpParsed.MediaDescriptions) == 0 {
+			s.log("ERR: the source doesn't have any track of the types in sourceTracks")
+			return true
+		}
+	}
+
 	// create a filtered SDP that is used by the server (not by the client)
 	serverSdpParsed, serverSdpText := sdpForServer(clientSdpParsed)
 
@@ -217,7 +664,7 @@ func (s *source) runUdp(conn *gortsplib.ConnClient) bool {
 			}
 		}()
 
-		rtpServerPort, rtcpServerPort, _, err := conn.SetupUdp(s.u, media, rtpPort, rtcpPort)
+		rtpServerPort, rtcpServerPort, err := s.setupUdp(conn, media, rtpPort, rtcpPort)
 		if err != nil {
 			s.log("ERR: %s", err)
 			rtpl.close()
@@ -241,8 +688,10 @@ func (s *source) runUdp(conn *gortsplib.ConnClient) bool {
 	}
 
 	s.RtcpReceivers = make([]*gortsplib.RtcpReceiver, len(s.clientSdpParsed.MediaDescriptions))
+	s.counters = make([]*trackCounters, len(s.clientSdpParsed.MediaDescriptions))
 	for trackId := range s.clientSdpParsed.MediaDescriptions {
 		s.RtcpReceivers[trackId] = gortsplib.NewRtcpReceiver()
+		s.counters[trackId] = &trackCounters{}
 	}
 
 	for _, pair := range sourceUdpListenerPairs {
@@ -252,19 +701,36 @@ func (s *source) runUdp(conn *gortsplib.ConnClient) bool {
 
 	sendKeepaliveTicker := time.NewTicker(sourceKeepaliveInterval)
 	checkStreamTicker := time.NewTicker(sourceCheckStreamInterval)
-	receiverReportTicker := time.NewTicker(sourceReceiverReportInterval)
+	receiverReportTicker := time.NewTicker(s.pconf.RtcpInterval)
 
+	s.setState(sourceStateReady)
 	s.p.events <- programEventStreamerReady{s}
 
+	// the source is told the number of readers as soon as it's ready
+	s.addPlaying(0)
+
 	var ret bool
 
 outer:
 	for {
 		select {
-		case <-s.terminate:
+		case <-s.innerTerminate:
 			ret = false
 			break outer
 
+		case <-s.readersChanged:
+			req := s.readersRequest()
+			if req == nil {
+				continue
+			}
+
+			_, err := conn.Do(req)
+			if err != nil {
+				s.log("ERR: %s", err)
+				ret = true
+				break outer
+			}
+
 		case <-sendKeepaliveTicker.C:
 			_, err := conn.Options(s.u)
 			if err != nil {
@@ -273,9 +739,19 @@ outer:
 				break outer
 			}
 
+		case preq := <-s.parameterRequests:
+			res, err := conn.Do(s.parameterRequest(preq.req))
+			if err != nil {
+				s.log("ERR: %s", err)
+				preq.res <- nil
+				ret = true
+				break outer
+			}
+			preq.res <- res
+
 		case <-checkStreamTicker.C:
 			for trackId := range s.clientSdpParsed.MediaDescriptions {
-				if time.Since(s.RtcpReceivers[trackId].LastFrameTime()) >= s.p.conf.StreamDeadAfter {
+				if time.Since(s.RtcpReceivers[trackId].LastFrameTime()) >= s.pconf.PublishTimeout {
 					s.log("ERR: stream is dead")
 					ret = true
 					break outer
@@ -283,8 +759,9 @@ outer:
 			}
 
 		case <-receiverReportTicker.C:
+			readersLoss := s.p.readersLoss(s.path)
 			for trackId := range s.clientSdpParsed.MediaDescriptions {
-				frame := s.RtcpReceivers[trackId].Report()
+				frame := receiverReport(s.RtcpReceivers[trackId], trackId, readersLoss)
 				sourceUdpListenerPairs[trackId].rtcpl.writeChan <- &udpAddrBufPair{
 					addr: &net.UDPAddr{
 						IP:   conn.NetConn().RemoteAddr().(*net.TCPAddr).IP,
@@ -316,12 +793,28 @@ outer:
 }
 
 func (s *source) runTcp(conn *gortsplib.ConnClient) bool {
+	s.channels = make(map[int]sourceChannel)
+	s.rtcpChannels = make([]int, len(s.clientSdpParsed.MediaDescriptions))
+
 	for i, media := range s.clientSdpParsed.MediaDescriptions {
-		_, err := conn.SetupTcp(s.u, media, i)
+		rtpChannel, rtcpChannel, err := s.setupTcp(conn, media, i)
 		if err != nil {
 			s.log("ERR: %s", err)
 			return true
 		}
+
+		if _, ok := s.channels[rtpChannel]; ok {
+			s.log("ERR: interleaved channel %d is used by multiple tracks", rtpChannel)
+			return true
+		}
+		if _, ok := s.channels[rtcpChannel]; ok || rtcpChannel == rtpChannel {
+			s.log("ERR: interleaved channel %d is used by multiple tracks", rtcpChannel)
+			return true
+		}
+
+		s.channels[rtpChannel] = sourceChannel{i, gortsplib.StreamTypeRtp}
+		s.channels[rtcpChannel] = sourceChannel{i, gortsplib.StreamTypeRtcp}
+		s.rtcpChannels[i] = rtcpChannel
 	}
 
 	_, err := conn.Play(s.u)
@@ -331,42 +824,69 @@ func (s *source) runTcp(conn *gortsplib.ConnClient) bool {
 	}
 
 	s.RtcpReceivers = make([]*gortsplib.RtcpReceiver, len(s.clientSdpParsed.MediaDescriptions))
+	s.counters = make([]*trackCounters, len(s.clientSdpParsed.MediaDescriptions))
 	for trackId := range s.clientSdpParsed.MediaDescriptions {
 		s.RtcpReceivers[trackId] = gortsplib.NewRtcpReceiver()
+		s.counters[trackId] = &trackCounters{}
 	}
 
+	s.setState(sourceStateReady)
 	s.p.events <- programEventStreamerReady{s}
 
+	// the source is told the number of readers as soon as it's ready
+	s.addPlaying(0)
+
 	frame := &gortsplib.InterleavedFrame{}
 
+	// responses to parameter requests are interleaved with frames
+	chanResponse := make(chan *gortsplib.Response, 1)
+
 	chanConnError := make(chan struct{})
 	go func() {
 		for {
 			frame.Content = s.readBuf.swap()
 			frame.Content = frame.Content[:cap(frame.Content)]
 
-			err := conn.ReadFrame(frame)
+			recv, err := conn.ReadFrameOrResponse(frame)
 			if err != nil {
 				s.log("ERR: %s", err)
 				close(chanConnError)
 				break
 			}
 
-			s.RtcpReceivers[frame.TrackId].OnFrame(frame.StreamType, frame.Content)
-			s.p.events <- programEventStreamerFrame{s, frame.TrackId, frame.StreamType, frame.Content}
+			switch recvt := recv.(type) {
+			case *gortsplib.InterleavedFrame:
+				// frames on channels that have not been setup are discarded
+				ch, ok := s.channels[interleavedChannel(frame)]
+				if !ok {
+					continue
+				}
+
+				s.counters[ch.trackId].onFrameIn(ch.streamType, len(frame.Content))
+				s.RtcpReceivers[ch.trackId].OnFrame(ch.streamType, frame.Content)
+				s.p.frames <- programEventStreamerFrame{s, ch.trackId, ch.streamType, frameBuffers.copy(frame.Content)}
+
+			case *gortsplib.Response:
+				// discard responses that are not expected anymore
+				select {
+				case chanResponse <- recvt:
+				default:
+				}
+			}
 		}
 	}()
 
-	// a ticker to check the stream is not needed since there's already a deadline
-	// on the RTSP reads
-	receiverReportTicker := time.NewTicker(sourceReceiverReportInterval)
+	// the deadline on the RTSP reads is not enough, since RTCP packets
+	// keep the connection alive even when RTP packets have stopped
+	checkStreamTicker := time.NewTicker(sourceCheckStreamInterval)
+	receiverReportTicker := time.NewTicker(s.pconf.RtcpInterval)
 
 	var ret bool
 
 outer:
 	for {
 		select {
-		case <-s.terminate:
+		case <-s.innerTerminate:
 			ret = false
 			break outer
 
@@ -374,19 +894,85 @@ outer:
 			ret = true
 			break outer
 
+		case <-s.readersChanged:
+			req := s.readersRequest()
+			if req == nil {
+				continue
+			}
+
+			// the response is read, in order not to be mistaken for the one
+			// of a parameter request
+			req.SkipResponse = true
+			_, err := conn.Do(req)
+			if err != nil {
+				s.log("ERR: %s", err)
+				conn.NetConn().Close()
+				<-chanConnError
+				ret = true
+				break outer
+			}
+
+			select {
+			case <-chanResponse:
+			case <-time.After(s.p.conf.ReadTimeout):
+			case <-chanConnError:
+				ret = true
+				break outer
+			}
+
+		case preq := <-s.parameterRequests:
+			req := s.parameterRequest(preq.req)
+			req.SkipResponse = true
+			_, err := conn.Do(req)
+			if err != nil {
+				s.log("ERR: %s", err)
+				preq.res <- nil
+				conn.NetConn().Close()
+				<-chanConnError
+				ret = true
+				break outer
+			}
+
+			select {
+			case res := <-chanResponse:
+				preq.res <- res
+
+			case <-time.After(s.p.conf.ReadTimeout):
+				preq.res <- nil
+
+			case <-chanConnError:
+				preq.res <- nil
+				ret = true
+				break outer
+			}
+
+		case <-checkStreamTicker.C:
+			for trackId := range s.clientSdpParsed.MediaDescriptions {
+				if time.Since(s.RtcpReceivers[trackId].LastFrameTime()) >= s.pconf.PublishTimeout {
+					s.log("ERR: stream is dead")
+					conn.NetConn().Close()
+					<-chanConnError
+					ret = true
+					break outer
+				}
+			}
+
 		case <-receiverReportTicker.C:
+			readersLoss := s.p.readersLoss(s.path)
 			for trackId := range s.clientSdpParsed.MediaDescriptions {
-				frame := s.RtcpReceivers[trackId].Report()
+				frame := receiverReport(s.RtcpReceivers[trackId], trackId, readersLoss)
 
+				// the channel is split like gortsplib does when reading
 				conn.WriteFrame(&gortsplib.InterleavedFrame{
-					TrackId:    trackId,
-					StreamType: gortsplib.StreamTypeRtcp,
+					TrackId:    s.rtcpChannels[trackId] / 2,
+					StreamType: gortsplib.StreamType(s.rtcpChannels[trackId] % 2),
 					Content:    frame,
 				})
 			}
 		}
 	}
 
+	checkStreamTicker.Stop()
 	receiverReportTicker.Stop()
 
 	s.p.events <- programEventStreamerNotReady{s}
@@ -398,6 +984,137 @@ outer:
 	return ret
 }
 
+// trackUrl returns the url of a track, that is built with the control
+// attribute of its media, like gortsplib does
+func (s *source) trackUrl(media *sdp.MediaDescription) *url.URL {
+	control, _ := media.Attribute("control")
+	switch {
+	case control == "":
+		return s.u
+
+	case strings.HasPrefix(control, "rtsp://"):
+		cu, err := url.Parse(control)
+		if err != nil {
+			return s.u
+		}
+		return &url.URL{
+			Scheme:   "rtsp",
+			Host:     s.u.Host,
+			User:     s.u.User,
+			Path:     cu.Path,
+			RawQuery: cu.RawQuery,
+		}
+	}
+
+	path := s.u.Path
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	return &url.URL{
+		Scheme:   "rtsp",
+		Host:     s.u.Host,
+		User:     s.u.User,
+		Path:     path + control,
+		RawQuery: s.u.RawQuery,
+	}
+}
+
+// setup sends a SETUP request and returns the Transport header of the
+// response
+func (s *source) setup(conn *gortsplib.ConnClient, media *sdp.MediaDescription, transport string) (gortsplib.HeaderTransport, error) {
+	res, err := conn.Do(&gortsplib.Request{
+		Method: gortsplib.SETUP,
+		Url:    s.trackUrl(media),
+		Header: gortsplib.Header{
+			"Transport": []string{transport},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != gortsplib.StatusOK {
+		return nil, fmt.Errorf("SETUP: bad status code: %d (%s)", res.StatusCode, res.StatusMessage)
+	}
+
+	tsRaw, ok := res.Header["Transport"]
+	if !ok || len(tsRaw) != 1 {
+		return nil, fmt.Errorf("SETUP: transport header not provided")
+	}
+
+	return readSourceTransport(tsRaw[0]), nil
+}
+
+// setupUdp setups a track with the UDP transport and returns the ports of
+// the server. A single server port is accepted, in which case RTCP uses the
+// next one
+func (s *source) setupUdp(conn *gortsplib.ConnClient, media *sdp.MediaDescription, rtpPort int, rtcpPort int) (int, int, error) {
+	th, err := s.setup(conn, media, fmt.Sprintf("RTP/AVP/UDP;unicast;client_port=%d-%d", rtpPort, rtcpPort))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rtpServerPort, rtcpServerPort := readTransportPorts(th, "server_port")
+	if rtpServerPort == 0 {
+		return 0, 0, fmt.Errorf("SETUP: server ports not provided")
+	}
+
+	return rtpServerPort, rtcpServerPort, nil
+}
+
+// setupTcp setups a track with the TCP transport and returns the interleaved
+// channels of its RTP and RTCP packets. The channels of the response are
+// used, even if they are not the requested ones; they are ignored if
+// sourceInterleavedChannels is set
+func (s *source) setupTcp(conn *gortsplib.ConnClient, media *sdp.MediaDescription, trackId int) (int, int, error) {
+	rtpChannel := trackId * 2
+	forced := trackId < len(s.pconf.SourceInterleavedChannels)
+	if forced {
+		rtpChannel = s.pconf.SourceInterleavedChannels[trackId]
+	}
+	rtcpChannel := rtpChannel + 1
+
+	th, err := s.setup(conn, media, fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", rtpChannel, rtcpChannel))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if forced {
+		return rtpChannel, rtcpChannel, nil
+	}
+
+	// servers that don't return the channels use the requested ones
+	v := th.GetValue("interleaved")
+	if v == "" {
+		return rtpChannel, rtcpChannel, nil
+	}
+
+	resRtpChannel, resRtcpChannel, ok := parseTransportRange(v, 255)
+	if !ok {
+		return 0, 0, fmt.Errorf("SETUP: invalid interleaved channels (%s)", v)
+	}
+	return resRtpChannel, resRtcpChannel, nil
+}
+
+// parameterRequest builds the request that is sent to the source from the
+// request of a reader
+func (s *source) parameterRequest(req *gortsplib.Request) *gortsplib.Request {
+	header := gortsplib.Header{}
+	if ct, ok := req.Header["Content-Type"]; ok {
+		header["Content-Type"] = ct
+	}
+	if len(req.Content) > 0 {
+		header["Content-Length"] = []string{strconv.FormatInt(int64(len(req.Content)), 10)}
+	}
+
+	return &gortsplib.Request{
+		Method:  req.Method,
+		Url:     s.u,
+		Header:  header,
+		Content: req.Content,
+	}
+}
+
 func (s *source) close() {
 	close(s.terminate)
 	<-s.done
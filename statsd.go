@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+type statsdExporter struct {
+	p     *program
+	nconn net.Conn
+
+	terminate chan struct{}
+	done      chan struct{}
+}
+
+func newStatsdExporter(p *program) (*statsdExporter, error) {
+	nconn, err := net.Dial("udp", p.conf.StatsdAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &statsdExporter{
+		p:         p,
+		nconn:     nconn,
+		terminate: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	e.log("sending metrics to %s every %s", p.conf.StatsdAddress, p.conf.StatsdInterval)
+	return e, nil
+}
+
+func (e *statsdExporter) log(format string, args ...interface{}) {
+	e.p.log("[StatsD exporter] "+format, args...)
+}
+
+func (e *statsdExporter) run() {
+	ticker := time.NewTicker(e.p.conf.StatsdInterval)
+	defer ticker.Stop()
+
+outer:
+	for {
+		select {
+		case <-ticker.C:
+			clients, publishers, readers := e.p.stats.get()
+			bytesOut := e.p.stats.getBytesOut()
+
+			var buf bytes.Buffer
+			for _, m := range []struct {
+				name  string
+				value int64
+			}{
+				{"clients", clients},
+				{"publishers", publishers},
+				{"readers", readers},
+				{"bytes_out", bytesOut},
+			} {
+				fmt.Fprintf(&buf, "%s.%s:%d|g\n", e.p.conf.StatsdPrefix, m.name, m.value)
+			}
+
+			e.nconn.SetWriteDeadline(time.Now().Add(e.p.conf.WriteTimeout))
+			_, err := e.nconn.Write(buf.Bytes())
+			if err != nil {
+				e.log("ERR: %s", err)
+			}
+
+		case <-e.terminate:
+			break outer
+		}
+	}
+
+	e.nconn.Close()
+
+	close(e.done)
+}
+
+func (e *statsdExporter) close() {
+	close(e.terminate)
+	<-e.done
+}
@@ -0,0 +1,57 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// setListenBacklog changes the size of the queue of the connections that
+// have not been accepted yet. Calling listen() on a socket that is already
+// listening updates its backlog.
+func setListenBacklog(l *net.TCPListener, backlog int) error {
+	rc, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var lerr error
+	err = rc.Control(func(fd uintptr) {
+		lerr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return lerr
+}
+
+// tcpWriteBufferSize returns the size of the send buffer of a TCP connection,
+// as applied by the kernel
+func tcpWriteBufferSize(nconn *net.TCPConn) (int, bool) {
+	rc, err := nconn.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+
+	var size int
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		size, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+	if err != nil || serr != nil {
+		return 0, false
+	}
+	return size, true
+}
+
+// openFilesLimit returns the soft limit of open file descriptors
+func openFilesLimit() (uint64, bool) {
+	var rl syscall.Rlimit
+	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl)
+	if err != nil {
+		return 0, false
+	}
+	return uint64(rl.Cur), true
+}
@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"net"
+)
+
+// the backlog can't be changed after the socket has been created on Windows
+func setListenBacklog(l *net.TCPListener, backlog int) error {
+	return nil
+}
+
+// the size of the send buffer is not read back on Windows
+func tcpWriteBufferSize(nconn *net.TCPConn) (int, bool) {
+	return 0, false
+}
+
+// Windows doesn't have a limit of open file descriptors
+func openFilesLimit() (uint64, bool) {
+	return 0, false
+}
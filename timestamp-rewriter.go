@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+const (
+	// differences between the RTP timestamps and the clock of the server that
+	// are bigger than this are considered discontinuities
+	timestampRewriterMaxDrift = 5 * time.Second
+)
+
+// timestampRewriter replaces the RTP timestamps of a track of a publisher with
+// ones that are based on the clock of the server. Timestamps of a publisher
+// are shifted by a constant offset, in order to preserve their differences,
+// that is computed again when the timestamps are discontinuous. A rewriter
+// is created for each publisher, therefore timestamps stay continuous when
+// the publisher of a path changes. RTP timestamps of sender reports are
+// shifted too. It is owned by the program.
+type timestampRewriter struct {
+	clockRate int
+	start     time.Time // time at which the server timestamps are zero
+
+	synced   bool
+	offset   uint32
+	lastIn   uint32
+	lastTime time.Time
+	buf      []byte
+}
+
+func newTimestampRewriter(clockRate int, start time.Time) *timestampRewriter {
+	return &timestampRewriter{
+		clockRate: clockRate,
+		start:     start,
+	}
+}
+
+// serverTimestamp returns the timestamp of the server clock at the given time
+func (tr *timestampRewriter) serverTimestamp(now time.Time) uint32 {
+	d := now.Sub(tr.start)
+	return uint32(uint64(d/time.Second)*uint64(tr.clockRate) +
+		uint64(d%time.Second)*uint64(tr.clockRate)/uint64(time.Second))
+}
+
+// rewriteRtp returns the packet with the new timestamp. The returned buffer is
+// reused by the next call.
+func (tr *timestampRewriter) rewriteRtp(frame []byte, now time.Time) []byte {
+	if len(frame) < 12 {
+		return frame
+	}
+	in := binary.BigEndian.Uint32(frame[4:8])
+
+	if tr.synced {
+		// compare the elapsed time according to the timestamps with the
+		// one according to the server
+		elapsed := time.Duration(int32(in-tr.lastIn)) * time.Second / time.Duration(tr.clockRate)
+		drift := elapsed - now.Sub(tr.lastTime)
+		if drift > timestampRewriterMaxDrift || drift < -timestampRewriterMaxDrift {
+			tr.synced = false
+		}
+	}
+
+	if !tr.synced {
+		tr.synced = true
+		tr.offset = tr.serverTimestamp(now) - in
+	}
+	tr.lastIn = in
+	tr.lastTime = now
+
+	tr.buf = append(tr.buf[:0], frame...)
+	binary.BigEndian.PutUint32(tr.buf[4:8], in+tr.offset)
+	return tr.buf
+}
+
+// rewriteRtcp shifts the RTP timestamps of the sender reports of a compound
+// packet. Packets are dropped until the first RTP packet, since the offset is
+// unknown.
+func (tr *timestampRewriter) rewriteRtcp(frame []byte) []byte {
+	pkts, err := rtcp.Unmarshal(frame)
+	if err != nil {
+		return nil
+	}
+
+	found := false
+	for _, pkt := range pkts {
+		if sr, ok := pkt.(*rtcp.SenderReport); ok {
+			if !tr.synced {
+				return nil
+			}
+			sr.RTPTime += tr.offset
+			found = true
+		}
+	}
+	if !found {
+		return frame
+	}
+
+	byts, err := rtcp.Marshal(pkts)
+	if err != nil {
+		return nil
+	}
+	return byts
+}
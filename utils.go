@@ -1,10 +1,20 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 
+	"github.com/aler9/gortsplib"
+	"github.com/pion/rtcp"
 	"github.com/pion/sdp"
 )
 
@@ -32,6 +42,266 @@ func parseIpCidrList(in []string) ([]interface{}, error) {
 	return ret, nil
 }
 
+// return the first IPv4 address of an interface or, if there's none,
+// its first IPv6 address
+func interfaceIp(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find interface '%s': %s", name, err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP, nil
+		}
+
+		if ret == nil {
+			ret = ipnet.IP
+		}
+	}
+
+	if ret == nil {
+		return nil, fmt.Errorf("interface '%s' has no IP addresses", name)
+	}
+	return ret, nil
+}
+
+// checkPathName rejects requested path names that could cause surprises
+// when they are used as keys or inside file names
+func checkPathName(name string, allowed *regexp.Regexp) error {
+	if name == "." || strings.Contains(name, "..") {
+		return fmt.Errorf("path '%s' can't contain '..'", name)
+	}
+
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("path can't contain control characters")
+		}
+	}
+
+	if allowed != nil && !allowed.MatchString(name) {
+		return fmt.Errorf("path '%s' doesn't match allowedPathRegexp", name)
+	}
+
+	return nil
+}
+
+// isPathPattern returns whether the name of a path in the configuration is a
+// regular expression or a glob, instead of the name of a single path
+func isPathPattern(name string) bool {
+	return strings.HasPrefix(name, "~") || strings.ContainsAny(name, "*?")
+}
+
+// globToRegexp converts a glob into a regular expression. '*' matches any
+// sequence of characters except '/', '?' matches a single character except '/'
+func globToRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// readTokenSignature returns the signature of a read token, that is the
+// HMAC-SHA256 of '<path>:<expiry>' with the secret, in hex format
+func readTokenSignature(secret string, path string, expiry int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(path + ":" + strconv.FormatInt(expiry, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkReadToken validates a token in the format '<expiry>-<signature>',
+// where expiry is a unix timestamp in seconds
+func checkReadToken(secret string, path string, token string, now time.Time) error {
+	parts := strings.SplitN(token, "-", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid token")
+	}
+
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid token")
+	}
+
+	if !hmac.Equal([]byte(parts[1]), []byte(readTokenSignature(secret, path, expiry))) {
+		return fmt.Errorf("invalid token signature")
+	}
+
+	if now.Unix() >= expiry {
+		return fmt.Errorf("token has expired")
+	}
+
+	return nil
+}
+
+var urlPasswordRegexp = regexp.MustCompile("^([a-zA-Z][a-zA-Z0-9+.-]*://[^:@/]*:)[^@/]*@")
+
+// redactUrl hides the password of an url, in order to print it in logs
+// and errors. The url is not parsed, since it can be invalid
+func redactUrl(u string) string {
+	return urlPasswordRegexp.ReplaceAllString(u, "${1}xxxxx@")
+}
+
+// readHeaderTransport parses a Transport header, ignoring the spaces that
+// some clients put around the separators
+func readHeaderTransport(in string) gortsplib.HeaderTransport {
+	th := make(gortsplib.HeaderTransport)
+	for _, t := range strings.Split(in, ";") {
+		t = strings.TrimSpace(t)
+		if t != "" {
+			th[t] = struct{}{}
+		}
+	}
+	return th
+}
+
+// readSourceTransport parses the Transport header of a response to a SETUP
+// of a source. Since some servers don't comply with RFC 2326, parsing is more
+// tolerant than the one of requests: only the first transport is used when
+// many are listed, and the names of the parameters are lowercased.
+func readSourceTransport(in string) gortsplib.HeaderTransport {
+	in = strings.SplitN(in, ",", 2)[0]
+
+	th := make(gortsplib.HeaderTransport)
+	for t := range readHeaderTransport(in) {
+		if i := strings.Index(t, "="); i >= 0 {
+			t = strings.ToLower(strings.TrimSpace(t[:i])) + "=" + strings.Trim(strings.TrimSpace(t[i+1:]), "\"")
+		}
+		th[t] = struct{}{}
+	}
+	return th
+}
+
+// parseTransportRange parses a range like 5000-5001 or a single value like
+// 5000, in which case the second value is the next one
+func parseTransportRange(val string, max uint64) (int, int, bool) {
+	parts := strings.Split(val, "-")
+	if len(parts) > 2 {
+		return 0, 0, false
+	}
+
+	var vals []int
+	for _, part := range parts {
+		v, err := strconv.ParseUint(part, 10, 64)
+		if err != nil || v > max {
+			return 0, 0, false
+		}
+		vals = append(vals, int(v))
+	}
+
+	if len(vals) == 1 {
+		if uint64(vals[0]) == max {
+			return 0, 0, false
+		}
+		return vals[0], vals[0] + 1, true
+	}
+
+	return vals[0], vals[1], true
+}
+
+// readTransportPorts reads the port pair of a Transport header field.
+// Zeros are returned if the field is missing or invalid.
+func readTransportPorts(th gortsplib.HeaderTransport, key string) (int, int) {
+	rtpPort, rtcpPort, ok := parseTransportRange(th.GetValue(key), 65535)
+	if !ok || rtpPort == 0 || rtcpPort == 0 {
+		return 0, 0
+	}
+	return rtpPort, rtcpPort
+}
+
+// readSetupTrackId returns the id of the track that is requested by a SETUP
+// of a reader, in the form path/trackID=N, or -1 if the url doesn't contain
+// it, that means that the first track that has not been setup is requested
+func readSetupTrackId(urlPath string, path string) int {
+	rest := strings.TrimPrefix(strings.TrimPrefix(urlPath, "/"), path)
+	rest = strings.TrimPrefix(rest, "/")
+	if !strings.HasPrefix(rest, "trackID=") {
+		return -1
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSuffix(rest[len("trackID="):], "/"), 10, 31)
+	if err != nil {
+		return -1
+	}
+	return int(id)
+}
+
+func headerTransportUdp(clientRtpPort int, clientRtcpPort int, serverRtpPort int, serverRtcpPort int) string {
+	return strings.Join([]string{
+		"RTP/AVP/UDP",
+		"unicast",
+		fmt.Sprintf("client_port=%d-%d", clientRtpPort, clientRtcpPort),
+		fmt.Sprintf("server_port=%d-%d", serverRtpPort, serverRtcpPort),
+	}, ";")
+}
+
+func headerTransportTcp(trackId int) string {
+	return strings.Join([]string{
+		"RTP/AVP/TCP",
+		"unicast",
+		fmt.Sprintf("interleaved=%d-%d", trackId*2, trackId*2+1),
+	}, ";")
+}
+
+// logDedup allows a message to be logged once per key within an interval.
+// It can be used by multiple goroutines.
+type logDedup struct {
+	interval    time.Duration
+	mutex       sync.Mutex
+	last        map[string]time.Time
+	lastCleanup time.Time
+}
+
+func newLogDedup(interval time.Duration) *logDedup {
+	return &logDedup{
+		interval:    interval,
+		last:        make(map[string]time.Time),
+		lastCleanup: time.Now(),
+	}
+}
+
+func (ld *logDedup) allow(key string) bool {
+	ld.mutex.Lock()
+	defer ld.mutex.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(ld.lastCleanup) >= ld.interval {
+		for k, t := range ld.last {
+			if now.Sub(t) >= ld.interval {
+				delete(ld.last, k)
+			}
+		}
+		ld.lastCleanup = now
+	}
+
+	if t, ok := ld.last[key]; ok && now.Sub(t) < ld.interval {
+		return false
+	}
+	ld.last[key] = now
+	return true
+}
+
 func ipEqualOrInRange(ip net.IP, ips []interface{}) bool {
 	for _, item := range ips {
 		switch titem := item.(type) {
@@ -73,6 +343,129 @@ func (db *doubleBuffer) swap() []byte {
 	return ret
 }
 
+// frameBufferPool contains the buffers of the frames that are queued to the
+// program and to TCP readers. Frames are copied into them, since the read
+// buffers of publishers and sources are reused as soon as the frames are queued.
+type frameBufferPool struct {
+	pool sync.Pool
+}
+
+var frameBuffers = &frameBufferPool{}
+
+func (fp *frameBufferPool) copy(frame []byte) []byte {
+	buf, _ := fp.pool.Get().([]byte)
+	if cap(buf) < len(frame) {
+		size := 2048
+		if len(frame) > size {
+			size = len(frame)
+		}
+		buf = make([]byte, size)
+	}
+	buf = buf[:len(frame)]
+	copy(buf, frame)
+	return buf
+}
+
+func (fp *frameBufferPool) put(buf []byte) {
+	fp.pool.Put(buf[:cap(buf)])
+}
+
+// rtcpFractionLost returns the fraction lost of the first report block of a
+// RTCP compound packet
+func rtcpFractionLost(buf []byte) (uint8, bool) {
+	pkts, err := rtcp.Unmarshal(buf)
+	if err != nil {
+		return 0, false
+	}
+
+	for _, pkt := range pkts {
+		switch tpkt := pkt.(type) {
+		case *rtcp.ReceiverReport:
+			if len(tpkt.Reports) > 0 {
+				return tpkt.Reports[0].FractionLost, true
+			}
+
+		case *rtcp.SenderReport:
+			if len(tpkt.Reports) > 0 {
+				return tpkt.Reports[0].FractionLost, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// rtcpReportSsrc returns the source SSRC of the first report block of a RTCP
+// compound packet
+func rtcpReportSsrc(buf []byte) (uint32, bool) {
+	pkts, err := rtcp.Unmarshal(buf)
+	if err != nil {
+		return 0, false
+	}
+
+	for _, pkt := range pkts {
+		switch tpkt := pkt.(type) {
+		case *rtcp.ReceiverReport:
+			if len(tpkt.Reports) > 0 {
+				return tpkt.Reports[0].SSRC, true
+			}
+
+		case *rtcp.SenderReport:
+			if len(tpkt.Reports) > 0 {
+				return tpkt.Reports[0].SSRC, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// rtcpRaiseFractionLost sets the fraction lost of a receiver report with a
+// single report block, if it is lower than the given one
+func rtcpRaiseFractionLost(rr []byte, fraction uint8) []byte {
+	// header (4 bytes), sender SSRC (4 bytes), source SSRC (4 bytes), fraction lost
+	if len(rr) < 13 || rr[1] != 201 || (rr[0]&0x1f) == 0 {
+		return rr
+	}
+
+	if rr[12] < fraction {
+		rr = append([]byte(nil), rr...)
+		rr[12] = fraction
+	}
+	return rr
+}
+
+// sdpMedias splits a SDP into its media descriptions, each one written on a
+// single line
+func sdpMedias(sdpText []byte) []string {
+	parts := strings.Split(string(sdpText), "\r\nm=")
+	var ret []string
+	for _, part := range parts[1:] {
+		ret = append(ret, "m="+strings.Join(strings.Split(strings.TrimSuffix(part, "\r\n"), "\r\n"), ", "))
+	}
+	return ret
+}
+
+// sdpMediaChanges describes the differences between the media descriptions
+// of two SDPs
+func sdpMediaChanges(oldSdp []byte, newSdp []byte) []string {
+	oldMedias := sdpMedias(oldSdp)
+	newMedias := sdpMedias(newSdp)
+
+	var ret []string
+	for i := 0; i < len(oldMedias) || i < len(newMedias); i++ {
+		switch {
+		case i >= len(newMedias):
+			ret = append(ret, fmt.Sprintf("track %d removed: %s", i, oldMedias[i]))
+
+		case i >= len(oldMedias):
+			ret = append(ret, fmt.Sprintf("track %d added: %s", i, newMedias[i]))
+
+		case oldMedias[i] != newMedias[i]:
+			ret = append(ret, fmt.Sprintf("track %d changed: %s -> %s", i, oldMedias[i], newMedias[i]))
+		}
+	}
+	return ret
+}
+
 func sdpForServer(sin *sdp.SessionDescription) (*sdp.SessionDescription, []byte) {
 	sout := &sdp.SessionDescription{
 		SessionName: "Stream",
@@ -83,7 +476,7 @@ func sdpForServer(sin *sdp.SessionDescription) (*sdp.SessionDescription, []byte)
 			UnicastAddress: "127.0.0.1",
 		},
 		TimeDescriptions: []sdp.TimeDescription{
-			{Timing: sdp.Timing{0, 0}},
+			{Timing: sdp.Timing{StartTime: 0, StopTime: 0}},
 		},
 	}
 
@@ -120,3 +513,166 @@ func sdpForServer(sin *sdp.SessionDescription) (*sdp.SessionDescription, []byte)
 	bytsout := []byte(sout.Marshal())
 	return sout, bytsout
 }
+
+// rtpPayload returns the payload of a RTP packet, skipping the header, the
+// CSRCs and the extension, or nil if the packet is invalid or empty
+func rtpPayload(frame []byte) []byte {
+	if len(frame) < 12 {
+		return nil
+	}
+
+	offset := 12 + int(frame[0]&0x0f)*4
+	if (frame[0] & 0x10) != 0 {
+		if len(frame) < offset+4 {
+			return nil
+		}
+		offset += 4 + (int(frame[offset+2])<<8|int(frame[offset+3]))*4
+	}
+	if len(frame) <= offset {
+		return nil
+	}
+	return frame[offset:]
+}
+
+// sdpMediaEncoding returns the encoding name of a media, that is read from
+// its rtpmap attribute
+func sdpMediaEncoding(m *sdp.MediaDescription) string {
+	for _, attr := range m.Attributes {
+		if attr.Key != "rtpmap" {
+			continue
+		}
+
+		parts := strings.SplitN(attr.Value, " ", 2)
+		if len(parts) == 2 {
+			return strings.ToUpper(strings.SplitN(parts[1], "/", 2)[0])
+		}
+	}
+	return ""
+}
+
+// sdpMediaClockRate returns the clock rate of the RTP timestamps of a media,
+// that is read from its rtpmap attribute or from the static payload type
+func sdpMediaClockRate(m *sdp.MediaDescription) int {
+	for _, attr := range m.Attributes {
+		if attr.Key != "rtpmap" {
+			continue
+		}
+
+		parts := strings.SplitN(attr.Value, " ", 2)
+		if len(parts) == 2 {
+			tmp := strings.Split(parts[1], "/")
+			if len(tmp) >= 2 {
+				v, err := strconv.ParseUint(tmp[1], 10, 31)
+				if err == nil && v > 0 {
+					return int(v)
+				}
+			}
+		}
+	}
+
+	// static payload types of audio codecs, RFC 3551
+	if len(m.MediaName.Formats) > 0 {
+		switch m.MediaName.Formats[0] {
+		case "0", "3", "4", "5", "7", "8", "9", "12", "13", "15", "18":
+			return 8000
+		case "6":
+			return 16000
+		case "10", "11":
+			return 44100
+		case "16":
+			return 11025
+		case "17":
+			return 22050
+		}
+	}
+	return 90000
+}
+
+// sdpMediaFmtp returns the parameters of the fmtp attribute of a media
+func sdpMediaFmtp(m *sdp.MediaDescription) map[string]string {
+	ret := make(map[string]string)
+	for _, attr := range m.Attributes {
+		if attr.Key != "fmtp" {
+			continue
+		}
+
+		parts := strings.SplitN(attr.Value, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		for _, kv := range strings.Split(parts[1], ";") {
+			tmp := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+			if len(tmp) == 2 {
+				ret[strings.ToLower(tmp[0])] = tmp[1]
+			}
+		}
+	}
+	return ret
+}
+
+// sdpMediaIsH264 checks whether a media has been encoded with H264
+func sdpMediaIsH264(m *sdp.MediaDescription) bool {
+	return sdpMediaEncoding(m) == "H264"
+}
+
+// h264IsKeyframeStart checks whether a RTP packet contains the beginning of
+// a IDR frame, or parameter sets, that are sent before IDR frames, as
+// described in RFC 6184
+func h264IsKeyframeStart(frame []byte) bool {
+	payload := rtpPayload(frame)
+	if payload == nil {
+		return false
+	}
+
+	isKeyframeNalu := func(typ byte) bool {
+		return typ == 5 || typ == 7 || typ == 8
+	}
+
+	switch typ := payload[0] & 0x1f; typ {
+	case 24: // STAP-A
+		payload = payload[1:]
+		for len(payload) >= 3 {
+			size := int(payload[0])<<8 | int(payload[1])
+			if size == 0 || len(payload) < 2+size {
+				return false
+			}
+			if isKeyframeNalu(payload[2] & 0x1f) {
+				return true
+			}
+			payload = payload[2+size:]
+		}
+		return false
+
+	case 28: // FU-A
+		return len(payload) >= 2 && (payload[1]&0x80) != 0 && isKeyframeNalu(payload[1]&0x1f)
+
+	default:
+		return isKeyframeNalu(typ)
+	}
+}
+
+// sdpRewrite returns a copy of a SDP generated by sdpForServer, in which the
+// media attributes with the given keys are removed and the given attributes
+// are added to every media. The input is not modified, since it's shared
+// between readers.
+func sdpRewrite(sin *sdp.SessionDescription, remove map[string]struct{}, add []sdp.Attribute) []byte {
+	sout := *sin
+	sout.MediaDescriptions = nil
+
+	for _, min := range sin.MediaDescriptions {
+		mout := *min
+		mout.Attributes = nil
+
+		for _, attr := range min.Attributes {
+			if _, ok := remove[attr.Key]; !ok {
+				mout.Attributes = append(mout.Attributes, attr)
+			}
+		}
+		mout.Attributes = append(mout.Attributes, add...)
+
+		sout.MediaDescriptions = append(sout.MediaDescriptions, &mout)
+	}
+
+	return []byte(sout.Marshal())
+}